@@ -0,0 +1,351 @@
+package aliza
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// How long a confirmation token of bulk deletion is valid at least. It's valid for twice as long at most.
+const ItemDeletionConfirmationWindow = 10 * time.Minute
+
+// The number of items deleted in one transaction. Items share an entity group, so a batch is one
+// transaction instead of one per item, and a task runs one batch well within its deadline.
+const ItemDeletionBatchSize = 20
+
+const ItemDeletionJobKind = "ItemDeletionJob"
+
+// Statuses of item deletion jobs
+const (
+	ItemDeletionRunning = "running"
+	ItemDeletionDone    = "done"
+)
+
+// Header APP Engine sets on requests from task queues. It's removed from external requests.
+const HttpHeaderAppengineQueueName = "X-Appengine-Queuename"
+
+type ItemDeletionRequestBody struct {
+	// Count the items without deleting them, and get a confirmation token
+	DryRun       bool   `json:"dryrun"`
+	// The token of a recent dry run
+	Confirmation string `json:"confirmation"`
+}
+
+type ItemDeletionResponseBody struct {
+	DryRun       bool   `json:"dryrun"`
+	// Items which will be deleted. Only in dry runs.
+	Count        int    `json:"count"`
+	// Pass it back to delete the items. Only in dry runs.
+	Confirmation string `json:"confirmation,omitempty"`
+}
+
+// Bulk deletion of all items. Batches of items are deleted by tasks one after another.
+type ItemDeletionJob struct {
+	Id          string    `json:"id"          datastore:"-"`
+	// The administrator who started the job
+	RequestedBy string    `json:"requestedby"`
+	// running or done
+	Status      string    `json:"status"`
+	// Items deleted so far
+	Deleted     int       `json:"deleted"`
+	// Where the next batch starts in the current pass over the items
+	Cursor      string    `json:"-"           datastore:",noindex"`
+	// Items deleted in the current pass. The job is done after a pass which deletes nothing,
+	// so that items skipped by cursors are deleted in the next pass.
+	PassDeleted int       `json:"-"           datastore:",noindex"`
+	CreateTime  time.Time `json:"createtime"`
+	UpdateTime  time.Time `json:"updatetime"`
+}
+
+// The confirmation token of deleting all items in a time window by an administrator.
+// It doesn't protect anything from the administrator. It makes sure the administrator has done a dry run.
+func itemDeletionToken(userKey string, window int64) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d", userKey, window)))
+	return hex.EncodeToString(h[:])
+}
+
+func itemDeletionWindow(now time.Time) int64 {
+	return now.UnixNano() / int64(ItemDeletionConfirmationWindow)
+}
+
+// Whether the token is issued in the current or the previous window
+func checkItemDeletionToken(token string, userKey string, now time.Time) bool {
+	var window int64 = itemDeletionWindow(now)
+	return token != "" && (token == itemDeletionToken(userKey, window) || token == itemDeletionToken(userKey, window-1))
+}
+
+// Run the next batch of an item deletion job later. It's a push task on APP Engine and a goroutine elsewhere.
+var enqueueItemDeletion func(c Context, jobId string) error = runItemDeletionInBackground
+
+// Run all batches of a job one after another outside the request
+func runItemDeletionInBackground(c Context, jobId string) error {
+	go func() {
+		bc := NewBackgroundLogContext("item-deletion " + jobId)
+		for {
+			done, err := runItemDeletionBatch(bc, jobId)
+			if err != nil {
+				bc.Errorf("%s in deleting items. Stop.", err)
+				return
+			}
+			if done {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Delete a batch of items in one transaction, notify their members and remove their GCM groups.
+// They can be restored within the restore window. Record the progress in the job.
+// Return true if the job is done, or if another run of the same batch has recorded it first.
+func runItemDeletionBatch(c Context, jobId string) (done bool, err error) {
+	pJob, err := store.ItemDeletionJobs().Get(c, jobId)
+	if err != nil {
+		c.Errorf("%s in getting item deletion job %s", err, jobId)
+		return
+	}
+	if pJob.Status == ItemDeletionDone {
+		return true, nil
+	}
+	var cursor string = pJob.Cursor
+
+	var items []Item
+	var next string
+	if items, next, err = store.Items().Query(c, ItemQuery{Limit: ItemDeletionBatchSize, Cursor: cursor}); err != nil {
+		c.Errorf("%s in querying items to delete", err)
+		return
+	}
+	var now time.Time = time.Unix(time.Now().Unix(), 0)
+	var deleted []Item
+	err = store.RunInTransaction(c, func(tc Context) error {
+		deleted = nil
+		for _, v := range items {
+			// The item may have been changed or deleted since the query
+			pItem, err1 := store.Items().Get(tc, v.Id)
+			if err1 == ErrNotFound {
+				continue
+			} else if err1 != nil {
+				return err1
+			}
+			if err1 = softDeleteItem(tc, v.Id, pItem, pJob.RequestedBy, now); err1 != nil {
+				return err1
+			}
+			deleted = append(deleted, *pItem)
+		}
+		return nil
+	})
+	if err != nil {
+		c.Errorf("%s in deleting a batch of %d items", err, len(items))
+		return
+	}
+	for i := range deleted {
+		notifyItemDeleted(c, &deleted[i], "Administrator deleted the item. ", pJob.RequestedBy)
+	}
+
+	// Record the progress unless another run of this batch has done it
+	err = store.RunInTransaction(c, func(tc Context) error {
+		done = false
+		pLatest, err1 := store.ItemDeletionJobs().Get(tc, jobId)
+		if err1 != nil {
+			return err1
+		}
+		if pLatest.Status == ItemDeletionDone || pLatest.Cursor != cursor {
+			done = true
+			return nil
+		}
+		pLatest.Deleted += len(deleted)
+		pLatest.PassDeleted += len(deleted)
+		pLatest.Cursor = next
+		if next == "" {
+			if pLatest.PassDeleted == 0 {
+				pLatest.Status = ItemDeletionDone
+				done = true
+			}
+			pLatest.PassDeleted = 0
+		}
+		pLatest.UpdateTime = now
+		return store.ItemDeletionJobs().Update(tc, jobId, pLatest)
+	})
+	if err != nil {
+		c.Errorf("%s in recording progress of item deletion job %s", err, jobId)
+		return
+	}
+	c.Infof("Deleted %d items in job %s. Done: %t", len(deleted), jobId, done)
+	return
+}
+
+// POST ./admin/item-deletions
+// Delete all items. Only administrators can call it. Do a dry run first to get the number of items
+// and a confirmation token, then pass the token back within 10 minutes to start deleting them.
+// Success: 200 OK with the number of items in a dry run, or 202 Accepted with the job and its URL
+// in the Location header
+// Failure: 400 Bad Request, 403 Forbidden, 500 Internal Server Error
+func deleteItems(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Infof("DeleteItems()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Response
+	var body ItemDeletionResponseBody
+	var job ItemDeletionJob
+
+	defer func() {
+		if r == http.StatusOK {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusOK)
+			json.NewEncoder(rw).Encode(body)
+		} else if r == http.StatusAccepted {
+			rw.Header().Set("Location", req.URL.String()+"/"+job.Id)
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(rw).Encode(job)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get data from body
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		c.Errorf("%s in reading body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
+		return
+	}
+	var deletion ItemDeletionRequestBody
+	if err = json.Unmarshal(b, &deletion); err != nil {
+		c.Errorf("%s in decoding body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be a deletion request in JSON")
+		return
+	}
+
+	userKey, _ := RequestUser(req)
+	var now time.Time = time.Now()
+	if deletion.DryRun {
+		body.DryRun = true
+		if body.Count, err = store.Items().Count(c); err != nil {
+			c.Errorf("%s in counting items", err)
+			r = http.StatusInternalServerError
+			return
+		}
+		body.Confirmation = itemDeletionToken(userKey, itemDeletionWindow(now))
+		c.Infof("Administrator %s would delete %d items", userKey, body.Count)
+		return
+	}
+	if !checkItemDeletionToken(deletion.Confirmation, userKey, now) {
+		c.Warningf("Invalid or expired confirmation token %s", deletion.Confirmation)
+		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeConfirmationRequired, "confirmation", "Do a dry run and pass its confirmation token within 10 minutes")
+		return
+	}
+
+	job = ItemDeletionJob{
+		RequestedBy: userKey,
+		Status:      ItemDeletionRunning,
+		CreateTime:  time.Unix(now.Unix(), 0),
+		UpdateTime:  time.Unix(now.Unix(), 0),
+	}
+	if _, err = store.ItemDeletionJobs().Create(c, &job); err != nil {
+		c.Errorf("%s in storing item deletion job", err)
+		r = http.StatusInternalServerError
+		return
+	}
+	if err = enqueueItemDeletion(c, job.Id); err != nil {
+		c.Errorf("%s in starting item deletion job %s", err, job.Id)
+		r = http.StatusInternalServerError
+		return
+	}
+	r = http.StatusAccepted
+	c.Infof("Administrator %s started deleting all items in job %s", userKey, job.Id)
+}
+
+// GET ./admin/item-deletions/xxx, xxx: Job key
+// Progress of a bulk deletion
+// Success: 200 OK with the job
+// Failure: 403 Forbidden, 404 Not Found, 500 Internal Server Error
+func queryItemDeletion(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("QueryItemDeletion()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Job key
+	var keyString string = params.Get("id")
+	var pJob *ItemDeletionJob
+
+	defer func() {
+		if r == http.StatusOK {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusOK)
+			json.NewEncoder(rw).Encode(pJob)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	var err error
+	if pJob, err = store.ItemDeletionJobs().Get(c, keyString); err == ErrNotFound || err == ErrInvalidId {
+		c.Warningf("%s in getting item deletion job %s", err, keyString)
+		r = http.StatusNotFound
+		e = NewApiError(ErrCodeDeletionJobNotFound, "Item deletion job is not found")
+		return
+	} else if err != nil {
+		c.Errorf("%s in getting item deletion job %s", err, keyString)
+		r = http.StatusInternalServerError
+		return
+	}
+}
+
+// POST ./tasks/item-deletions/xxx, xxx: Job key
+// Called by the task queue on APP Engine. Delete a batch of items and queue the next batch.
+// Success: 200 OK
+// Failure: 403 Forbidden, 500 Internal Server Error, which makes the task queue retry
+func itemDeletionTask(rw http.ResponseWriter, req *http.Request, params Params) {
+	// Appengine
+	var c Context = newContext(req)
+	// Result
+	var r int = http.StatusOK
+	// Job key
+	var keyString string = params.Get("id")
+
+	defer func() {
+		if r == http.StatusOK {
+			rw.WriteHeader(r)
+		} else {
+			writeError(rw, r, nil)
+		}
+	}()
+
+	// Only task queues can delete
+	if req.Header.Get(HttpHeaderAppengineQueueName) == "" {
+		c.Warningf("Request is not from a task queue. Ignore.")
+		r = http.StatusForbidden
+		return
+	}
+
+	done, err := runItemDeletionBatch(c, keyString)
+	if err == ErrNotFound || err == ErrInvalidId {
+		// Nothing to retry
+		return
+	} else if err != nil {
+		r = http.StatusInternalServerError
+		return
+	}
+	if done {
+		return
+	}
+	if err = enqueueItemDeletion(c, keyString); err != nil {
+		c.Errorf("%s in queuing the next batch of item deletion job %s", err, keyString)
+		r = http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,32 @@
+package aliza
+
+import (
+	"errors"
+)
+
+// Blob storage for uploaded files, e.g. images
+type BlobStore interface {
+	// Store a blob. Overwrite the existing one with the same name.
+	Put(c Context, name string, contentType string, data []byte) error
+	// Get returns ErrBlobNotFound if the blob doesn't exist
+	Get(c Context, name string) ([]byte, error)
+	// Delete returns ErrBlobNotFound if the blob doesn't exist
+	Delete(c Context, name string) error
+	// The public URL to download the blob
+	URL(c Context, name string) (string, error)
+}
+
+// Errors returned by blob stores
+var (
+	ErrBlobNotFound    = errors.New("Blob not found")
+	ErrInvalidBlobName = errors.New("Invalid blob name")
+)
+
+// The blob store used by all handlers. It's Google Cloud Storage on APP Engine.
+// Elsewhere it must be set by SetBlobStore().
+var blobStore BlobStore
+
+// Replace the blob store. Call it before serving requests.
+func SetBlobStore(b BlobStore) {
+	blobStore = b
+}
@@ -0,0 +1,119 @@
+//go:build appengine
+// +build appengine
+
+package aliza
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	gcscontext   "golang.org/x/net/context"
+	gcsappengine "google.golang.org/appengine"
+	gcsfile      "google.golang.org/appengine/file"
+	"google.golang.org/cloud/storage"
+)
+
+// Blob store on Google Cloud Storage. Blobs are readable by all users.
+type gcsBlobStore struct {
+	// Bucket name. Empty means the default bucket of the APP.
+	bucketName string
+}
+
+func NewGcsBlobStore(bucketName string) BlobStore {
+	return &gcsBlobStore{bucketName: bucketName}
+}
+
+// Get Google Cloud Storage authentication from the request of the context
+func gcsContext(c Context) gcscontext.Context {
+	return gcsappengine.NewContext(appengineContext(c).Request().(*http.Request))
+}
+
+// Get the bucket name
+func (b *gcsBlobStore) bucket(cc gcscontext.Context) (string, error) {
+	if b.bucketName != "" {
+		return b.bucketName, nil
+	}
+	return gcsfile.DefaultBucketName(cc)
+}
+
+// Open a client and the bucket. Caller must close the client.
+func (b *gcsBlobStore) open(c Context) (cc gcscontext.Context, client *storage.Client, bucketHandle *storage.BucketHandle, err error) {
+	var bucketName string
+	cc = gcsContext(c)
+	if bucketName, err = b.bucket(cc); err != nil {
+		c.Errorf("%s in getting default GCS bucket name", err)
+		return
+	}
+	if client, err = storage.NewClient(cc); err != nil {
+		c.Errorf("%s in initializing a GCS client", err)
+		return
+	}
+	bucketHandle = client.Bucket(bucketName)
+	return
+}
+
+func (b *gcsBlobStore) Put(c Context, name string, contentType string, data []byte) error {
+	cc, client, bucketHandle, err := b.open(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Change default object ACLs
+	if err = bucketHandle.DefaultObjectACL().Set(cc, storage.AllUsers, storage.RoleReader); err != nil {
+		c.Errorf("%v in saving default object ACL rule", err)
+		return err
+	}
+
+	wc := bucketHandle.Object(name).NewWriter(cc)
+	wc.ContentType = contentType
+	if _, err = wc.Write(data); err != nil {
+		c.Errorf("%s in writing file %s", err, name)
+		wc.Close()
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		c.Errorf("%s in closing file %s", err, name)
+		return err
+	}
+	return nil
+}
+
+func (b *gcsBlobStore) Get(c Context, name string) ([]byte, error) {
+	cc, client, bucketHandle, err := b.open(c)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	rc, err := bucketHandle.Object(name).NewReader(cc)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func (b *gcsBlobStore) Delete(c Context, name string) error {
+	cc, client, bucketHandle, err := b.open(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = bucketHandle.Object(name).Delete(cc)
+	if err == storage.ErrObjectNotExist {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (b *gcsBlobStore) URL(c Context, name string) (string, error) {
+	bucketName, err := b.bucket(gcsContext(c))
+	if err != nil {
+		return "", err
+	}
+	return "http://" + bucketName + ".storage.googleapis.com/" + name, nil
+}
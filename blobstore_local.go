@@ -0,0 +1,90 @@
+package aliza
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Blob store in a local directory, for development and tests.
+// Blobs are expected to be served at BaseURL, e.g. by http.FileServer.
+type LocalBlobStore struct {
+	Dir     string
+	BaseURL string
+}
+
+func NewLocalBlobStore(dir string, baseURL string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &LocalBlobStore{Dir: dir, BaseURL: baseURL}, nil
+}
+
+// Get the file path of a blob. Names can't contain directories.
+func (b *LocalBlobStore) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", ErrInvalidBlobName
+	}
+	return filepath.Join(b.Dir, name), nil
+}
+
+func (b *LocalBlobStore) Put(c Context, name string, contentType string, data []byte) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that readers never see a partial blob
+	f, err := ioutil.TempFile(b.Dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (b *LocalBlobStore) Get(c Context, name string) ([]byte, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (b *LocalBlobStore) Delete(c Context, name string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (b *LocalBlobStore) URL(c Context, name string) (string, error) {
+	if _, err := b.path(name); err != nil {
+		return "", err
+	}
+	return b.BaseURL + name, nil
+}
@@ -0,0 +1,112 @@
+//go:build !appengine
+// +build !appengine
+
+// Command aliza runs the Aliza API on a plain net/http server outside APP Engine.
+//
+// Usage:
+//	aliza -config config.json -addr :8080 -blobs ./blobs -push fcm
+//
+// Configuration is loaded like on APP Engine: the file, its profile selected by ALIZA_PROFILE,
+// then ALIZA_* environment variables.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/junglesung/Aliza"
+)
+
+// Path to serve blobs of the local blob store
+const BlobsPath = "/blobs/"
+
+func main() {
+	var addr = flag.String("addr", ":8080", "Address to listen on")
+	var storage = flag.String("store", "memory", "Storage backend. Valid: memory")
+	var blobs = flag.String("blobs", "blobs", "Directory to store uploaded images")
+	var publicURL = flag.String("public-url", "http://localhost:8080", "URL prefix clients use to reach this server")
+	var push = flag.String("push", "fake", "Push provider. Valid: fcm, fake")
+	var configFile = flag.String("config", aliza.ConfigFile, "Configuration file")
+	var sweep = flag.Duration("sweep", time.Minute, "Interval to close expired items like the cron job on APP Engine. 0 to disable.")
+	flag.Parse()
+
+	// Configuration
+	cfg, err := aliza.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	aliza.SetConfig(cfg)
+
+	// Storage backend
+	switch *storage {
+	case "memory":
+		aliza.SetStore(aliza.NewMemoryStore())
+	default:
+		log.Fatalf("Unknown storage backend %s", *storage)
+	}
+
+	// Blob store
+	blobStore, err := aliza.NewLocalBlobStore(*blobs, *publicURL+BlobsPath)
+	if err != nil {
+		log.Fatalf("%s in creating blob directory %s", err, *blobs)
+	}
+	aliza.SetBlobStore(blobStore)
+
+	// Push provider
+	switch *push {
+	case "fcm":
+		n, err := aliza.NewFcmNotifierFromConfig(cfg)
+		if err != nil {
+			log.Fatalf("%s in initializing FCM with service account %s", err, cfg.FcmServiceAccountFile)
+		}
+		aliza.SetNotifier(n)
+	case "fake":
+		aliza.SetNotifier(aliza.NewRecordingNotifier())
+	default:
+		log.Fatalf("Unknown push provider %s", *push)
+	}
+
+	// Routes
+	mux := http.NewServeMux()
+	aliza.RegisterHandlers(mux)
+	mux.Handle(BlobsPath, http.StripPrefix(BlobsPath, http.FileServer(http.Dir(*blobs))))
+
+	server := &http.Server{
+		Addr:         *addr,
+		Handler:      mux,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+	// Close expired items periodically
+	if *sweep > 0 {
+		go sweepExpiredItems(*sweep)
+	}
+
+	log.Printf("Aliza listens on %s with %s storage and %s push in profile %s", *addr, *storage, *push, cfg.Profile)
+	log.Fatal(server.ListenAndServe())
+}
+
+// Close expired items, delete expired idempotency records, purge deleted items and backfill old items every interval
+func sweepExpiredItems(interval time.Duration) {
+	c := aliza.NewBackgroundLogContext("sweeper")
+	for range time.Tick(interval) {
+		if n, err := aliza.ExpireItems(c, time.Now()); err != nil {
+			c.Errorf("%s in closing expired items", err)
+		} else if n > 0 {
+			c.Infof("Closed %d expired items", n)
+		}
+		aliza.ExpireIdempotencyRecords(c, time.Now())
+		if n, err := aliza.PurgeDeletedItems(c, time.Now()); err != nil {
+			c.Errorf("%s in purging deleted items", err)
+		} else if n > 0 {
+			c.Infof("Purged %d deleted items", n)
+		}
+		if n, err := aliza.BackfillItems(c, time.Now()); err != nil {
+			c.Errorf("%s in backfilling items", err)
+		} else if n > 0 {
+			c.Infof("Backfilled %d items", n)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !appengine
+// +build !appengine
+
+// Command genindex writes the datastore composite indexes which item searches need.
+//
+// Usage:
+//	genindex -o index.yaml
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/junglesung/Aliza"
+)
+
+func main() {
+	var output = flag.String("o", "index.yaml", "Output file. - for standard output.")
+	flag.Parse()
+
+	var w *os.File = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := aliza.WriteIndexYaml(w); err != nil {
+		log.Fatal(err)
+	}
+}
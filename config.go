@@ -0,0 +1,226 @@
+package aliza
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Secret is a string which never shows up in logs or JSON output
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "******"
+}
+
+func (s Secret) GoString() string {
+	return strconv.Quote(s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Configuration of the server. Loaded from a JSON file, then overridden by environment variables.
+// The file contains base values and a "profiles" object whose members override them per environment, e.g.
+//	{"appnamespace":"com.example", "profiles":{"dev":{"skiptokenverification":true}}}
+type Config struct {
+	// dev, staging or prod
+	Profile                   string `json:"profile"                   env:"ALIZA_PROFILE"`
+	// APP package name which registration tokens must belong to
+	AppNamespace              string `json:"appnamespace"              env:"ALIZA_APP_NAMESPACE"`
+	// Google project number, i.e. GCM sender ID
+	GaeProjectNumber          string `json:"gaeprojectnumber"          env:"ALIZA_GAE_PROJECT_NUMBER"`
+	// Google Instance ID authenticity service
+	InstanceIdVerificationUrl string `json:"instanceidverificationurl" env:"ALIZA_INSTANCE_ID_VERIFICATION_URL"`
+	// Server key to access Google Instance ID service and legacy GCM
+	GcmApiKey                 Secret `json:"gcmapikey"                 env:"ALIZA_GCM_API_KEY"`
+	// Legacy GCM servers
+	GcmURL                    string `json:"gcmurl"                    env:"ALIZA_GCM_URL"`
+	GcmGroupURL               string `json:"gcmgroupurl"               env:"ALIZA_GCM_GROUP_URL"`
+	// FCM HTTP v1 servers
+	FcmBaseURL                string `json:"fcmbaseurl"                env:"ALIZA_FCM_BASE_URL"`
+	FcmGroupURL               string `json:"fcmgroupurl"               env:"ALIZA_FCM_GROUP_URL"`
+	// Service account key file for FCM
+	FcmServiceAccountFile     string `json:"fcmserviceaccountfile"     env:"ALIZA_FCM_SERVICE_ACCOUNT_FILE"`
+	// Accept registration tokens without asking Google Instance ID service. Not allowed in prod.
+	SkipTokenVerification     bool   `json:"skiptokenverification"     env:"ALIZA_SKIP_TOKEN_VERIFICATION"`
+	// Comma separated instance IDs of administrators who can delete any item
+	AdminInstanceIds          string `json:"admininstanceids"          env:"ALIZA_ADMIN_INSTANCE_IDS"`
+	// How long deleted items can be restored before they are purged, e.g. "72h"
+	ItemRestoreWindow         string `json:"itemrestorewindow"         env:"ALIZA_ITEM_RESTORE_WINDOW"`
+}
+
+// Profiles
+const (
+	ProfileDev     = "dev"
+	ProfileStaging = "staging"
+	ProfileProd    = "prod"
+)
+
+// Default config file deployed with the APP
+const ConfigFile = "config.json"
+
+// The configuration used by all handlers
+var config *Config = DefaultConfig()
+
+// Replace the configuration. Call it before serving requests.
+func SetConfig(cfg *Config) {
+	config = cfg
+}
+
+// Configuration with public Google server URLs. Deployment specific values are left empty.
+func DefaultConfig() *Config {
+	return &Config{
+		Profile:                   ProfileDev,
+		InstanceIdVerificationUrl: "https://iid.googleapis.com/iid/info/",
+		GcmURL:                    "https://gcm-http.googleapis.com/gcm/send",
+		GcmGroupURL:               "https://android.googleapis.com/gcm/notification",
+		FcmBaseURL:                FcmBaseURL,
+		FcmGroupURL:               FcmGroupURL,
+		FcmServiceAccountFile:     FcmServiceAccountFile,
+		ItemRestoreWindow:         "72h",
+	}
+}
+
+// Load configuration from a file and environment variables, and validate it.
+// The profile is taken from ALIZA_PROFILE, then the file, and is "dev" by default.
+// A missing file is fine as long as environment variables complete the configuration.
+func LoadConfig(path string) (*Config, error) {
+	var cfg *Config = DefaultConfig()
+
+	// Read the file
+	var file struct {
+		Profiles map[string]json.RawMessage `json:"profiles"`
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s in decoding %s", err, path)
+		}
+		if err = json.Unmarshal(b, &file); err != nil {
+			return nil, fmt.Errorf("%s in decoding %s", err, path)
+		}
+	}
+
+	// Apply the profile
+	if v := os.Getenv("ALIZA_PROFILE"); v != "" {
+		cfg.Profile = v
+	}
+	if v, ok := file.Profiles[cfg.Profile]; ok {
+		if err = json.Unmarshal(v, cfg); err != nil {
+			return nil, fmt.Errorf("%s in decoding profile %s of %s", err, cfg.Profile, path)
+		}
+	}
+
+	// Environment variables win
+	if err = cfg.applyEnvironment(); err != nil {
+		return nil, err
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Override fields by the environment variables in their env tags
+func (cfg *Config) applyEnvironment() error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		s, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(s)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("Environment variable %s should be true or false", name)
+			}
+			f.SetBool(b)
+		}
+	}
+	return nil
+}
+
+// Whether the instance ID belongs to an administrator
+func (cfg *Config) IsAdmin(instanceId string) bool {
+	if instanceId == "" {
+		return false
+	}
+	for _, v := range strings.Split(cfg.AdminInstanceIds, ",") {
+		if strings.TrimSpace(v) == instanceId {
+			return true
+		}
+	}
+	return false
+}
+
+// How long deleted items can be restored. Validate() makes sure it's a positive duration.
+func (cfg *Config) RestoreWindow() time.Duration {
+	d, _ := time.ParseDuration(cfg.ItemRestoreWindow)
+	return d
+}
+
+// Check the configuration is complete and consistent
+func (cfg *Config) Validate() error {
+	var problems []string
+
+	switch cfg.Profile {
+	case ProfileDev, ProfileStaging, ProfileProd:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown profile %q", cfg.Profile))
+	}
+	if cfg.AppNamespace == "" {
+		problems = append(problems, "appnamespace is empty")
+	}
+	if cfg.GaeProjectNumber == "" {
+		problems = append(problems, "gaeprojectnumber is empty")
+	} else if _, err := strconv.ParseUint(cfg.GaeProjectNumber, 10, 64); err != nil {
+		problems = append(problems, "gaeprojectnumber should be a number")
+	}
+	for _, v := range []struct{ name, value string }{
+		{"instanceidverificationurl", cfg.InstanceIdVerificationUrl},
+		{"gcmurl", cfg.GcmURL},
+		{"gcmgroupurl", cfg.GcmGroupURL},
+		{"fcmbaseurl", cfg.FcmBaseURL},
+		{"fcmgroupurl", cfg.FcmGroupURL},
+	} {
+		if u, err := url.Parse(v.value); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, v.name+" is not an absolute URL")
+		}
+	}
+	if !cfg.SkipTokenVerification && cfg.GcmApiKey == "" {
+		problems = append(problems, "gcmapikey is required to verify registration tokens")
+	}
+	if d, err := time.ParseDuration(cfg.ItemRestoreWindow); err != nil || d <= 0 {
+		problems = append(problems, "itemrestorewindow should be a positive duration, e.g. 72h")
+	}
+	if cfg.SkipTokenVerification && cfg.Profile == ProfileProd {
+		problems = append(problems, "skiptokenverification is not allowed in prod")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
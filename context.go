@@ -0,0 +1,70 @@
+package aliza
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Context is what handlers and repositories need from a request: leveled logging.
+// appengine.Context satisfies it. Repositories may require more, e.g. the datastore
+// repositories require an appengine.Context underneath.
+type Context interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Create the context of a request. It's appengine.NewContext() on APP Engine.
+var newContext func(req *http.Request) Context = NewLogContext
+
+// Get an HTTP client to send outgoing requests in the context. It's URL fetch service on APP Engine.
+var httpClient func(c Context) *http.Client = defaultHTTPClient
+
+func defaultHTTPClient(c Context) *http.Client {
+	return http.DefaultClient
+}
+
+// Context which writes logs with the standard logger.
+// It stands in for appengine.Context outside APP Engine.
+type logContext struct {
+	prefix string
+}
+
+// Sequence number to tell log lines of different requests apart when there is no request ID
+var logContextSequence uint64
+
+func NewLogContext(req *http.Request) Context {
+	var id string = RequestId(req)
+	if id == "" {
+		id = fmt.Sprint(atomic.AddUint64(&logContextSequence, 1))
+	}
+	return &logContext{prefix: fmt.Sprintf("[%s %s %s] ", id, req.Method, req.URL.Path)}
+}
+
+// Context of work which doesn't serve a request, e.g. a background job outside APP Engine
+func NewBackgroundLogContext(name string) Context {
+	return &logContext{prefix: "[" + name + "] "}
+}
+
+func (c *logContext) logf(level string, format string, args ...interface{}) {
+	log.Printf("%s %s%s", level, c.prefix, fmt.Sprintf(format, args...))
+}
+
+func (c *logContext) Debugf(format string, args ...interface{}) {
+	c.logf("DEBUG", format, args...)
+}
+
+func (c *logContext) Infof(format string, args ...interface{}) {
+	c.logf("INFO", format, args...)
+}
+
+func (c *logContext) Warningf(format string, args ...interface{}) {
+	c.logf("WARNING", format, args...)
+}
+
+func (c *logContext) Errorf(format string, args ...interface{}) {
+	c.logf("ERROR", format, args...)
+}
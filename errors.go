@@ -0,0 +1,161 @@
+package aliza
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error response body of all endpoints, e.g.
+//	{"code":"item_full","message":"Too many attendants","details":[{"field":"attendant","message":"3 + 2 > 4"}]}
+// Clients should switch on Code. Message and details are for humans and may change.
+type ApiError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// Validation failure of one field in a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error codes. They are part of the API. Never change existing ones.
+const (
+	// Generic codes by HTTP status
+	ErrCodeBadRequest            = "bad_request"
+	ErrCodeForbidden             = "forbidden"
+	ErrCodeNotFound              = "not_found"
+	ErrCodeMethodNotAllowed      = "method_not_allowed"
+	ErrCodeConflict              = "conflict"
+	ErrCodePreconditionFailed    = "precondition_failed"
+	ErrCodeInternal              = "internal_error"
+	// Requests
+	ErrCodeInvalidBody           = "invalid_body"
+	ErrCodeInvalidId             = "invalid_id"
+	ErrCodeInvalidQuery          = "invalid_query"
+	ErrCodeFieldRequired         = "field_required"
+	ErrCodeUnauthenticated       = "unauthenticated"
+	ErrCodeAdminRequired         = "admin_required"
+	ErrCodeInvalidIdempotencyKey = "invalid_idempotency_key"
+	ErrCodeIdempotencyKeyReused  = "idempotency_key_reused"
+	ErrCodeIdempotencyInProgress = "idempotency_in_progress"
+	// Users
+	ErrCodeInvalidInstanceId     = "invalid_instance_id"
+	ErrCodeInvalidToken          = "invalid_registration_token"
+	ErrCodeUserNotFound          = "user_not_found"
+	// Images
+	ErrCodeUnsupportedImage      = "unsupported_image_type"
+	ErrCodeInvalidImage          = "invalid_image"
+	// Items
+	ErrCodeItemNotFound          = "item_not_found"
+	ErrCodeImageRequired         = "image_required"
+	ErrCodeInvalidAttendant      = "invalid_attendant"
+	ErrCodeInvalidPeople         = "invalid_people"
+	ErrCodeInvalidLocation       = "invalid_location"
+	ErrCodeOwnerNotSet           = "owner_not_set"
+	ErrCodeAttendantMismatch     = "attendant_mismatch"
+	ErrCodeContactRequired       = "contact_required"
+	ErrCodeItemFull              = "item_full"
+	ErrCodeTooFewAttendants      = "too_few_attendants"
+	ErrCodeDuplicateLeave        = "duplicate_leave"
+	ErrCodeInvalidDeadline       = "invalid_deadline"
+	ErrCodeDescriptionTooLong    = "description_too_long"
+	ErrCodeInvalidStatus         = "invalid_status"
+	ErrCodeInvalidTransition     = "invalid_status_transition"
+	ErrCodeItemNotActive         = "item_not_active"
+	ErrCodeNotItemOwner          = "not_item_owner"
+	ErrCodeNotItemMember         = "not_item_member"
+	ErrCodeAlreadyMember         = "already_member"
+	ErrCodeItemNotFull           = "item_not_full"
+	ErrCodeNotWaitlisted         = "not_waitlisted"
+	ErrCodeBannedFromItem        = "banned_from_item"
+	ErrCodeCannotRemoveOwner     = "cannot_remove_owner"
+	ErrCodeNotBanned             = "not_banned"
+	ErrCodeAlreadyBanned         = "already_banned"
+	ErrCodeConfirmationRequired  = "confirmation_required"
+	ErrCodeDeletionJobNotFound   = "deletion_job_not_found"
+	ErrCodeRestoreWindowPassed   = "restore_window_passed"
+	// Comments
+	ErrCodeCommentNotFound       = "comment_not_found"
+	ErrCodeCommentTooLong        = "comment_too_long"
+	ErrCodeNotCommentAuthor      = "not_comment_author"
+	// Saved searches
+	ErrCodeSavedSearchNotFound   = "saved_search_not_found"
+	ErrCodeInvalidRadius         = "invalid_radius"
+	ErrCodeInvalidMinOpenSlots   = "invalid_min_open_slots"
+	ErrCodeInvalidKeywords       = "invalid_keywords"
+	ErrCodeTooManySavedSearches  = "too_many_saved_searches"
+	// Groups
+	ErrCodeGroupNotFound         = "group_not_found"
+	ErrCodeGroupNameRequired     = "group_name_required"
+	// Push notifications
+	ErrCodeNotificationRejected  = "notification_rejected"
+	ErrCodeNotificationFailed    = "notification_failed"
+)
+
+func NewApiError(code string, message string) *ApiError {
+	return &ApiError{Code: code, Message: message}
+}
+
+// Error about one field of the request
+func NewFieldError(code string, field string, message string) *ApiError {
+	return NewApiError(code, message).WithField(field, message)
+}
+
+// Add a field validation detail
+func (e *ApiError) WithField(field string, message string) *ApiError {
+	e.Details = append(e.Details, FieldError{Field: field, Message: message})
+	return e
+}
+
+func (e *ApiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Generic error of an HTTP status
+func statusError(status int) *ApiError {
+	var code string
+	switch status {
+	case http.StatusBadRequest:
+		code = ErrCodeBadRequest
+	case http.StatusForbidden:
+		code = ErrCodeForbidden
+	case http.StatusNotFound:
+		code = ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		code = ErrCodeMethodNotAllowed
+	case http.StatusConflict:
+		code = ErrCodeConflict
+	case http.StatusPreconditionFailed:
+		code = ErrCodePreconditionFailed
+	default:
+		code = ErrCodeInternal
+	}
+	return NewApiError(code, http.StatusText(status))
+}
+
+// Error of a failed push notification or group operation
+func notificationError(status int) *ApiError {
+	if status == http.StatusBadRequest {
+		return NewApiError(ErrCodeNotificationRejected, "Push provider rejected the notification")
+	}
+	return NewApiError(ErrCodeNotificationFailed, "Push provider is unavailable")
+}
+
+// Write an error response with the HTTP status.
+// Use the generic error of the status if e is nil.
+func writeError(rw http.ResponseWriter, status int, e *ApiError) {
+	if e == nil {
+		e = statusError(status)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		http.Error(rw, http.StatusText(status), status)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	rw.Write(append(b, '\n'))
+}
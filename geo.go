@@ -0,0 +1,111 @@
+package aliza
+
+import (
+	"math"
+)
+
+// Mean earth radius in kilometers
+const EarthRadiusKm = 6371.0
+
+// Length of one latitude degree in kilometers
+const kmPerDegree = EarthRadiusKm * math.Pi / 180
+
+// Precision of geohashes stored in items. 9 characters are about 5 meters.
+const GeohashPrecision = 9
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Encode a location into a geohash. Locations in the same cell share the prefix,
+// so that a cell can be searched by a range of geohashes.
+func encodeGeohash(latitude float64, longitude float64, precision int) string {
+	var latRange = [2]float64{-90, 90}
+	var lonRange = [2]float64{-180, 180}
+	var hash []byte = make([]byte, 0, precision)
+	// Bits alternate between longitude and latitude, starting from longitude
+	var even bool = true
+	var bit, ch int
+	for len(hash) < precision {
+		var r *[2]float64 = &latRange
+		var v float64 = latitude
+		if even {
+			r = &lonRange
+			v = longitude
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// Size of a geohash cell in degrees
+func geohashCellDegrees(precision int) (latDegrees float64, lonDegrees float64) {
+	var bits uint = uint(precision) * 5
+	var lonBits uint = (bits + 1) / 2
+	var latBits uint = bits / 2
+	return 180 / float64(uint64(1)<<latBits), 360 / float64(uint64(1)<<lonBits)
+}
+
+// Geohash prefixes of the cells which cover a circle. The cells are the one containing the center
+// and its 8 neighbors at the finest precision whose cells are not smaller than the radius.
+// Return nil if the circle is too large to cover, e.g. near the poles. Don't search all items instead.
+func geohashCover(latitude float64, longitude float64, radiusKm float64) []string {
+	var precision int
+	var latDegrees, lonDegrees float64
+	for p := GeohashPrecision; p >= 1; p-- {
+		h, w := geohashCellDegrees(p)
+		// Cells are narrower toward the poles. Measure the width at the poleward edge of the neighbors.
+		edge := math.Min(90, math.Abs(latitude)+h*2)
+		if h*kmPerDegree >= radiusKm && w*kmPerDegree*math.Cos(edge*math.Pi/180) >= radiusKm {
+			precision, latDegrees, lonDegrees = p, h, w
+			break
+		}
+	}
+	if precision == 0 {
+		return nil
+	}
+
+	var prefixes []string
+	var seen map[string]bool = make(map[string]bool)
+	for _, dLat := range []float64{-latDegrees, 0, latDegrees} {
+		lat := latitude + dLat
+		if lat < -90 || lat > 90 {
+			continue
+		}
+		for _, dLon := range []float64{-lonDegrees, 0, lonDegrees} {
+			lon := longitude + dLon
+			// Wrap around the antimeridian
+			if lon < -180 {
+				lon += 360
+			} else if lon >= 180 {
+				lon -= 360
+			}
+			v := encodeGeohash(lat, lon, precision)
+			if !seen[v] {
+				seen[v] = true
+				prefixes = append(prefixes, v)
+			}
+		}
+	}
+	return prefixes
+}
+
+// Great-circle distance between two locations in kilometers by the haversine formula
+func distanceKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	var rad float64 = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -1,15 +1,9 @@
 package aliza
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
-	"strings"
-	"appengine/urlfetch"
-	"errors"
-	"bytes"
 )
 
 // Data structure got from datastore group kind
@@ -28,7 +22,7 @@ type GroupUser struct {
 	GroupName            string    `json:"groupname"`
 }
 
-// HTTP body to send to Google Cloud Messaging server to manage device groups
+// Device group operation sent to the push provider. It's also the HTTP body to send to Google Cloud Messaging server.
 type GroupOperation struct {
 	Operation            string    `json:"operation"`              // "create", "add", "remove"
 	Notification_key_name string   `json:"notification_key_name"`  // A unique group name in a Google project
@@ -36,26 +30,20 @@ type GroupOperation struct {
 	Registration_ids   []string    `json:"registration_ids"`       // APP registration tokens in the group
 }
 
-// HTTP body received from Google Cloud Messaging server
-type GroupOperationResponse struct {
-	Notification_key     string    `json:"notification_key"`       // A unique key to identify a group
-	Error                string    `json:"error"`                  // Error message
-}
-
 const GroupKind = "Group"
 const GroupRoot = "Group root"
 
-// GCM server
-const GcmGroupURL = "https://android.googleapis.com/gcm/notification"
-
 // PUT ./groups"
+// Header {"Instance-Id":"..."}
 // Success: 204 No Content
 // Failure: 400 Bad Request, 403 Forbidden, 500 Internal Server Error
 func JoinGroup(rw http.ResponseWriter, req *http.Request) {
 	// Appengine
-	var c appengine.Context = appengine.NewContext(req)
+	var c Context = newContext(req)
 	// Return code in a HTTP response
 	var r int = http.StatusNoContent
+	// Error detail
+	var e *ApiError
 	var err error = nil
 
 	// Write response finally
@@ -66,7 +54,7 @@ func JoinGroup(rw http.ResponseWriter, req *http.Request) {
 			// Return status. WriteHeader() must be called before call to Write
 			rw.WriteHeader(r)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
@@ -85,14 +73,25 @@ func JoinGroup(rw http.ResponseWriter, req *http.Request) {
 	if err = json.Unmarshal(b, &user); err != nil {
 		c.Errorf("%s in decoding body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be a group user in JSON")
+		return
+	}
+	if user.GroupName == "" {
+		c.Warningf("Missing group name. Ignore the request.")
+		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeGroupNameRequired, "groupname", "Group name is required")
 		return
 	}
 
-	r = joinGroup(c, user)
+	// Join as the authenticated user regardless of the instance ID in the body
+	_, pUser := RequestUser(req)
+	user.InstanceId = pUser.InstanceId
+
+	r, e = joinGroup(c, user)
 }
 
-func joinGroup(c appengine.Context, user GroupUser) (r int) {
-	var cKey *datastore.Key = nil
+func joinGroup(c Context, user GroupUser) (r int, e *ApiError) {
+	var cKey string
 	var err error = nil
 
 	// Initial variables
@@ -110,6 +109,7 @@ func joinGroup(c appengine.Context, user GroupUser) (r int) {
 	if pUser == nil {
 		c.Errorf("User %s not found. Invalid request. Ignore.", user.InstanceId)
 		r = http.StatusForbidden
+		e = NewApiError(ErrCodeUserNotFound, "User is not registered")
 		return
 	}
 	token = pUser.RegistrationToken
@@ -125,13 +125,14 @@ func joinGroup(c appengine.Context, user GroupUser) (r int) {
 
 	// Make GCM message body
 	var operation GroupOperation
-	if cKey == nil {
+	if pGroup == nil {
 		// Create a new group on GCM server
 		operation.Operation = "create"
 		operation.Notification_key_name = user.GroupName
 		operation.Registration_ids = []string{token}
-		if r = sendGroupOperationToGcm(&operation, c); r != http.StatusOK {
+		if r = sendGroupOperation(c, &operation); r != http.StatusOK {
 			c.Errorf("Send group operation to GCM failed")
+			e = notificationError(r)
 			return
 		}
 		r = http.StatusNoContent
@@ -143,8 +144,7 @@ func joinGroup(c appengine.Context, user GroupUser) (r int) {
 			Members: []string {user.InstanceId},
 			NotificationKey: operation.Notification_key,
 		}
-		var pKey *datastore.Key = datastore.NewKey(c, GroupKind, GroupRoot, 0, nil)
-		cKey, err = datastore.Put(c, datastore.NewIncompleteKey(c, GroupKind, pKey), pGroup)
+		cKey, err = store.Groups().Create(c, pGroup)
 		if err != nil {
 			c.Errorf("%s in storing to datastore", err)
 			r = http.StatusInternalServerError
@@ -157,15 +157,16 @@ func joinGroup(c appengine.Context, user GroupUser) (r int) {
 		operation.Notification_key_name = user.GroupName
 		operation.Notification_key = pGroup.NotificationKey
 		operation.Registration_ids = []string{token}
-		if r = sendGroupOperationToGcm(&operation, c); r != http.StatusOK {
+		if r = sendGroupOperation(c, &operation); r != http.StatusOK {
 			c.Errorf("Send group operation to GCM failed")
+			e = notificationError(r)
 			return
 		}
 		r = http.StatusNoContent
 
 		// Modify datastore
 		pGroup.Members = append(pGroup.Members, token)
-		cKey, err = datastore.Put(c, cKey, pGroup)
+		err = store.Groups().Update(c, cKey, pGroup)
 		if err != nil {
 			c.Errorf("%s in storing to datastore", err)
 			r = http.StatusInternalServerError
@@ -180,11 +181,13 @@ func joinGroup(c appengine.Context, user GroupUser) (r int) {
 // Header {"Instance-Id":"..."}
 // Success returns 204 No Content
 // Failure returns 400 Bad Request, 403 Forbidden, 500 Internal Server Error
-func LeaveGroup(rw http.ResponseWriter, req *http.Request) {
+func LeaveGroup(rw http.ResponseWriter, req *http.Request, params Params) {
 	// Appengine
-	var c appengine.Context = appengine.NewContext(req)
+	var c Context = newContext(req)
 	// Result, 0: success, 1: failed
 	var r int = http.StatusNoContent
+	// Error detail
+	var e *ApiError
 	// Sender instance ID
 	var instanceId string
 	// Group name to leave
@@ -195,46 +198,36 @@ func LeaveGroup(rw http.ResponseWriter, req *http.Request) {
 			// Return status. WriteHeader() must be called before call to Write
 			rw.WriteHeader(r)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
-	// Get instance ID from header
-	instanceId = req.Header.Get("Instance-Id")
-	if instanceId == "" {
-		c.Warningf("Missing instance ID. Ignore the request.")
-		r = http.StatusBadRequest
-		return
-	}
+	// Get instance ID of the authenticated user
+	_, pUser := RequestUser(req)
+	instanceId = pUser.InstanceId
 
 	// Get group name from URL
-	var tokens []string
-	tokens = strings.Split(req.URL.Path, "/")
-	for i, v := range tokens {
-		if v == "groups" && i + 1 < len(tokens) {
-			groupName = tokens[i + 1]
-			break
-		}
-	}
+	groupName = params.Get("name")
 	if groupName == "" {
 		c.Warningf("Missing group name. Ignore the request.")
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeGroupNameRequired, "name", "Group name is required")
 		return
 	}
 
 	// Vernon debug
 	c.Debugf("User %s is going to leave group %s", instanceId, groupName)
 
-	r = leaveGroup(c, instanceId, groupName)
+	r, e = leaveGroup(c, instanceId, groupName)
 }
 
-func leaveGroup(c appengine.Context, instanceId string, groupName string) (r int) {
+func leaveGroup(c Context, instanceId string, groupName string) (r int, e *ApiError) {
 	// Sender registration token
 	var registrationToken string
 	// Then operation sent to GCM server
 	var operation GroupOperation
 	// Group in datastore
-	var cKey *datastore.Key
+	var cKey string
 	var pGroup *Group
 	// Error
 	var err error
@@ -253,6 +246,7 @@ func leaveGroup(c appengine.Context, instanceId string, groupName string) (r int
 	if pUser == nil {
 		c.Errorf("User %s not found. Invalid request. Ignore.", instanceId)
 		r = http.StatusForbidden
+		e = NewApiError(ErrCodeUserNotFound, "User is not registered")
 		return
 	}
 	registrationToken = pUser.RegistrationToken
@@ -264,7 +258,7 @@ func leaveGroup(c appengine.Context, instanceId string, groupName string) (r int
 		r = http.StatusInternalServerError
 		return
 	}
-	if cKey == nil {
+	if pGroup == nil {
 		c.Infof("Group %s has been deleted already", groupName)
 		return
 	}
@@ -293,16 +287,17 @@ func leaveGroup(c appengine.Context, instanceId string, groupName string) (r int
 			operation.Notification_key_name = pGroup.Name
 			operation.Notification_key = pGroup.NotificationKey
 			operation.Registration_ids = []string{registrationToken}
-			if returnCode = sendGroupOperationToGcm(&operation, c); returnCode != http.StatusOK {
+			if returnCode = sendGroupOperation(c, &operation); returnCode != http.StatusOK {
 				c.Warningf("Failed to remove user %s from group %s because sending group operation to GCM failed", v, groupName)
 				r = returnCode
+				e = notificationError(returnCode)
 				continue
 			}
 			c.Infof("User %s is removed from group %s", pUser.InstanceId, groupName)
 		}
 
 		// Modify datastore
-		if err = datastore.Delete(c, cKey); err != nil {
+		if err = store.Groups().Delete(c, cKey); err != nil {
 			c.Errorf("%s in delete group %s from datastore", err, groupName)
 			r = http.StatusInternalServerError
 			return
@@ -317,9 +312,10 @@ func leaveGroup(c appengine.Context, instanceId string, groupName string) (r int
 		operation.Notification_key_name = groupName
 		operation.Notification_key = pGroup.NotificationKey
 		operation.Registration_ids = []string{registrationToken}
-		if returnCode = sendGroupOperationToGcm(&operation, c); returnCode != http.StatusOK {
+		if returnCode = sendGroupOperation(c, &operation); returnCode != http.StatusOK {
 			c.Errorf("Send group operation to GCM failed")
 			r = returnCode
+			e = notificationError(returnCode)
 			return
 		}
 
@@ -334,7 +330,7 @@ func leaveGroup(c appengine.Context, instanceId string, groupName string) (r int
 			}
 		}
 		pGroup.Members = a
-		cKey, err = datastore.Put(c, cKey, pGroup)
+		err = store.Groups().Update(c, cKey, pGroup)
 		if err != nil {
 			c.Errorf("%s in storing to datastore", err)
 			r = http.StatusInternalServerError
@@ -346,10 +342,10 @@ func leaveGroup(c appengine.Context, instanceId string, groupName string) (r int
 	return
 }
 
-// Send a Google Cloud Messaging Device Group operation to GCM server
+// Send a Device Group operation to the push provider
 // Success: 200 OK. Store the notification key from server to the operation structure
 // Failure: 400 Bad Request, 403 Forbidden, 500 Internal Server Error
-func sendGroupOperationToGcm(pOperation *GroupOperation, c appengine.Context) (r int) {
+func sendGroupOperation(c Context, pOperation *GroupOperation) (r int) {
 	// Initial variables
 	var err error = nil
 	r = http.StatusOK
@@ -361,91 +357,28 @@ func sendGroupOperationToGcm(pOperation *GroupOperation, c appengine.Context) (r
 		return
 	}
 
-	// Vernon debug
-	c.Debugf("GCM operation %+v", pOperation)
-
-	// Make a POST request for GCM
-	var b []byte
-	b, err = json.Marshal(pOperation)
-	if err != nil {
-		c.Errorf("%s in encoding an operation as JSON", err)
-		r = http.StatusBadRequest
-		return
-	}
-	pReq, err := http.NewRequest("POST", GcmGroupURL, bytes.NewReader(b))
-	if err != nil {
-		c.Errorf("%s in makeing a HTTP request", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	defer pReq.Body.Close()
-	pReq.Header.Add("Content-Type", "application/json")
-	pReq.Header.Add("Authorization", "key="+GcmApiKey)
-	pReq.Header.Add("project_id", GaeProjectNumber)
-	// Debug
-	c.Debugf("Send request to GCM server %s", *pReq)
-	c.Debugf("Send body to GCM server %s", b)
-
-	// Send request
-	var client = urlfetch.Client(c)
-	resp, err := client.Do(pReq)
-	if err != nil {
-		c.Errorf("%s in sending request", err)
+	switch pOperation.Operation {
+	case "create":
+		pOperation.Notification_key, err = notifier.CreateGroup(c, pOperation.Notification_key_name, pOperation.Registration_ids)
+	case "add":
+		err = notifier.AddToGroup(c, pOperation.Notification_key_name, pOperation.Notification_key, pOperation.Registration_ids)
+	case "remove":
+		err = notifier.RemoveFromGroup(c, pOperation.Notification_key_name, pOperation.Notification_key, pOperation.Registration_ids)
+	default:
+		c.Errorf("Unknown group operation %s", pOperation.Operation)
 		r = http.StatusInternalServerError
 		return
 	}
-	defer resp.Body.Close()
-
-	// Get response body
-	var respBody GroupOperationResponse
-	b, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		c.Errorf("%s in reading response body", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	c.Infof("Receive body %s", b)
-	if err = json.Unmarshal(b, &respBody); err != nil {
-		c.Errorf("%s in decoding JSON response body", err)
-		r = http.StatusInternalServerError
-		return
-	}
-
-	// Check response
-	c.Infof("%d %s", resp.StatusCode, resp.Status)
-	if resp.StatusCode == http.StatusOK {
-		// Success. Write Notification Key to operation structure
-		pOperation.Notification_key = respBody.Notification_key
-		return
-	} else {
-		c.Errorf("GCM server replied that %s", respBody.Error)
-		r = http.StatusBadRequest
+		c.Errorf("%s in group operation %+v", err, pOperation)
+		r = notificationErrorCode(err)
 		return
 	}
+	return
 }
 
-func searchGroup(name string, c appengine.Context) (key *datastore.Key, group *Group, err error) {
-	var v []Group
-	// Initial variables
-	key = nil
-	group = nil
-	err = nil
-
-	// Query
-	f := datastore.NewQuery(GroupKind)
-	f = f.Filter("Name=", name)
-	k, err := f.GetAll(c, &v)
-	if err != nil {
-		c.Errorf("%s in getting data from datastore\n", err)
-		err = errors.New("Datastore is temporary unavailable")
-		return
-	}
-
-	if k == nil || len(k) == 0 {
-		return
-	}
-
-	key = k[0]
-	group = &v[0]
-	return
+// Search for a group by name
+// Return an empty key and a nil group if the group doesn't exist
+func searchGroup(name string, c Context) (key string, group *Group, err error) {
+	return store.Groups().FindByName(c, name)
 }
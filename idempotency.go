@@ -0,0 +1,195 @@
+package aliza
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Header which clients set to retry a request safely
+const HttpHeaderIdempotencyKey = "Idempotency-Key"
+
+// Header set on replayed responses
+const HttpHeaderIdempotentReplayed = "Idempotent-Replayed"
+
+const IdempotencyKind = "IdempotencyRecord"
+
+// How long a response is kept for replays
+const IdempotencyRetention = 24 * time.Hour
+
+// How long the first request may run. A request which crashed is no longer in progress after it.
+const IdempotencyPendingTimeout = time.Minute
+
+const MaxIdempotencyKeyLength = 255
+
+// Response headers which are replayed
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag", "Link"}
+
+// The first request with an idempotency key and its response
+type IdempotencyRecord struct {
+	// Hash of the method, the path and the body
+	Fingerprint string
+	// Response status. 0 while the first request is running.
+	Status      int
+	// Response headers in "Name: value"
+	Header      []string  `datastore:",noindex"`
+	Body        []byte    `datastore:",noindex"`
+	CreateTime  time.Time
+	ExpireTime  time.Time
+}
+
+// Records a response to store it for replays
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseCapture) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseCapture) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// The query is encoded in sorted order so that the same parameters in another order match
+func idempotencyFingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + "\n" + req.URL.Path + "\n" + req.URL.Query().Encode() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Replay requests with the same Idempotency-Key header of the same user. The first response is returned
+// again without running the handler, so that retried requests don't create or join twice.
+// Server errors are not stored so that clients can retry them. Must run after AuthenticateMiddleware.
+func IdempotencyMiddleware(h HandlerFunc) HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request, params Params) {
+		var key string = req.Header.Get(HttpHeaderIdempotencyKey)
+		if key == "" {
+			h(rw, req, params)
+			return
+		}
+		c := newContext(req)
+		if len(key) > MaxIdempotencyKeyLength {
+			c.Warningf("Idempotency key is %d long", len(key))
+			writeError(rw, http.StatusBadRequest, NewFieldError(ErrCodeInvalidIdempotencyKey, HttpHeaderIdempotencyKey,
+				"Idempotency key should be at most 255 characters"))
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			c.Errorf("%s in reading body %s", err, body)
+			writeError(rw, http.StatusBadRequest, NewApiError(ErrCodeInvalidBody, "Failed to read the request body"))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// Keys are per user
+		userKey, _ := RequestUser(req)
+		var recordKey string = userKey + ":" + key
+		var fingerprint string = idempotencyFingerprint(req, body)
+		var now time.Time = time.Now()
+
+		// Reserve the key unless an earlier request has it
+		var pRecord *IdempotencyRecord
+		err = store.RunInTransaction(c, func(tc Context) error {
+			p, err1 := store.Idempotency().Get(tc, recordKey, now)
+			if err1 == nil && !(p.Status == 0 && now.Sub(p.CreateTime) > IdempotencyPendingTimeout) {
+				pRecord = p
+				return nil
+			} else if err1 != nil && err1 != ErrNotFound {
+				return err1
+			}
+			pRecord = nil
+			return store.Idempotency().Put(tc, recordKey, &IdempotencyRecord{
+				Fingerprint: fingerprint,
+				CreateTime:  now,
+				ExpireTime:  now.Add(IdempotencyRetention),
+			})
+		})
+		if err == ErrConcurrentTransaction {
+			c.Warningf("Requests with idempotency key %s collided", key)
+			writeError(rw, http.StatusConflict, NewApiError(ErrCodeIdempotencyInProgress, "A request with the same idempotency key is running"))
+			return
+		} else if err != nil {
+			c.Errorf("%s in reserving idempotency key %s", err, key)
+			writeError(rw, http.StatusInternalServerError, nil)
+			return
+		}
+
+		if pRecord != nil {
+			switch {
+			case pRecord.Fingerprint != fingerprint:
+				c.Warningf("Idempotency key %s is reused by another request", key)
+				writeError(rw, http.StatusUnprocessableEntity, NewFieldError(ErrCodeIdempotencyKeyReused, HttpHeaderIdempotencyKey,
+					"Idempotency key is used by another request"))
+			case pRecord.Status == 0:
+				c.Warningf("Request with idempotency key %s is running", key)
+				writeError(rw, http.StatusConflict, NewApiError(ErrCodeIdempotencyInProgress, "A request with the same idempotency key is running"))
+			default:
+				c.Infof("Replay response %d of idempotency key %s", pRecord.Status, key)
+				for _, v := range pRecord.Header {
+					if i := strings.Index(v, ": "); i > 0 {
+						rw.Header().Set(v[:i], v[i+2:])
+					}
+				}
+				rw.Header().Set(HttpHeaderIdempotentReplayed, "true")
+				rw.WriteHeader(pRecord.Status)
+				rw.Write(pRecord.Body)
+			}
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: rw}
+		h(capture, req, params)
+		if capture.status == 0 {
+			capture.status = http.StatusOK
+		}
+
+		// Release the key for retries of server errors. Otherwise keep the response.
+		if capture.status >= http.StatusInternalServerError {
+			if err = store.Idempotency().Delete(c, recordKey); err != nil {
+				c.Errorf("%s in releasing idempotency key %s", err, key)
+			}
+			return
+		}
+		var record IdempotencyRecord = IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      capture.status,
+			Body:        capture.body.Bytes(),
+			CreateTime:  now,
+			ExpireTime:  now.Add(IdempotencyRetention),
+		}
+		for _, name := range idempotentHeaders {
+			if v := rw.Header().Get(name); v != "" {
+				record.Header = append(record.Header, name+": "+v)
+			}
+		}
+		if err = store.Idempotency().Put(c, recordKey, &record); err != nil {
+			c.Errorf("%s in storing response of idempotency key %s", err, key)
+		}
+	}
+}
+
+// Delete idempotency records after the retention window. Return the number of deleted records.
+func ExpireIdempotencyRecords(c Context, now time.Time) (n int, err error) {
+	if n, err = store.Idempotency().DeleteExpired(c, now); err != nil {
+		c.Errorf("%s in deleting expired idempotency records", err)
+		return
+	}
+	c.Debugf("%d idempotency records expire at %s", n, now)
+	return
+}
@@ -1,7 +1,6 @@
 package aliza
 
 import (
-	"appengine"
 	"bytes"
 	"image"
 	"io/ioutil"
@@ -11,24 +10,11 @@ import (
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/tiff"
 	"github.com/disintegration/imaging"
-
-	gcscontext   "golang.org/x/net/context"
-	gcsappengine "google.golang.org/appengine"
-	gcsfile      "google.golang.org/appengine/file"
-	"google.golang.org/cloud/storage"
 )
 
 func storeImage(rw http.ResponseWriter, req *http.Request) {
 	// Appengine
-	var c appengine.Context
-	// Google Cloud Storage authentication
-	var cc gcscontext.Context
-	// Google Cloud Storage bucket name
-	var bucketName string = ""
-	// Google Cloud Storage client
-	var client *storage.Client
-	// Google Cloud Storage bucket
-	var bucketHandle *storage.BucketHandle
+	var c Context
 	// User uploaded image file name
 	var fileName string = uuid.New()
 	// Transform user uploaded image to a thumbnail file name
@@ -37,12 +23,16 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 	var contentType string = ""
 	// User uploaded image file raw data
 	var b []byte
-	// Google Cloud Storage file writer
-	var wc *storage.Writer = nil
+	// Encoded image to store
+	var buf bytes.Buffer
+	// Public URLs of the image and the thumbnail
+	var fileURL, thumbnailURL string
 	// Error
 	var err error = nil
 	// Result, 0: success, 1: failed
 	var r int = http.StatusCreated
+	// Error detail
+	var e *ApiError
 
 	// Set response in the end
 	defer func() {
@@ -50,16 +40,16 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 		if r == http.StatusCreated {
 			// Changing the header after a call to WriteHeader (or Write) has no effect.
 			// rw.Header().Set("Location", req.URL.String()+"/"+cKey.Encode())
-			rw.Header().Set("Location", "http://"+ bucketName +".storage.googleapis.com/"+fileName)
-			rw.Header().Set("X-Thumbnail", "http://"+ bucketName +".storage.googleapis.com/"+ fileNameThumbnail)
+			rw.Header().Set("Location", fileURL)
+			rw.Header().Set("X-Thumbnail", thumbnailURL)
 			rw.WriteHeader(r)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
 	// To log information in Google APP Engine console
-	c = appengine.NewContext(req)
+	c = newContext(req)
 
 	// Get data from body
 	b, err = ioutil.ReadAll(req.Body)
@@ -71,7 +61,7 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 	c.Infof("Body length %d bytes, read %d bytes", req.ContentLength, len(b))
 
 	// Determine filename extension from content type
-	contentType = req.Header["Content-Type"][0]
+	contentType = req.Header.Get("Content-Type")
 	switch contentType {
 	case "image/jpeg":
 		fileName += ".jpg"
@@ -79,37 +69,12 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 	default:
 		c.Errorf("Unknown or unsupported content type '%s'. Valid: image/jpeg", contentType)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeUnsupportedImage, "Content-Type", "Content type should be image/jpeg")
 		return
 	}
 	c.Infof("Content type %s is received, %s is detected.", contentType, http.DetectContentType(b))
 
-	// Prepare Google Cloud Storage authentication
-	cc = gcsappengine.NewContext(req)
-	if client, err = storage.NewClient(cc); err != nil {
-		c.Errorf("%s in initializing a GCS client", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	defer client.Close()
-
-	// Get default bucket
-	if bucketName, err = gcsfile.DefaultBucketName(cc); err != nil {
-		c.Errorf("%s in getting default GCS bucket name", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	bucketHandle = client.Bucket(bucketName)
-	c.Infof("APP Engine Version: %s", gcsappengine.VersionID(cc))
-	c.Infof("Using bucket name: %s", bucketName)
-
-	// Change default object ACLs
-	if err = bucketHandle.DefaultObjectACL().Set(cc, storage.AllUsers, storage.RoleReader); err != nil {
-		c.Errorf("%v in saving default object ACL rule for bucket %q", err, bucketName)
-		r = http.StatusInternalServerError
-		return
-	}
-
-	// Store rotated image in Google Cloud Storage
+	// Store rotated image in the blob store
 	var in *bytes.Reader = bytes.NewReader(b)
 	var x *exif.Exif = nil
 	var orientation *tiff.Tag = nil
@@ -119,16 +84,21 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 	// Read EXIF
 	if _, err = in.Seek(0, 0); err != nil {
 		c.Errorf("%s in moving the reader offset to the beginning in order to read EXIF", err)
+		r = http.StatusInternalServerError
 		return
 	}
 	if x, err = exif.Decode(in); err != nil {
 		c.Errorf("%s in decoding JPEG image", err)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidImage, "Image should be a JPEG with EXIF")
 		return
 	}
 
 	// Get Orientation
 	if orientation, err = x.Get(exif.Orientation); err != nil {
 		c.Warningf("%s in getting orientation from EXIF", err)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidImage, "Image should have an EXIF orientation")
 		return
 	}
 	c.Debugf("Orientation %s", orientation.String())
@@ -136,16 +106,18 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 	// Open image
 	if _, err = in.Seek(0, 0); err != nil {
 		c.Errorf("%s in moving the reader offset to the beginning in order to read EXIF", err)
+		r = http.StatusInternalServerError
 		return
 	}
 	if beforeImage, err = imaging.Decode(in); err != nil {
-		c.Errorf("%s in opening image %s", err)
+		c.Errorf("%s in opening image %s", err, fileName)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidImage, "Image can't be decoded as JPEG")
 		return
 	}
 
+	// Decoded JPEGs are YCbCr, so copy them even when they don't turn
 	switch orientation.String() {
-	case "1":
-		afterImage = beforeImage.(*image.NRGBA)
 	case "2":
 		afterImage = imaging.FlipH(beforeImage)
 	case "3":
@@ -160,21 +132,21 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 		afterImage = imaging.Transpose(beforeImage)
 	case "8":
 		afterImage = imaging.Rotate90(beforeImage)
+	default:
+		afterImage = imaging.Clone(beforeImage)
 	}
 
 	// Save rotated image
-	wc = bucketHandle.Object(fileName).NewWriter(cc)
-	wc.ContentType = contentType
-	if err = imaging.Encode(wc, afterImage, imaging.JPEG); err != nil {
-		c.Errorf("%s in saving rotated image", err)
+	if err = imaging.Encode(&buf, afterImage, imaging.JPEG); err != nil {
+		c.Errorf("%s in encoding rotated image", err)
+		r = http.StatusInternalServerError
 		return
 	}
-	if err = wc.Close(); err != nil {
-		c.Errorf("CreateFile: unable to close bucket %q, file %q: %v", bucketName, fileName, err)
-		r = 1
+	if err = blobStore.Put(c, fileName, contentType, buf.Bytes()); err != nil {
+		c.Errorf("%s in saving rotated image %s", err, fileName)
+		r = http.StatusInternalServerError
 		return
 	}
-	wc = nil
 
 	// Make thumbnail
 	if afterImage.Rect.Dx() > afterImage.Rect.Dy() {
@@ -184,17 +156,29 @@ func storeImage(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Save thumbnail
-	wc = bucketHandle.Object(fileNameThumbnail).NewWriter(cc)
-	wc.ContentType = contentType
-	if imaging.Encode(wc, afterImage, imaging.JPEG); err != nil {
-		c.Errorf("%s in saving image thumbnail", err)
+	buf.Reset()
+	if err = imaging.Encode(&buf, afterImage, imaging.JPEG); err != nil {
+		c.Errorf("%s in encoding image thumbnail", err)
+		r = http.StatusInternalServerError
 		return
 	}
-	if err = wc.Close(); err != nil {
-		c.Errorf("CreateFileThumbnail: unable to close bucket %q, file %q: %v", bucketName, fileNameThumbnail, err)
-		r = 1
+	if err = blobStore.Put(c, fileNameThumbnail, contentType, buf.Bytes()); err != nil {
+		c.Errorf("%s in saving image thumbnail %s", err, fileNameThumbnail)
+		r = http.StatusInternalServerError
+		return
+	}
+
+	// Get public URLs from the blob store
+	if fileURL, err = blobStore.URL(c, fileName); err != nil {
+		c.Errorf("%s in getting URL of %s", err, fileName)
+		r = http.StatusInternalServerError
+		return
+	}
+	if thumbnailURL, err = blobStore.URL(c, fileNameThumbnail); err != nil {
+		c.Errorf("%s in getting URL of %s", err, fileNameThumbnail)
+		r = http.StatusInternalServerError
 		return
 	}
 
-	c.Infof("/%v/%v, /%v/%v created", bucketName, fileName, bucketName, fileNameThumbnail)
+	c.Infof("%v, %v created", fileURL, thumbnailURL)
 }
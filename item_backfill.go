@@ -0,0 +1,99 @@
+package aliza
+
+import (
+	"time"
+)
+
+const ItemBackfillKind = "ItemBackfill"
+
+// The max number of items to read in one sweep. The rest are read in the next sweeps.
+const ItemBackfillBatchSize = 100
+
+// Name of the current pass. Rename it to run another pass when items need more properties filled.
+const itemBackfillName = "geohash-status"
+
+// Progress of a pass over all items which stores again the items stored before their indexed
+// properties existed. Searches can't find items by properties which have never been stored.
+type ItemBackfill struct {
+	// Where the next sweep starts
+	Cursor     string    `datastore:",noindex"`
+	Done       bool      `datastore:",noindex"`
+	UpdateTime time.Time `datastore:",noindex"`
+}
+
+// Whether an item lacks indexed properties. Items stored before the status existed have none,
+// so that even queries for the empty status don't find them.
+func needsBackfill(pItem *Item) bool {
+	return pItem.Geohash == "" || pItem.Status == ""
+}
+
+// Fill the indexed properties of a batch of items until all items are read.
+// Return the number of items stored again.
+func BackfillItems(c Context, now time.Time) (n int, err error) {
+	pBackfill, err := store.ItemBackfills().Get(c, itemBackfillName)
+	if err == ErrNotFound {
+		pBackfill, err = &ItemBackfill{}, nil
+	}
+	if err != nil {
+		c.Errorf("%s in getting item backfill %s", err, itemBackfillName)
+		return
+	}
+	if pBackfill.Done {
+		return
+	}
+
+	items, next, err := store.Items().Query(c, ItemQuery{Cursor: pBackfill.Cursor, Limit: ItemBackfillBatchSize})
+	if err != nil {
+		c.Errorf("%s in querying items to backfill", err)
+		return
+	}
+	for i := range items {
+		if !needsBackfill(&items[i]) {
+			continue
+		}
+		var saved bool
+		if saved, err = backfillItem(c, items[i].Id); err != nil {
+			c.Errorf("%s in backfilling item %s", err, items[i].Id)
+			return
+		}
+		if saved {
+			n++
+		}
+	}
+
+	pBackfill.Cursor = next
+	pBackfill.Done = next == ""
+	pBackfill.UpdateTime = now
+	if err = store.ItemBackfills().Put(c, itemBackfillName, pBackfill); err != nil {
+		c.Errorf("%s in recording item backfill %s", err, itemBackfillName)
+		return
+	}
+	c.Debugf("%d of %d items are backfilled at %s", n, len(items), now)
+	if pBackfill.Done {
+		c.Infof("Item backfill %s is done", itemBackfillName)
+	}
+	return
+}
+
+// Fill the indexed properties of an item in a transaction. Return false if it's no longer to fill.
+func backfillItem(c Context, id string) (saved bool, err error) {
+	err = store.RunInTransaction(c, func(tc Context) error {
+		saved = false
+		// The item may have been changed since the query
+		p, err1 := store.Items().Get(tc, id)
+		if err1 == ErrNotFound {
+			return nil
+		} else if err1 != nil {
+			return err1
+		}
+		if !needsBackfill(p) {
+			return nil
+		}
+		p.Geohash = encodeGeohash(p.Latitude, p.Longitude, GeohashPrecision)
+		p.OpenSlots = p.People - p.Attendant
+		p.Status = itemStatus(p)
+		saved = true
+		return store.Items().Update(tc, id, p)
+	})
+	return
+}
@@ -0,0 +1,41 @@
+package aliza
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackfillItems(t *testing.T) {
+	defer SetStore(store)
+	SetStore(NewMemoryStore())
+	c := NewBackgroundLogContext("test")
+
+	// Items stored before the geohash and the status existed, and one stored after
+	var ids []string
+	for i := 0; i < ItemBackfillBatchSize+1; i++ {
+		id, _ := store.Items().Create(c, &Item{People: 4, Attendant: 1, Latitude: 25, Longitude: 121})
+		ids = append(ids, id)
+	}
+	store.Items().Create(c, &Item{People: 4, Attendant: 1, Geohash: "wsqqqqqqq", Status: ItemStatusFull})
+
+	var total int
+	for i := 0; i < 3; i++ {
+		n, err := BackfillItems(c, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+	}
+	if total != len(ids) {
+		t.Errorf("Backfilled %d items instead of %d", total, len(ids))
+	}
+	for _, id := range ids {
+		pItem, _ := store.Items().Get(c, id)
+		if pItem.Geohash != encodeGeohash(25, 121, GeohashPrecision) || pItem.OpenSlots != 3 || pItem.Status != ItemStatusOpen {
+			t.Fatalf("Got %+v", pItem)
+		}
+	}
+	if pBackfill, _ := store.ItemBackfills().Get(c, itemBackfillName); pBackfill == nil || !pBackfill.Done {
+		t.Errorf("Got backfill %+v", pBackfill)
+	}
+}
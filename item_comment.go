@@ -0,0 +1,272 @@
+package aliza
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+const ItemCommentKind = "ItemComment"
+
+// Max characters of a comment
+const MaxItemCommentLength = 1000
+
+// Max characters of a comment in a push notification. FCM data payloads are at most 4KB.
+const ItemCommentPreviewLength = 100
+
+// Default and max page sizes of GET ./items/xxx/comments
+const (
+	DefaultItemCommentLimit = 50
+	MaxItemCommentLimit     = 200
+)
+
+// A message in the discussion thread of an item. Stored under the item.
+type ItemComment struct {
+	Id         string    `json:"id"         datastore:"-"`
+	UserKey    string    `json:"userkey"`
+	Text       string    `json:"text"       datastore:",noindex"`
+	CreateTime time.Time `json:"createtime"`
+}
+
+type ItemCommentRequestBody struct {
+	Text string `json:"text"`
+}
+
+// The beginning of a comment to push. Clients get the whole comment by listing comments.
+func commentPreview(text string) string {
+	if utf8.RuneCountInString(text) <= ItemCommentPreviewLength {
+		return text
+	}
+	return string([]rune(text)[:ItemCommentPreviewLength-1]) + "…"
+}
+
+// Only current members can read and write comments
+// Success: return the item and 200 OK
+// Failure: return 400 Bad Request, 403 Forbidden, 404 Not Found, 500 Internal Server Error
+func checkItemCommenter(c Context, itemId string, userKey string) (*Item, int, *ApiError) {
+	pItem, err := store.Items().Get(c, itemId)
+	if err != nil {
+		c.Errorf("%s in getting item %s", err, itemId)
+		r, e := itemError(err)
+		return nil, r, e
+	}
+	if !isItemMember(pItem, userKey) {
+		c.Warningf("User %s is not a member of item %s", userKey, itemId)
+		return nil, http.StatusForbidden, NewApiError(ErrCodeNotItemMember, "Only members can discuss the item")
+	}
+	return pItem, http.StatusOK, nil
+}
+
+// POST ./items/xxx/comments, xxx: Item key
+// Success: 201 Created with the comment and its URL in the Location header
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found
+func storeItemComment(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("StoreItemComment()")
+	// Result
+	r := http.StatusCreated
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+	// Comment
+	var comment ItemComment
+
+	// Set response
+	defer func() {
+		if r == http.StatusCreated {
+			rw.Header().Set("Location", req.URL.String()+"/"+comment.Id)
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusCreated)
+			if err := json.NewEncoder(rw).Encode(comment); err != nil {
+				c.Errorf("%s in encoding comment %s", err, comment.Id)
+			}
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get data from body
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		c.Errorf("%s in reading body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
+		return
+	}
+	var body ItemCommentRequestBody
+	if err = json.Unmarshal(b, &body); err != nil {
+		c.Errorf("%s in decoding body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be a comment in JSON")
+		return
+	}
+	if body.Text == "" {
+		c.Warningf("Comment text is not given")
+		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeFieldRequired, "text", "Comment text is required")
+		return
+	}
+	if utf8.RuneCountInString(body.Text) > MaxItemCommentLength {
+		c.Warningf("Comment is %d characters long", utf8.RuneCountInString(body.Text))
+		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeCommentTooLong, "text", "Comment should be at most 1000 characters")
+		return
+	}
+
+	userKey, _ := RequestUser(req)
+	pItem, status, e1 := checkItemCommenter(c, keyString, userKey)
+	if status != http.StatusOK {
+		r, e = status, e1
+		return
+	}
+	comment = ItemComment{
+		UserKey:    userKey,
+		Text:       body.Text,
+		CreateTime: time.Now(),
+	}
+	if _, err = store.ItemComments().Create(c, keyString, &comment); err != nil {
+		c.Errorf("%s in storing comment of item %s", err, keyString)
+		r, e = itemError(err)
+		return
+	}
+	c.Infof("User %s commented %s on item %s", userKey, comment.Id, keyString)
+
+	// Notify members through Google Cloud Messaging. Keep going in failure because datastore has updated.
+	var data map[string]string = map[string]string{
+		"message":       "New comment. ",
+		"itemid":        keyString,
+		"commentid":     comment.Id,
+		"text":          commentPreview(comment.Text),
+		"requestuserid": userKey,
+	}
+	if err = notifier.SendToGroup(c, pItem.GcmGroupKey, data); err != nil {
+		c.Warningf("%s in sending comment %s to group %s", err, comment.Id, pItem.GcmGroupName)
+	}
+}
+
+// GET ./items/xxx/comments?limit=50&cursor=yyy, xxx: Item key
+// Comments in time order. Only members can read them.
+// Success: 200 OK with comments and a Link header to the next page if any
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found
+func listItemComments(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("ListItemComments()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+	// Comments
+	var comments []ItemComment
+	var next string
+
+	defer func() {
+		if r == http.StatusOK {
+			if next != "" {
+				rw.Header().Set("Link", "<"+nextPageUrl(req, next)+`>; rel="next"`)
+			}
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusOK)
+			if comments == nil {
+				comments = []ItemComment{}
+			}
+			if err := json.NewEncoder(rw).Encode(comments); err != nil {
+				c.Errorf("%s in encoding comments of item %s", err, keyString)
+			}
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Paging
+	limit, e := parsePageLimit(req.URL.Query(), DefaultItemCommentLimit, MaxItemCommentLimit)
+	if e != nil {
+		c.Warningf("Invalid limit %s", req.URL.Query().Get("limit"))
+		r = http.StatusBadRequest
+		return
+	}
+
+	userKey, _ := RequestUser(req)
+	if _, r, e = checkItemCommenter(c, keyString, userKey); r != http.StatusOK {
+		return
+	}
+
+	var err error
+	if comments, next, err = store.ItemComments().List(c, keyString, req.URL.Query().Get("cursor"), limit); err != nil {
+		c.Errorf("%s in listing comments of item %s", err, keyString)
+		if err == ErrInvalidCursor {
+			r = http.StatusBadRequest
+			e = NewFieldError(ErrCodeInvalidQuery, "cursor", "Invalid cursor")
+		} else {
+			r = http.StatusInternalServerError
+		}
+		return
+	}
+}
+
+// DELETE ./items/xxx/comments/yyy, xxx: Item key, yyy: Comment key
+// The author or the item owner can delete a comment
+// Success: 204 No Content
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found
+func deleteItemComment(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("DeleteItemComment()")
+	// Result
+	r := http.StatusNoContent
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+	// Comment key
+	var commentId string = params.Get("commentid")
+
+	// Set response
+	defer func() {
+		if r == http.StatusNoContent {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	userKey, _ := RequestUser(req)
+	err := store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		pComment, err1 := store.ItemComments().Get(tc, keyString, commentId)
+		if err1 == ErrNotFound || err1 == ErrInvalidId {
+			return NewApiError(ErrCodeCommentNotFound, "Comment is not found")
+		} else if err1 != nil {
+			return err1
+		}
+		if pComment.UserKey != userKey && !isItemOwner(pItem, userKey) {
+			return NewApiError(ErrCodeNotCommentAuthor, "Only the author or the item owner can delete the comment")
+		}
+		return store.ItemComments().Delete(tc, keyString, commentId)
+	})
+	if err != nil {
+		c.Errorf("%s in deleting comment %s of item %s", err, commentId, keyString)
+		if e1, ok := err.(*ApiError); ok {
+			e = e1
+			switch e.Code {
+			case ErrCodeNotCommentAuthor:
+				r = http.StatusForbidden
+			default:
+				r = http.StatusNotFound
+			}
+		} else {
+			r, e = itemError(err)
+		}
+		return
+	}
+	c.Infof("User %s deleted comment %s of item %s", userKey, commentId, keyString)
+}
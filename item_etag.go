@@ -0,0 +1,65 @@
+package aliza
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Strong entity tag of the item version, e.g. "3"
+func itemETag(pItem *Item) string {
+	return `"` + strconv.FormatInt(pItem.Version, 10) + `"`
+}
+
+// Strong entity tag of the item as the user sees it, e.g. "3-public". Non-members share a view.
+// Every member sees their own contact details, so each member has a view of their own.
+func itemViewETag(pItem *Item, userKey string) string {
+	var view string = "public"
+	if isItemMember(pItem, userKey) {
+		h := sha256.Sum256([]byte(userKey))
+		view = "member-" + hex.EncodeToString(h[:4])
+	}
+	return `"` + strconv.FormatInt(pItem.Version, 10) + "-" + view + `"`
+}
+
+// The version tag of a view tag, e.g. "3" of "3-public". Other tags stay as they are.
+func etagVersion(etag string) string {
+	if i := strings.Index(etag, "-"); i > 0 && strings.HasPrefix(etag, `"`) {
+		return etag[:i] + `"`
+	}
+	return etag
+}
+
+// Whether an If-Match or If-None-Match header lists the entity tag. "*" matches any.
+// Weak tags match by their opaque tags when weak is true. Otherwise, for If-Match which only cares
+// about the version, view tags match by their versions.
+func etagListMatches(header string, etag string, weak bool) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if weak {
+			v = strings.TrimPrefix(v, "W/")
+		} else {
+			v = etagVersion(v)
+		}
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the If-Match header of a request which modifies the item. Requests without it always pass.
+func checkItemIfMatch(header string, pItem *Item) *ApiError {
+	if header == "" || etagListMatches(header, itemETag(pItem), false) {
+		return nil
+	}
+	return NewApiError(ErrCodePreconditionFailed, "Item has been modified. Get it again and retry.")
+}
+
+// Whether the client already has the user's view of the item by If-None-Match
+func itemNotModified(req *http.Request, pItem *Item, userKey string) bool {
+	var header string = req.Header.Get("If-None-Match")
+	return header != "" && etagListMatches(header, itemViewETag(pItem, userKey), true)
+}
@@ -0,0 +1,159 @@
+package aliza
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const ItemEventKind = "ItemEvent"
+
+// Types of item events
+const (
+	ItemEventCreated          = "created"
+	ItemEventJoined           = "joined"
+	ItemEventAttendantChanged = "attendant_changed"
+	ItemEventLeft             = "left"
+	// The owner changed item properties
+	ItemEventUpdated          = "updated"
+	ItemEventStatusChanged    = "status_changed"
+	ItemEventOwnerChanged     = "owner_changed"
+	// A waitlisted user became a member
+	ItemEventPromoted         = "promoted"
+	ItemEventWaitlistJoined   = "waitlist_joined"
+	ItemEventWaitlistLeft     = "waitlist_left"
+	// The owner removed a member, and banned the user or lifted the ban
+	ItemEventMemberRemoved    = "member_removed"
+	ItemEventMemberBanned     = "member_banned"
+	ItemEventMemberUnbanned   = "member_unbanned"
+	// A member changed the contact details or what to share. The details aren't recorded.
+	ItemEventContactChanged   = "contact_changed"
+	ItemEventDeleted          = "deleted"
+	ItemEventRestored         = "restored"
+)
+
+// An immutable record of an item change. Stored under the item.
+type ItemEvent struct {
+	Id        string    `json:"id"                  datastore:"-"`
+	Type      string    `json:"type"`
+	// The user who made the change. Empty for changes by the server, e.g. deadlines.
+	UserKey   string    `json:"userkey,omitempty"`
+	// Attendants the user added or removed, or requested on the waitlist
+	Attendant int       `json:"attendant,omitempty"`
+	// The new status of status_changed
+	Status    string    `json:"status,omitempty"`
+	// The new owner's user key of owner_changed
+	Owner     string    `json:"owner,omitempty"`
+	// The user key whom the owner removed, banned or unbanned
+	Member    string    `json:"member,omitempty"`
+	// Human readable detail
+	Detail    string    `json:"detail,omitempty"    datastore:",noindex"`
+	Time      time.Time `json:"time"`
+}
+
+// Default and max page sizes of GET ./items/xxx/events
+const (
+	DefaultItemEventLimit = 50
+	MaxItemEventLimit     = 200
+)
+
+func newItemEvent(eventType string, userKey string, now time.Time) ItemEvent {
+	return ItemEvent{Type: eventType, UserKey: userKey, Time: now}
+}
+
+func statusChangedEvent(userKey string, status string, now time.Time) ItemEvent {
+	event := newItemEvent(ItemEventStatusChanged, userKey, now)
+	event.Status = status
+	return event
+}
+
+// Event of the last ownership change of the item
+func ownerChangedEvent(pItem *Item) ItemEvent {
+	v := pItem.OwnerChanges[len(pItem.OwnerChanges)-1]
+	event := newItemEvent(ItemEventOwnerChanged, v.From, v.Time)
+	event.Owner = v.To
+	event.Detail = v.Reason
+	return event
+}
+
+// Store events of an item. Call it in the transaction which changes the item.
+func saveItemEvents(c Context, itemId string, events []ItemEvent) error {
+	for i := range events {
+		if _, err := store.ItemEvents().Create(c, itemId, &events[i]); err != nil {
+			c.Errorf("%s in storing event %s of item %s", err, events[i].Type, itemId)
+			return err
+		}
+	}
+	return nil
+}
+
+// GET ./items/xxx/events?limit=50&cursor=yyy, xxx: Item key
+// History of the item in time order. Only members can read it.
+// Success: 200 OK with events and a Link header to the next page if any
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found
+func listItemEvents(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("ListItemEvents()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+	// Events
+	var events []ItemEvent
+	var next string
+
+	defer func() {
+		if r == http.StatusOK {
+			if next != "" {
+				rw.Header().Set("Link", "<"+nextPageUrl(req, next)+`>; rel="next"`)
+			}
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusOK)
+			if events == nil {
+				events = []ItemEvent{}
+			}
+			if err := json.NewEncoder(rw).Encode(events); err != nil {
+				c.Errorf("%s in encoding events of item %s", err, keyString)
+			}
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Paging
+	limit, e := parsePageLimit(req.URL.Query(), DefaultItemEventLimit, MaxItemEventLimit)
+	if e != nil {
+		c.Warningf("Invalid limit %s", req.URL.Query().Get("limit"))
+		r = http.StatusBadRequest
+		return
+	}
+
+	// Only members can read
+	pItem, err := store.Items().Get(c, keyString)
+	if err != nil {
+		c.Errorf("%s in getting item %s", err, keyString)
+		r, e = itemError(err)
+		return
+	}
+	userKey, _ := RequestUser(req)
+	if !isItemMember(pItem, userKey) {
+		c.Warningf("User %s is not a member of item %s", userKey, keyString)
+		r = http.StatusForbidden
+		e = NewApiError(ErrCodeNotItemMember, "Only members can read the item history")
+		return
+	}
+
+	if events, next, err = store.ItemEvents().List(c, keyString, req.URL.Query().Get("cursor"), limit); err != nil {
+		c.Errorf("%s in listing events of item %s", err, keyString)
+		if err == ErrInvalidCursor {
+			r = http.StatusBadRequest
+			e = NewFieldError(ErrCodeInvalidQuery, "cursor", "Invalid cursor")
+		} else {
+			r = http.StatusInternalServerError
+		}
+		return
+	}
+}
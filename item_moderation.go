@@ -0,0 +1,273 @@
+package aliza
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Whether the request user owns the item
+func isItemOwner(pItem *Item, userKey string) bool {
+	return len(pItem.Members) > 0 && pItem.Members[0].UserKey == userKey
+}
+
+// DELETE ./items/xxx/members/yyy?ban=true, xxx: Item key, yyy: User key
+// Only the owner can remove another member, e.g. a no-show. Banned users can't join or wait again.
+// With ban=true, any user can be banned, e.g. a waitlisted user or a former member.
+// Success: 204 No Content
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found, 409 Conflict, 412 Precondition Failed
+func removeItemMember(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("RemoveItemMember()")
+	// Result
+	r := http.StatusNoContent
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+	// The member to remove
+	var memberKey string = params.Get("userkey")
+	var ban bool = req.URL.Query().Get("ban") == "true"
+
+	// Set response
+	defer func() {
+		if r == http.StatusNoContent {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	userKey, _ := RequestUser(req)
+	var dst Item
+	var notification ItemUpdateNotification
+	// The removed member. UserKey is empty if the user isn't a member.
+	var removed ItemMember
+	// Whether the banned user was waiting
+	var unwaited bool
+	// Waitlisted users who take the open slots
+	var promoted []ItemMember
+	err := store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		dst = *pItem
+		notification.Message = ""
+		var now time.Time = time.Unix(time.Now().Unix(), 0)
+		if e1 := checkItemIfMatch(req.Header.Get("If-Match"), &dst); e1 != nil {
+			return e1
+		}
+		if !isItemOwner(&dst, userKey) {
+			return NewApiError(ErrCodeNotItemOwner, "Only the item owner can remove members")
+		}
+		if memberKey == userKey {
+			return NewApiError(ErrCodeCannotRemoveOwner, "Owner can't remove themselves. Leave the item or hand it over instead.")
+		}
+		if !isItemActive(&dst) {
+			return NewApiError(ErrCodeItemNotActive, "Item is "+dst.Status)
+		}
+		var i int
+		for i = 1; i < len(dst.Members); i++ {
+			if dst.Members[i].UserKey == memberKey {
+				break
+			}
+		}
+		removed = ItemMember{}
+		unwaited = false
+		var events []ItemEvent
+		var event ItemEvent
+		if i < len(dst.Members) {
+			// Delete the member from the item. Keep the joining order.
+			removed = dst.Members[i]
+			dst.Members = append(append([]ItemMember(nil), dst.Members[:i]...), dst.Members[i+1:]...)
+			dst.Attendant -= removed.Attendant
+			notification.Message += fmt.Sprintf("Owner removed a member and item is now %d/%d. ", dst.Attendant, dst.People)
+			event = newItemEvent(ItemEventMemberRemoved, userKey, now)
+			event.Member = memberKey
+			event.Attendant = removed.Attendant
+			events = append(events, event)
+		} else if !ban {
+			return NewApiError(ErrCodeNotItemMember, "User is not a member of the item")
+		} else if containsString(dst.Banned, memberKey) {
+			return NewApiError(ErrCodeAlreadyBanned, "User is already banned from the item")
+		}
+		if ban && !containsString(dst.Banned, memberKey) {
+			dst.Banned = append(append([]string(nil), dst.Banned...), memberKey)
+			var waitlist []ItemMember = removeWaitlisted(append([]ItemMember(nil), dst.Waitlist...), memberKey)
+			unwaited = len(waitlist) < len(dst.Waitlist)
+			dst.Waitlist = waitlist
+			event = newItemEvent(ItemEventMemberBanned, userKey, now)
+			event.Member = memberKey
+			events = append(events, event)
+		}
+
+		// Fill the open slots with waitlisted users
+		promoted = promoteWaitlist(&dst, now)
+		for _, v := range promoted {
+			event = newItemEvent(ItemEventPromoted, v.UserKey, now)
+			event.Attendant = v.Attendant
+			events = append(events, event)
+			notification.Message += fmt.Sprintf("A waitlisted user attended %d and now item reaches %d/%d. ", v.Attendant, dst.Attendant, dst.People)
+		}
+		dst.OpenSlots = dst.People - dst.Attendant
+
+		// Follow the attendants between open and full
+		if status := attendantItemStatus(&dst); status != itemStatus(&dst) {
+			if e1 := transitItem(&dst, status, &notification); e1 != nil {
+				return e1
+			}
+			events = append(events, statusChangedEvent(userKey, dst.Status, now))
+		}
+		if err1 = saveItemEvents(tc, keyString, events); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, keyString, &dst)
+	})
+	if err != nil {
+		c.Errorf("%s in removing member %s from item %s", err, memberKey, keyString)
+		r, e = itemModerationError(err)
+		return
+	}
+	c.Infof("Owner %s removed member %s from item %s. Ban: %t", userKey, memberKey, keyString, ban)
+	rw.Header().Set("ETag", itemETag(&dst))
+
+	// Keep going in failure because datastore has updated
+	if removed.UserKey == "" {
+		// Only banned. Members don't need to know.
+		if unwaited {
+			notifyUnwaitedUser(c, &dst, memberKey)
+		}
+		return
+	}
+	notifyRemovedMember(c, &dst, removed, ban)
+
+	// Notify members through Google Cloud Messaging
+	notification.ItemId = keyString
+	notification.RequestUserId = userKey
+	if gcmResponseCode := sendItemGcmMessage(c, &dst, &notification); gcmResponseCode != http.StatusOK {
+		c.Warningf("Send notification to all members failed")
+	}
+	notifyPromotedMembers(c, &dst, promoted)
+}
+
+// Remove the member from the GCM group of the item and tell the member
+func notifyRemovedMember(c Context, pItem *Item, removed ItemMember, ban bool) {
+	pUser, err := store.Users().Get(c, removed.UserKey)
+	if err != nil {
+		c.Errorf("%s in getting removed user %s", err, removed.UserKey)
+		return
+	}
+	if r := updateItemGcmGroup(c, stateDeleteMember, pItem, pUser); r != http.StatusOK {
+		c.Warningf("Remove user %s from GCM group %s failed", removed.UserKey, pItem.GcmGroupName)
+	}
+	var message string = "Owner removed you from the item. "
+	if ban {
+		message = "Owner removed you from the item and you can't join it again. "
+	}
+	var data map[string]string = map[string]string{
+		"message": message,
+		"itemid":  pItem.Id,
+		"status":  itemStatus(pItem),
+	}
+	if err = notifier.SendToToken(c, pUser.RegistrationToken, data); err != nil {
+		c.Warningf("%s in notifying removed user %s", err, removed.UserKey)
+	}
+}
+
+// Tell a banned user who was waiting for the item
+func notifyUnwaitedUser(c Context, pItem *Item, userKey string) {
+	pUser, err := store.Users().Get(c, userKey)
+	if err != nil {
+		c.Errorf("%s in getting banned user %s", err, userKey)
+		return
+	}
+	var data map[string]string = map[string]string{
+		"message": "Owner removed you from the waitlist and you can't join the item. ",
+		"itemid":  pItem.Id,
+		"status":  itemStatus(pItem),
+	}
+	if err = notifier.SendToToken(c, pUser.RegistrationToken, data); err != nil {
+		c.Warningf("%s in notifying banned user %s", err, userKey)
+	}
+}
+
+// DELETE ./items/xxx/bans/yyy, xxx: Item key, yyy: User key
+// Only the owner can let a banned user join again
+// Success: 204 No Content
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found
+func unbanItemMember(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("UnbanItemMember()")
+	// Result
+	r := http.StatusNoContent
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+	// The banned user
+	var memberKey string = params.Get("userkey")
+
+	// Set response
+	defer func() {
+		if r == http.StatusNoContent {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	userKey, _ := RequestUser(req)
+	err := store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		if !isItemOwner(pItem, userKey) {
+			return NewApiError(ErrCodeNotItemOwner, "Only the item owner can lift bans")
+		}
+		var banned []string
+		for _, v := range pItem.Banned {
+			if v != memberKey {
+				banned = append(banned, v)
+			}
+		}
+		if len(banned) == len(pItem.Banned) {
+			return NewApiError(ErrCodeNotBanned, "User is not banned from the item")
+		}
+		pItem.Banned = banned
+		event := newItemEvent(ItemEventMemberUnbanned, userKey, time.Unix(time.Now().Unix(), 0))
+		event.Member = memberKey
+		if err1 = saveItemEvents(tc, keyString, []ItemEvent{event}); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, keyString, pItem)
+	})
+	if err != nil {
+		c.Errorf("%s in unbanning user %s from item %s", err, memberKey, keyString)
+		r, e = itemModerationError(err)
+		return
+	}
+	c.Infof("Owner %s unbanned user %s from item %s", userKey, memberKey, keyString)
+}
+
+// Map an error of moderation transactions to an HTTP status
+func itemModerationError(err error) (int, *ApiError) {
+	e, ok := err.(*ApiError)
+	if !ok {
+		return itemError(err)
+	}
+	switch e.Code {
+	case ErrCodeNotItemOwner:
+		return http.StatusForbidden, e
+	case ErrCodeNotItemMember, ErrCodeNotBanned:
+		return http.StatusNotFound, e
+	case ErrCodeCannotRemoveOwner:
+		return http.StatusBadRequest, e
+	case ErrCodePreconditionFailed:
+		return http.StatusPreconditionFailed, e
+	}
+	return http.StatusConflict, e
+}
@@ -0,0 +1,170 @@
+package aliza
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Why the ownership changed
+const (
+	// The owner handed the item over to a member
+	ItemOwnerChangeTransfer = "transfer"
+	// The owner left and the longest-standing member took over
+	ItemOwnerChangeLeft     = "left"
+)
+
+// An audit entry of an ownership change
+type ItemOwnerChange struct {
+	From   string    `json:"from"`   // User key
+	To     string    `json:"to"`     // User key
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+type ItemOwnerRequestBody struct {
+	UserKey string `json:"userkey"`
+}
+
+// Index of the member who joined earliest except the owner. Members are in joining order
+// but the join times are compared in case. Members without join times joined before the others.
+func longestStandingMember(members []ItemMember) int {
+	var j int = -1
+	for i := 1; i < len(members); i++ {
+		if j < 0 || members[i].JoinTime.Before(members[j].JoinTime) {
+			j = i
+		}
+	}
+	return j
+}
+
+// Make the i-th member the owner. Keep the joining order of the others.
+// Record the change and append it to the notification.
+func handOverItem(pItem *Item, i int, from string, reason string, now time.Time, pNotification *ItemUpdateNotification) {
+	var a []ItemMember = pItem.Members
+	var owner ItemMember = a[i]
+	copy(a[1:i+1], a[:i])
+	a[0] = owner
+	pItem.OwnerChanges = append(pItem.OwnerChanges, ItemOwnerChange{
+		From:   from,
+		To:     owner.UserKey,
+		Reason: reason,
+		Time:   time.Unix(now.Unix(), 0),
+	})
+	if reason == ItemOwnerChangeLeft {
+		pNotification.Message += "Owner left. The longest-standing member is the new owner. "
+	} else {
+		pNotification.Message += "Owner handed the item over to another member. "
+	}
+}
+
+// PUT ./items/xxx/owner, xxx: Item key
+// Only the owner can hand the item over to another member
+// Success: 200 OK
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found, 409 Conflict, 412 Precondition Failed
+func updateItemOwner(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("UpdateItemOwner()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+
+	// Set response
+	defer func() {
+		if r == http.StatusOK {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get data from body
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		c.Errorf("%s in reading body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
+		return
+	}
+	var body ItemOwnerRequestBody
+	if err = json.Unmarshal(b, &body); err != nil {
+		c.Errorf("%s in decoding body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be a user key in JSON")
+		return
+	}
+	if body.UserKey == "" {
+		c.Warningf("New owner is not given")
+		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeFieldRequired, "userkey", "New owner's user key is required")
+		return
+	}
+
+	userKey, _ := RequestUser(req)
+	var dst Item
+	var notification ItemUpdateNotification
+	err = store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		dst = *pItem
+		notification.Message = ""
+		if e1 := checkItemIfMatch(req.Header.Get("If-Match"), &dst); e1 != nil {
+			return e1
+		}
+		if len(dst.Members) == 0 || dst.Members[0].UserKey != userKey {
+			return NewApiError(ErrCodeNotItemOwner, "Only the item owner can hand the item over")
+		}
+		if !isItemActive(&dst) {
+			return NewApiError(ErrCodeItemNotActive, "Item is "+dst.Status)
+		}
+		var i int
+		for i = 1; i < len(dst.Members); i++ {
+			if dst.Members[i].UserKey == body.UserKey {
+				break
+			}
+		}
+		if i == len(dst.Members) {
+			return NewFieldError(ErrCodeNotItemMember, "userkey", "New owner should be another member of the item")
+		}
+		handOverItem(&dst, i, userKey, ItemOwnerChangeTransfer, time.Now(), &notification)
+		if err1 = saveItemEvents(tc, keyString, []ItemEvent{ownerChangedEvent(&dst)}); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, keyString, &dst)
+	})
+	if err != nil {
+		c.Errorf("%s in handing item %s over to %s", err, keyString, body.UserKey)
+		if e1, ok := err.(*ApiError); ok {
+			e = e1
+			switch e.Code {
+			case ErrCodeNotItemOwner:
+				r = http.StatusForbidden
+			case ErrCodePreconditionFailed:
+				r = http.StatusPreconditionFailed
+			case ErrCodeNotItemMember:
+				r = http.StatusBadRequest
+			default:
+				r = http.StatusConflict
+			}
+		} else {
+			r, e = itemError(err)
+		}
+		return
+	}
+	c.Infof("Item %s is handed over from %s to %s", keyString, userKey, body.UserKey)
+	rw.Header().Set("ETag", itemETag(&dst))
+
+	// Notify members through Google Cloud Messaging. Keep going in failure because datastore has updated.
+	notification.ItemId = keyString
+	notification.RequestUserId = userKey
+	if gcmResponseCode := sendItemGcmMessage(c, &dst, &notification); gcmResponseCode != http.StatusOK {
+		c.Warningf("Send notification to all members failed")
+	}
+}
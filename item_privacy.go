@@ -0,0 +1,155 @@
+package aliza
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Body of PUT ./items/xxx/contact
+type ItemContactRequestBody struct {
+	PhoneNumber     string `json:"phonenumber"`
+	SkypeId         string `json:"skypeid"`
+	HidePhoneNumber bool   `json:"hidephonenumber"`
+	HideSkypeId     bool   `json:"hideskypeid"`
+}
+
+// Remove the contact details which the member hides
+func hideContacts(m ItemMember) ItemMember {
+	if m.HidePhoneNumber {
+		m.PhoneNumber = ""
+	}
+	if m.HideSkypeId {
+		m.SkypeId = ""
+	}
+	return m
+}
+
+// Shape an item in a response for the request user. Non-members see the numbers of members
+// and waitlisted users only, and no user keys, not even in owner changes or the GCM group. Members see the contact details which the others share.
+// Everyone sees their own details. The item must be a copy which isn't stored.
+func shapeItem(pItem *Item, userKey string) {
+	pItem.MemberCount = len(pItem.Members)
+	pItem.WaitlistCount = len(pItem.Waitlist)
+	if !isItemMember(pItem, userKey) {
+		pItem.Members = []ItemMember{}
+		pItem.Waitlist = []ItemMember{}
+		pItem.Banned = nil
+		pItem.OwnerChanges = nil
+		pItem.GcmGroupName = ""
+		pItem.GcmGroupKey = ""
+		return
+	}
+	var members []ItemMember = make([]ItemMember, 0, len(pItem.Members))
+	for _, v := range pItem.Members {
+		if v.UserKey != userKey {
+			v = hideContacts(v)
+		}
+		members = append(members, v)
+	}
+	pItem.Members = members
+	var waitlist []ItemMember = make([]ItemMember, 0, len(pItem.Waitlist))
+	for _, v := range pItem.Waitlist {
+		waitlist = append(waitlist, hideContacts(v))
+	}
+	pItem.Waitlist = waitlist
+}
+
+// PUT ./items/xxx/contact, xxx: Item key
+// A member changes the contact details and which of them other members see.
+// The owner should keep a phone number or a Skype ID.
+// Success: 200 OK
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found, 412 Precondition Failed
+func updateItemContact(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("UpdateItemContact()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+
+	// Set response
+	defer func() {
+		if r == http.StatusOK {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get data from body
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		c.Errorf("%s in reading body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
+		return
+	}
+	var body ItemContactRequestBody
+	if err = json.Unmarshal(b, &body); err != nil {
+		c.Errorf("%s in decoding body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be contact details in JSON")
+		return
+	}
+
+	userKey, _ := RequestUser(req)
+	var dst Item
+	err = store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		dst = *pItem
+		if e1 := checkItemIfMatch(req.Header.Get("If-Match"), &dst); e1 != nil {
+			return e1
+		}
+		var i int
+		for i = 0; i < len(dst.Members); i++ {
+			if dst.Members[i].UserKey == userKey {
+				break
+			}
+		}
+		if i == len(dst.Members) {
+			return NewApiError(ErrCodeNotItemMember, "Only members have contact details in the item")
+		}
+		if i == 0 && body.PhoneNumber == "" && body.SkypeId == "" {
+			return NewApiError(ErrCodeContactRequired, "Phone number or Skype ID is required").
+				WithField("phonenumber", "Phone number or Skype ID is required").
+				WithField("skypeid", "Phone number or Skype ID is required")
+		}
+		dst.Members = append([]ItemMember(nil), dst.Members...)
+		dst.Members[i].PhoneNumber = body.PhoneNumber
+		dst.Members[i].SkypeId = body.SkypeId
+		dst.Members[i].HidePhoneNumber = body.HidePhoneNumber
+		dst.Members[i].HideSkypeId = body.HideSkypeId
+		event := newItemEvent(ItemEventContactChanged, userKey, time.Unix(time.Now().Unix(), 0))
+		if err1 = saveItemEvents(tc, keyString, []ItemEvent{event}); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, keyString, &dst)
+	})
+	if err != nil {
+		c.Errorf("%s in updating contact of user %s in item %s", err, userKey, keyString)
+		if e1, ok := err.(*ApiError); ok {
+			e = e1
+			switch e.Code {
+			case ErrCodeNotItemMember:
+				r = http.StatusForbidden
+			case ErrCodePreconditionFailed:
+				r = http.StatusPreconditionFailed
+			default:
+				r = http.StatusBadRequest
+			}
+		} else {
+			r, e = itemError(err)
+		}
+		return
+	}
+	c.Infof("User %s updated contact in item %s", userKey, keyString)
+	rw.Header().Set("ETag", itemETag(&dst))
+}
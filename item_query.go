@@ -0,0 +1,256 @@
+package aliza
+
+//go:generate go run ./cmd/genindex -o index.yaml
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A searchable item property
+type itemSearchProperty struct {
+	// Query parameter name
+	name     string
+	// Datastore property name
+	property string
+	// Parse a query parameter value
+	parse    func(v string) (interface{}, error)
+	// Whether it can be used with range operators and sort
+	ordered  bool
+}
+
+func parseInt(v string) (interface{}, error) {
+	return strconv.Atoi(v)
+}
+
+func parseFloat(v string) (interface{}, error) {
+	return strconv.ParseFloat(v, 64)
+}
+
+func parseString(v string) (interface{}, error) {
+	return v, nil
+}
+
+func parseTime(v string) (interface{}, error) {
+	return time.Parse(time.RFC3339, v)
+}
+
+func parseStatus(v string) (interface{}, error) {
+	if !isItemStatus(v) {
+		return nil, fmt.Errorf("Unknown item status %s", v)
+	}
+	return v, nil
+}
+
+// Properties which searchItem supports
+var itemSearchProperties = []itemSearchProperty{
+	{"image", "Image", parseString, false},
+	{"people", "People", parseInt, true},
+	{"attendant", "Attendant", parseInt, true},
+	{"open_slots", "OpenSlots", parseInt, true},
+	{"latitude", "Latitude", parseFloat, true},
+	{"longitude", "Longitude", parseFloat, true},
+	{"createtime", "CreateTime", parseTime, true},
+	{"deadline", "Deadline", parseTime, true},
+	{"status", "Status", parseStatus, false},
+}
+
+// Whether a property is a time which accepts before and after
+func isTimeSearchProperty(p itemSearchProperty) bool {
+	return p.property == "CreateTime" || p.property == "Deadline"
+}
+
+// Operators of query parameters, e.g. people_gte=3
+var itemSearchOperators = map[string]string{
+	"eq":     "=",
+	"gt":     ">",
+	"gte":    ">=",
+	"lt":     "<",
+	"lte":    "<=",
+	"after":  ">",
+	"before": "<",
+}
+
+// Find a searchable property by its query parameter name. Legacy names like "People" are accepted.
+func findItemSearchProperty(name string) (itemSearchProperty, bool) {
+	name = strings.ToLower(name)
+	if name == "openslots" {
+		name = "open_slots"
+	}
+	for _, v := range itemSearchProperties {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return itemSearchProperty{}, false
+}
+
+// Split a query parameter into a property and an operator, e.g. "people_gte" into people and ">="
+func parseItemSearchKey(key string) (p itemSearchProperty, operator string, ok bool) {
+	if p, ok = findItemSearchProperty(key); ok {
+		return p, "=", true
+	}
+	i := strings.LastIndex(key, "_")
+	if i < 0 {
+		return p, "", false
+	}
+	if operator, ok = itemSearchOperators[strings.ToLower(key[i+1:])]; !ok {
+		return p, "", false
+	}
+	if p, ok = findItemSearchProperty(key[:i]); !ok {
+		return p, "", false
+	}
+	// Only time accepts before and after. Only ordered properties accept range operators.
+	var op string = strings.ToLower(key[i+1:])
+	if (op == "after" || op == "before") && !isTimeSearchProperty(p) {
+		return p, "", false
+	}
+	if operator != "=" && !p.ordered {
+		return p, "", false
+	}
+	return p, operator, true
+}
+
+// Build an item query from search parameters, e.g.
+//	people_gte=3&createtime_after=2016-01-02T15:04:05Z&open_slots_gt=0&sort=-createtime
+// Paging parameters are skipped. Return all the bad parameters in the error.
+// Datastore allows range filters on only one property, which must be the sort property if any.
+// With range filters or sort, at most one property can have equality filters so that
+// the composite indexes in index.yaml serve all queries.
+func parseItemSearch(q url.Values) (f ItemQuery, e *ApiError) {
+	// Properties with equality filters and with range filters
+	var equalities []itemSearchProperty
+	var ranges []itemSearchProperty
+	var bad = func(field string, message string) {
+		if e == nil {
+			e = NewApiError(ErrCodeInvalidQuery, "Invalid search parameters")
+		}
+		e.WithField(field, message)
+	}
+
+	// Sort keys for stable error details
+	var keys []string
+	for key := range q {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if isItemPageParameter(key) {
+			continue
+		}
+		var value string = q.Get(key)
+		if key == "sort" {
+			p, ok := findItemSearchProperty(strings.TrimPrefix(value, "-"))
+			if !ok || !p.ordered {
+				bad(key, "Unknown sort property "+value)
+				continue
+			}
+			f.Order = p.property
+			if strings.HasPrefix(value, "-") {
+				f.Order = "-" + p.property
+			}
+			continue
+		}
+		p, operator, ok := parseItemSearchKey(key)
+		if !ok {
+			bad(key, "Unknown search parameter")
+			continue
+		}
+		v, err := p.parse(value)
+		if err != nil {
+			if isTimeSearchProperty(p) {
+				bad(key, "Time should be in RFC3339, e.g. 2016-01-02T15:04:05Z")
+			} else if p.property == "Status" {
+				bad(key, "Status should be open, full, confirmed, closed or cancelled")
+			} else {
+				bad(key, "Invalid value "+value)
+			}
+			continue
+		}
+		f.Filters = append(f.Filters, ItemFilter{p.property, operator, v})
+		if operator == "=" {
+			equalities = appendOnce(equalities, p)
+		} else {
+			ranges = appendOnce(ranges, p)
+		}
+	}
+	if e != nil {
+		return
+	}
+
+	// Check datastore restrictions
+	var orderProperty string = strings.TrimPrefix(f.Order, "-")
+	if len(ranges) > 1 {
+		for _, v := range ranges {
+			bad(v.name, "Range filters are allowed on only one property")
+		}
+	}
+	if len(ranges) == 1 && orderProperty != "" && orderProperty != ranges[0].property {
+		bad("sort", fmt.Sprintf("Sort property should be %s which has range filters", ranges[0].name))
+	}
+	if (len(ranges) > 0 || orderProperty != "") && len(equalities) > 1 {
+		for _, v := range equalities {
+			bad(v.name, "Equality filters are allowed on only one property with range filters or sort")
+		}
+	}
+	if len(ranges) == 1 && orderProperty == "" {
+		// Datastore sorts by the range property anyway
+		f.Order = ranges[0].property
+	}
+	return
+}
+
+func appendOnce(a []itemSearchProperty, v itemSearchProperty) []itemSearchProperty {
+	for _, x := range a {
+		if x.property == v.property {
+			return a
+		}
+	}
+	return append(a, v)
+}
+
+// Write the composite indexes which searchItem needs in index.yaml format.
+// Each index has one equality property followed by one range or sort property.
+// Item events and comments are listed by time under their items.
+func WriteIndexYaml(w io.Writer) error {
+	var lines []string = []string{
+		"# Generated by cmd/genindex. DO NOT EDIT.",
+		"# Composite indexes for searching items with an equality filter and a range filter or sort.",
+		"indexes:",
+		"",
+		"- kind: " + ItemEventKind,
+		"  ancestor: yes",
+		"  properties:",
+		"  - name: Time",
+		"",
+		"- kind: " + ItemCommentKind,
+		"  ancestor: yes",
+		"  properties:",
+		"  - name: CreateTime",
+	}
+	for _, eq := range itemSearchProperties {
+		for _, r := range itemSearchProperties {
+			if r.property == eq.property || !r.ordered {
+				continue
+			}
+			for _, direction := range []string{"asc", "desc"} {
+				lines = append(lines,
+					"",
+					"- kind: "+ItemKind,
+					"  properties:",
+					"  - name: "+eq.property,
+					"  - name: "+r.property,
+					"    direction: "+direction,
+				)
+			}
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
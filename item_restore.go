@@ -0,0 +1,239 @@
+package aliza
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+const DeletedItemKind = "DeletedItem"
+
+// The max number of deleted items to purge in one sweep. The rest are purged in the next sweep.
+const PurgeItemsBatchSize = 100
+
+// An item which is deleted by its owner, an administrator or its last member leaving.
+// It's hidden from queries and can be restored until it's purged after the restore window.
+type DeletedItem struct {
+	// The item as it was before it was deleted
+	Item       Item      `json:"item"`
+	DeleteTime time.Time `json:"deletetime"`
+	// User key of whom deleted the item or left it last
+	DeletedBy  string    `json:"deletedby"`
+	// Purging has started and the item can't be restored any more
+	Purging    bool      `json:"-"`
+}
+
+// Move an item to the deleted items and record it. Call it in a transaction.
+func softDeleteItem(c Context, id string, pItem *Item, userKey string, now time.Time) error {
+	if err := store.Items().Delete(c, id); err != nil {
+		return err
+	}
+	if err := saveItemEvents(c, id, []ItemEvent{newItemEvent(ItemEventDeleted, userKey, now)}); err != nil {
+		return err
+	}
+	var deleted DeletedItem = DeletedItem{Item: *pItem, DeleteTime: now, DeletedBy: userKey}
+	if err := store.DeletedItems().Create(c, id, &deleted); err != nil {
+		c.Errorf("%s in keeping deleted item %s", err, id)
+		return err
+	}
+	return nil
+}
+
+// Create a new GCM group with all the members because the old one was removed along with the item.
+// Success: 200 OK
+// Failure: 400 Bad Request, 500 Internal Server Error
+func recreateItemGcmGroup(c Context, pItem *Item) (r int) {
+	var operation GroupOperation
+	operation.Operation = "create"
+	operation.Notification_key_name = pItem.Members[0].UserKey + strconv.FormatInt(time.Now().UnixNano(), 16)
+	for _, v := range pItem.Members {
+		pMember, err := store.Users().Get(c, v.UserKey)
+		if err != nil {
+			c.Errorf("%s in getting member %s of item %s", err, v.UserKey, pItem.Id)
+			continue
+		}
+		operation.Registration_ids = append(operation.Registration_ids, pMember.RegistrationToken)
+	}
+	if r = sendGroupOperation(c, &operation); r != http.StatusOK {
+		c.Errorf("Send group operation %+v to GCM failed", operation)
+		return
+	}
+	pItem.GcmGroupName = operation.Notification_key_name
+	pItem.GcmGroupKey = operation.Notification_key
+	c.Infof("GCM group %s is created again for item %s", pItem.GcmGroupName, pItem.Id)
+	return
+}
+
+// POST ./items/xxx/restore, xxx: Item key
+// The owner or an administrator restores a deleted item within the restore window.
+// Members are notified through a new GCM group.
+// Success: 200 OK
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found, 410 Gone, 500 Internal Server Error
+func restoreItem(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("RestoreItem()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+
+	// Set response
+	defer func() {
+		if r == http.StatusOK {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get the deleted item
+	pDeleted, err := store.DeletedItems().Get(c, keyString)
+	if err != nil {
+		c.Errorf("%s in getting deleted item %s", err, keyString)
+		r, e = itemError(err)
+		return
+	}
+	var dst Item = pDeleted.Item
+	userKey, _ := RequestUser(req)
+	if !isItemOwner(&dst, userKey) && !isAdmin(req) {
+		c.Warningf("User %s is neither the owner of item %s nor an administrator", userKey, keyString)
+		r = http.StatusForbidden
+		e = NewApiError(ErrCodeNotItemOwner, "Only the item owner can restore the item")
+		return
+	}
+	var now time.Time = time.Unix(time.Now().Unix(), 0)
+	if !now.Before(pDeleted.DeleteTime.Add(config.RestoreWindow())) {
+		c.Warningf("Item %s was deleted at %s. It's too late to restore.", keyString, pDeleted.DeleteTime)
+		r = http.StatusGone
+		e = NewApiError(ErrCodeRestoreWindowPassed, "Item was deleted too long ago to restore")
+		return
+	}
+
+	// Nobody joins or leaves a finished item. It doesn't need a GCM group.
+	var recreated bool = isItemActive(&dst)
+	if recreated {
+		if gcmResponseCode := recreateItemGcmGroup(c, &dst); gcmResponseCode != http.StatusOK {
+			r = gcmResponseCode
+			e = notificationError(gcmResponseCode)
+			return
+		}
+	}
+
+	err = store.RunInTransaction(c, func(tc Context) error {
+		if err1 := store.DeletedItems().Restore(tc, keyString, &dst); err1 != nil {
+			return err1
+		}
+		return saveItemEvents(tc, keyString, []ItemEvent{newItemEvent(ItemEventRestored, userKey, now)})
+	})
+	if err != nil {
+		c.Errorf("%s in restoring item %s", err, keyString)
+		r, e = itemError(err)
+		// Nobody uses the new group, e.g. another request has restored the item with its own group
+		if recreated {
+			if gcmResponseCode := updateItemGcmGroup(c, stateDeleteItem, &dst, nil); gcmResponseCode != http.StatusOK {
+				c.Warningf("Remove unused GCM group %s of item %s failed", dst.GcmGroupName, keyString)
+			}
+		}
+		return
+	}
+	c.Infof("Item %s is restored by %s", keyString, userKey)
+	rw.Header().Set("ETag", itemETag(&dst))
+
+	// Notify members through Google Cloud Messaging. Keep going in failure because datastore has updated.
+	if isItemActive(&dst) {
+		var notification ItemUpdateNotification = ItemUpdateNotification{
+			Message:       "Item is restored. ",
+			ItemId:        keyString,
+			RequestUserId: userKey,
+		}
+		if gcmResponseCode := sendItemGcmMessage(c, &dst, &notification); gcmResponseCode != http.StatusOK {
+			c.Warningf("Send notification to all members failed")
+		}
+	}
+}
+
+// Name of the blob which a URL of the blob store points to. Return "" for other URLs.
+func itemBlobName(c Context, blobUrl string) string {
+	if blobUrl == "" || blobStore == nil {
+		return ""
+	}
+	u, err := url.Parse(blobUrl)
+	if err != nil {
+		return ""
+	}
+	var name string = path.Base(u.Path)
+	if v, err := blobStore.URL(c, name); err != nil || v != blobUrl {
+		return ""
+	}
+	return name
+}
+
+// Whether an item or a deleted item other than the purged one still shows the blob.
+// Clients can set any URL as the image of any number of items.
+func blobInUse(c Context, blobUrl string, purgedId string) (bool, error) {
+	for _, property := range []string{"Image", "Thumbnail"} {
+		items, _, err := store.Items().Query(c, ItemQuery{Filters: []ItemFilter{{property, "=", blobUrl}}, Limit: 1})
+		if err != nil {
+			return false, err
+		}
+		if len(items) > 0 {
+			return true, nil
+		}
+	}
+	deleted, err := store.DeletedItems().FindByBlob(c, blobUrl, 2)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range deleted {
+		if v.Item.Id != purgedId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Delete items for good after the restore window along with their events, comments and images.
+// Return the number of purged items.
+func PurgeDeletedItems(c Context, now time.Time) (n int, err error) {
+	var items []DeletedItem
+	if items, err = store.DeletedItems().Expired(c, now.Add(-config.RestoreWindow()), PurgeItemsBatchSize); err != nil {
+		c.Errorf("%s in querying deleted items to purge", err)
+		return
+	}
+	for _, v := range items {
+		var id string = v.Item.Id
+		if err = store.DeletedItems().Purge(c, id); err == ErrNotFound {
+			// Restored or purged by others
+			continue
+		} else if err != nil {
+			c.Errorf("%s in purging item %s", err, id)
+			return
+		}
+		n++
+		// Delete images which no other items show. Keep going in failure because the item is gone.
+		for _, blobUrl := range []string{v.Item.Image, v.Item.Thumbnail} {
+			var name string = itemBlobName(c, blobUrl)
+			if name == "" {
+				continue
+			}
+			if inUse, err1 := blobInUse(c, blobUrl, id); err1 != nil {
+				c.Warningf("%s in checking whether image %s of item %s is in use. Keep it.", err1, name, id)
+				continue
+			} else if inUse {
+				c.Debugf("Image %s of item %s is in use by other items", name, id)
+				continue
+			}
+			if err1 := blobStore.Delete(c, name); err1 != nil && err1 != ErrBlobNotFound {
+				c.Warningf("%s in deleting image %s of item %s", err1, name, id)
+			}
+		}
+		c.Infof("Item %s deleted at %s is purged", id, v.DeleteTime)
+	}
+	c.Debugf("%d deleted items are purged at %s", n, now)
+	return
+}
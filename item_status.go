@@ -0,0 +1,203 @@
+package aliza
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Item status. Items are open until they are full. The owner confirms a full item to meet,
+// then closes it after the meetup. The owner can cancel an item any time before it's closed.
+// Items close automatically after their deadlines. Closed and cancelled items can't be changed.
+const (
+	ItemStatusOpen      = "open"
+	ItemStatusFull      = "full"
+	ItemStatusConfirmed = "confirmed"
+	ItemStatusClosed    = "closed"
+	ItemStatusCancelled = "cancelled"
+)
+
+// Valid transitions from each status. Open and full follow the attendants automatically.
+var itemStatusTransitions = map[string][]string{
+	ItemStatusOpen:      {ItemStatusFull, ItemStatusClosed, ItemStatusCancelled},
+	ItemStatusFull:      {ItemStatusOpen, ItemStatusConfirmed, ItemStatusClosed, ItemStatusCancelled},
+	ItemStatusConfirmed: {ItemStatusOpen, ItemStatusClosed, ItemStatusCancelled},
+}
+
+// Statuses which the owner can set by PUT ./items/xxx/status
+var ownerItemStatuses = []string{ItemStatusConfirmed, ItemStatusClosed, ItemStatusCancelled}
+
+// Notification message of entering each status
+var itemStatusMessages = map[string]string{
+	ItemStatusOpen:      "Item is open again. ",
+	ItemStatusFull:      "Item is full. Waiting for the owner to confirm. ",
+	ItemStatusConfirmed: "Owner confirmed the item. Please get together! ",
+	ItemStatusClosed:    "Item is closed. Thank you for attending! ",
+	ItemStatusCancelled: "Owner cancelled the item. ",
+}
+
+// Statuses in which members can join and leave
+var activeItemStatuses = []string{ItemStatusOpen, ItemStatusFull, ItemStatusConfirmed}
+
+type ItemStatusRequestBody struct {
+	Status string `json:"status"`
+}
+
+// Status of an item. Items stored before the status existed are open.
+func itemStatus(pItem *Item) string {
+	if pItem.Status == "" {
+		return ItemStatusOpen
+	}
+	return pItem.Status
+}
+
+func isItemStatus(status string) bool {
+	_, ok := itemStatusMessages[status]
+	return ok
+}
+
+func isItemActive(pItem *Item) bool {
+	return containsString(activeItemStatuses, itemStatus(pItem))
+}
+
+func containsString(a []string, v string) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Change the item status. Append the message of the new status to the notification.
+func transitItem(pItem *Item, status string, pNotification *ItemUpdateNotification) *ApiError {
+	var from string = itemStatus(pItem)
+	if !containsString(itemStatusTransitions[from], status) {
+		return NewFieldError(ErrCodeInvalidTransition, "status", fmt.Sprintf("Item can't be %s when it's %s", status, from))
+	}
+	pItem.Status = status
+	pNotification.Message += itemStatusMessages[status]
+	return nil
+}
+
+// The status which the attendants imply. Owners confirm full items themselves.
+func attendantItemStatus(pItem *Item) string {
+	var status string = itemStatus(pItem)
+	switch {
+	case pItem.Attendant >= pItem.People && status == ItemStatusOpen:
+		return ItemStatusFull
+	case pItem.Attendant < pItem.People && (status == ItemStatusFull || status == ItemStatusConfirmed):
+		return ItemStatusOpen
+	}
+	return status
+}
+
+// PUT ./items/xxx/status, xxx: Item key
+// Only the owner can confirm, close and cancel the item
+// Success: 200 OK
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found, 409 Conflict, 412 Precondition Failed
+func updateItemStatus(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("UpdateItemStatus()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+
+	// Set response
+	defer func() {
+		if r == http.StatusOK {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get data from body
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		c.Errorf("%s in reading body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
+		return
+	}
+	var body ItemStatusRequestBody
+	if err = json.Unmarshal(b, &body); err != nil {
+		c.Errorf("%s in decoding body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be a status in JSON")
+		return
+	}
+	if !containsString(ownerItemStatuses, body.Status) {
+		c.Warningf("Invalid status %s", body.Status)
+		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeInvalidStatus, "status", "Status should be confirmed, closed or cancelled")
+		return
+	}
+
+	userKey, _ := RequestUser(req)
+	var dst Item
+	var notification ItemUpdateNotification
+	err = store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		dst = *pItem
+		notification.Message = ""
+		if e1 := checkItemIfMatch(req.Header.Get("If-Match"), &dst); e1 != nil {
+			return e1
+		}
+		if len(dst.Members) == 0 || dst.Members[0].UserKey != userKey {
+			return NewApiError(ErrCodeNotItemOwner, "Only the item owner can change the status")
+		}
+		// Meetups of unconfirmed items never happen. Cancel them instead.
+		if body.Status == ItemStatusClosed && itemStatus(&dst) != ItemStatusConfirmed {
+			return NewFieldError(ErrCodeInvalidTransition, "status", "Only confirmed items can be closed")
+		}
+		if e1 := transitItem(&dst, body.Status, &notification); e1 != nil {
+			return e1
+		}
+		if err1 = saveItemEvents(tc, keyString, []ItemEvent{statusChangedEvent(userKey, dst.Status, time.Now())}); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, keyString, &dst)
+	})
+	if err != nil {
+		c.Errorf("%s in changing item %s to %s", err, keyString, body.Status)
+		if e1, ok := err.(*ApiError); ok {
+			e = e1
+			switch e.Code {
+			case ErrCodeNotItemOwner:
+				r = http.StatusForbidden
+			case ErrCodePreconditionFailed:
+				r = http.StatusPreconditionFailed
+			default:
+				r = http.StatusConflict
+			}
+		} else {
+			r, e = itemError(err)
+		}
+		return
+	}
+	c.Infof("Item %s is %s by its owner", keyString, dst.Status)
+	rw.Header().Set("ETag", itemETag(&dst))
+
+	// Notify members through Google Cloud Messaging. Keep going in failure because datastore has updated.
+	notification.ItemId = keyString
+	notification.RequestUserId = userKey
+	if gcmResponseCode := sendItemGcmMessage(c, &dst, &notification); gcmResponseCode != http.StatusOK {
+		c.Warningf("Send notification to all members failed")
+	}
+	// Nobody joins or leaves a finished item. Remove its GCM group.
+	if !isItemActive(&dst) {
+		if gcmResponseCode := updateItemGcmGroup(c, stateDeleteItem, &dst, nil); gcmResponseCode != http.StatusOK {
+			c.Warningf("Remove GCM group of item %s failed", keyString)
+		}
+	}
+}
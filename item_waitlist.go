@@ -0,0 +1,253 @@
+package aliza
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type ItemWaitlistResponseBody struct {
+	// 1 for the first waiting user
+	Position int `json:"position"`
+}
+
+func isItemMember(pItem *Item, userKey string) bool {
+	for _, v := range pItem.Members {
+		if v.UserKey == userKey {
+			return true
+		}
+	}
+	return false
+}
+
+func removeWaitlisted(waitlist []ItemMember, userKey string) []ItemMember {
+	for i, v := range waitlist {
+		if v.UserKey == userKey {
+			return append(waitlist[:i], waitlist[i+1:]...)
+		}
+	}
+	return waitlist
+}
+
+// Whether any waitlisted user fits into the open slots
+func waitlistFits(pItem *Item) bool {
+	for _, v := range pItem.Waitlist {
+		if pItem.Attendant + v.Attendant <= pItem.People && !isItemMember(pItem, v.UserKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Promote waitlisted users to members in waiting order as long as they fit.
+// Users who don't fit keep waiting. Return the promoted members.
+func promoteWaitlist(pItem *Item, now time.Time) (promoted []ItemMember) {
+	if !isItemActive(pItem) {
+		return
+	}
+	var waitlist []ItemMember = make([]ItemMember, 0, len(pItem.Waitlist))
+	for _, v := range pItem.Waitlist {
+		if isItemMember(pItem, v.UserKey) {
+			// Joined by other means
+			continue
+		}
+		if pItem.Attendant + v.Attendant > pItem.People {
+			waitlist = append(waitlist, v)
+			continue
+		}
+		v.JoinTime = time.Unix(now.Unix(), 0)
+		pItem.Members = append(pItem.Members, v)
+		pItem.Attendant += v.Attendant
+		promoted = append(promoted, v)
+	}
+	pItem.Waitlist = waitlist
+	return
+}
+
+// Add promoted members to the GCM group and tell each of them.
+// Keep going in failure because datastore has updated.
+func notifyPromotedMembers(c Context, pItem *Item, promoted []ItemMember) {
+	for _, v := range promoted {
+		pUser, err := store.Users().Get(c, v.UserKey)
+		if err != nil {
+			c.Errorf("%s in getting promoted user %s", err, v.UserKey)
+			continue
+		}
+		if r := updateItemGcmGroup(c, stateAppendMember, pItem, pUser); r != http.StatusOK {
+			c.Warningf("Add promoted user %s to GCM group %s failed", v.UserKey, pItem.GcmGroupName)
+		}
+		var data map[string]string = map[string]string{
+			"message": fmt.Sprintf("You are promoted from the waitlist and attend %d. ", v.Attendant),
+			"itemid":  pItem.Id,
+			"status":  itemStatus(pItem),
+		}
+		if err = notifier.SendToToken(c, pUser.RegistrationToken, data); err != nil {
+			c.Warningf("%s in notifying promoted user %s", err, v.UserKey)
+		}
+	}
+}
+
+// PUT ./items/xxx/waitlist, xxx: Item key
+// Wait for open slots of a full item. Waiting again changes the attendant but keeps the position.
+// Success: 200 OK with the position
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found, 409 Conflict
+func joinItemWaitlist(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("JoinItemWaitlist()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+	// Position in the waitlist
+	var position int
+
+	// Set response
+	defer func() {
+		if r == http.StatusOK {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusOK)
+			json.NewEncoder(rw).Encode(ItemWaitlistResponseBody{Position: position})
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get data from body
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		c.Errorf("%s in reading body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
+		return
+	}
+	var m ItemMember
+	if err = json.Unmarshal(b, &m); err != nil {
+		c.Errorf("%s in decoding body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be a member in JSON")
+		return
+	}
+	if m.Attendant <= 0 {
+		c.Warningf("Attendant %d <= 0", m.Attendant)
+		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeInvalidAttendant, "attendant", "Attendant should be greater than 0")
+		return
+	}
+	userKey, _ := RequestUser(req)
+	m.UserKey = userKey
+
+	err = store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		if !isItemActive(pItem) {
+			return NewApiError(ErrCodeItemNotActive, "Item is "+pItem.Status)
+		}
+		if containsString(pItem.Banned, userKey) {
+			return NewApiError(ErrCodeBannedFromItem, "Owner banned the user from the item")
+		}
+		if isItemMember(pItem, userKey) {
+			return NewApiError(ErrCodeAlreadyMember, "User is already a member of the item")
+		}
+		if m.Attendant > pItem.People {
+			return NewFieldError(ErrCodeInvalidAttendant, "attendant", fmt.Sprintf("At most %d people can attend", pItem.People))
+		}
+		var i int
+		for i = 0; i < len(pItem.Waitlist); i++ {
+			if pItem.Waitlist[i].UserKey == userKey {
+				break
+			}
+		}
+		if i == len(pItem.Waitlist) && pItem.Attendant + m.Attendant <= pItem.People {
+			return NewApiError(ErrCodeItemNotFull, "Item has enough open slots. Join it directly.")
+		}
+		if i == len(pItem.Waitlist) {
+			m.JoinTime = time.Unix(time.Now().Unix(), 0)
+			pItem.Waitlist = append(pItem.Waitlist, m)
+		} else {
+			m.JoinTime = pItem.Waitlist[i].JoinTime
+			pItem.Waitlist[i] = m
+		}
+		position = i + 1
+		event := newItemEvent(ItemEventWaitlistJoined, userKey, time.Unix(time.Now().Unix(), 0))
+		event.Attendant = m.Attendant
+		if err1 = saveItemEvents(tc, keyString, []ItemEvent{event}); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, keyString, pItem)
+	})
+	if err != nil {
+		c.Errorf("%s in waiting for item %s", err, keyString)
+		r, e = itemWaitlistError(err)
+		return
+	}
+	c.Infof("User %s waits for item %s at %d", userKey, keyString, position)
+}
+
+// DELETE ./items/xxx/waitlist, xxx: Item key
+// Success: 204 No Content
+// Failure: 400 Bad Request, 404 Not Found, 409 Conflict
+func leaveItemWaitlist(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("LeaveItemWaitlist()")
+	// Result
+	r := http.StatusNoContent
+	// Error detail
+	var e *ApiError
+	// Item key
+	var keyString string = params.Get("id")
+
+	// Set response
+	defer func() {
+		if r == http.StatusNoContent {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	userKey, _ := RequestUser(req)
+	err := store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		var n int = len(pItem.Waitlist)
+		if pItem.Waitlist = removeWaitlisted(pItem.Waitlist, userKey); len(pItem.Waitlist) == n {
+			return NewApiError(ErrCodeNotWaitlisted, "User is not waiting for the item")
+		}
+		event := newItemEvent(ItemEventWaitlistLeft, userKey, time.Unix(time.Now().Unix(), 0))
+		if err1 = saveItemEvents(tc, keyString, []ItemEvent{event}); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, keyString, pItem)
+	})
+	if err != nil {
+		c.Errorf("%s in leaving waitlist of item %s", err, keyString)
+		r, e = itemWaitlistError(err)
+		return
+	}
+	c.Infof("User %s stops waiting for item %s", userKey, keyString)
+}
+
+// Map an error of waitlist transactions to an HTTP status
+func itemWaitlistError(err error) (int, *ApiError) {
+	e, ok := err.(*ApiError)
+	if !ok {
+		return itemError(err)
+	}
+	switch e.Code {
+	case ErrCodeInvalidAttendant, ErrCodeNotWaitlisted:
+		return http.StatusBadRequest, e
+	case ErrCodeBannedFromItem:
+		return http.StatusForbidden, e
+	}
+	return http.StatusConflict, e
+}
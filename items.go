@@ -1,38 +1,68 @@
 package aliza
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/urlfetch"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"fmt"
+	"unicode/utf8"
 )
 
 type ItemMember struct {
-	UserKey      string     `json:"userkey"`
-	Attendant    int        `json:"attendant"`
-	PhoneNumber  string     `json:"phonenumber,omitempty"`
-	SkypeId      string     `json:"skypeid,omitempty"`
+	UserKey         string     `json:"userkey"`
+	Attendant       int        `json:"attendant"`
+	PhoneNumber     string     `json:"phonenumber,omitempty"`
+	SkypeId         string     `json:"skypeid,omitempty"`
+	// Contact details hidden from other members. Members share all by default.
+	HidePhoneNumber bool       `json:"hidephonenumber,omitempty"`
+	HideSkypeId     bool       `json:"hideskypeid,omitempty"`
+	// When the member joined. Zero for members who joined before it existed.
+	JoinTime        time.Time  `json:"jointime"`
 }
 
 type Item struct {
 	Id             string     `json:"id"          datastore:"-"`
 	Image          string     `json:"image"`
 	Thumbnail      string     `json:"thumbnail"`
+	// What the meetup is about. Saved searches match their keywords against it.
+	Description    string     `json:"description" datastore:",noindex"`
 	People         int        `json:"people"`
 	Attendant      int        `json:"attendant"`
+	// People - Attendant. Stored to search items with free slots.
+	OpenSlots      int        `json:"openslots"`
 	Latitude       float64    `json:"latitude"`
 	Longitude      float64    `json:"longitude"`
+	// Geohash of the location to search nearby items
+	Geohash        string     `json:"-"`
+	// Distance in kilometers from the location of a nearby search. Not stored.
+	Distance      *float64    `json:"distance,omitempty"  datastore:"-"`
 	CreateTime     time.Time  `json:"createtime"`
-	// Members are whom join this item. The first member is the item owner.
-	// When the first member leaves, delete the item.
+	// The item closes automatically after the deadline. Zero means no deadline.
+	Deadline       time.Time  `json:"deadline"`
+	// open, full, confirmed, closed or cancelled. Empty is open for items stored before it existed.
+	Status         string     `json:"status"`
+	// Members are whom join this item in joining order. The first member is the item owner.
+	// When the owner leaves, the longest-standing member becomes the owner.
+	// When the last member leaves, delete the item.
 	Members      []ItemMember `json:"members"`
+	// Incremented by every update. Exposed as ETag.
+	Version        int64      `json:"version"`
+	// Every ownership change for audit
+	OwnerChanges []ItemOwnerChange `json:"ownerchanges"`
+	// Users waiting for open slots in waiting order. They are promoted to members when they fit.
+	Waitlist     []ItemMember `json:"waitlist"`
+	// User keys whom the owner banned. They can't join or wait again.
+	Banned       []string     `json:"banned"`
+	// Numbers of members and waitlisted users. Not stored. Non-members see only them.
+	MemberCount    int        `json:"membercount"   datastore:"-"`
+	WaitlistCount  int        `json:"waitlistcount" datastore:"-"`
 	// Google Cloud Messaging group unique name and ID. Reference: https://developers.google.com/cloud-messaging/notifications
 	GcmGroupName   string     `json:"gcmgroupname"`
 	GcmGroupKey    string     `json:"gcmgroupkey"`
@@ -59,21 +89,22 @@ const (
 
 func storeItem(rw http.ResponseWriter, req *http.Request) {
 	// Appengine
-	var c appengine.Context = appengine.NewContext(req)
+	var c Context = newContext(req)
 	// Result, 0: success, 1: failed
 	var r int = http.StatusCreated
-	var cKey *datastore.Key = nil
+	// Error detail
+	var e *ApiError
+	var cKey string
 
 	// Write response finally
 	defer func() {
 		// Return status. WriteHeader() must be called before call to Write
 		if r == http.StatusCreated {
 			// Changing the header after a call to WriteHeader (or Write) has no effect.
-			rw.Header().Set("Location", req.URL.String()+"/"+cKey.Encode())
+			rw.Header().Set("Location", req.URL.String()+"/"+cKey)
 			rw.WriteHeader(http.StatusCreated)
 		} else {
-			// http.StatusBadRequest
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
@@ -82,12 +113,14 @@ func storeItem(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		c.Errorf("%s in reading body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
 		return
 	}
 	var item Item
 	if err = json.Unmarshal(b, &item); err != nil {
 		c.Errorf("%s in decoding body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be an item in JSON")
 		return
 	}
 
@@ -95,65 +128,90 @@ func storeItem(rw http.ResponseWriter, req *http.Request) {
 	if item.Image == "" {
 		c.Errorf("The request does not specify item image URL")
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeImageRequired, "image", "Item image URL is required")
 		return
 	}
 	if item.Attendant <= 0 {
 		c.Errorf("Item attendant %d must be >= 0", item.Attendant)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeInvalidAttendant, "attendant", "Attendant should be greater than 0")
 		return
 	}
 	if item.Attendant >= item.People {
 		c.Errorf("Item attendant %d can't be greater or equal to item people %d", item.Attendant, item.People)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeInvalidPeople, "people", "People should be greater than attendant")
 		return
 	}
 	if item.Latitude < -90 || item.Latitude > 90 {
-		c.Errorf("Latitude %d should be -90~90", item.Latitude)
+		c.Errorf("Latitude %f should be -90~90", item.Latitude)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeInvalidLocation, "latitude", "Latitude should be -90~90")
 		return
 	}
 	if item.Longitude < -180 || item.Longitude > 180 {
-		c.Errorf("Latitude %d should be -180~180", item.Longitude)
+		c.Errorf("Longitude %f should be -180~180", item.Longitude)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeInvalidLocation, "longitude", "Longitude should be -180~180")
 		return
 	}
 	if item.Members == nil || len(item.Members) != 1 {
 		c.Errorf("Owner is not set")
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeOwnerNotSet, "members", "Members should contain exactly the owner")
 		return
 	}
 	if item.Members[0].Attendant <= 0 {
 		c.Errorf("Attendant %d <= 0", item.Members[0].Attendant)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeInvalidAttendant, "members[0].attendant", "Owner's attendant should be greater than 0")
 		return
 	}
 	if item.Members[0].Attendant != item.Attendant {
-		c.Errorf("Confused attendant %d and owner's attendant", item.Attendant, item.Members[0].Attendant)
+		c.Errorf("Confused attendant %d and owner's attendant %d", item.Attendant, item.Members[0].Attendant)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeAttendantMismatch, "members[0].attendant", "Owner's attendant should equal item attendant")
 		return
 	}
 	if item.Members[0].PhoneNumber == "" && item.Members[0].SkypeId == "" {
 		c.Errorf("Phone number %s or Skype ID %s is not given", item.Members[0].PhoneNumber, item.Members[0].SkypeId)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeContactRequired, "Phone number or Skype ID is required").
+			WithField("members[0].phonenumber", "Phone number or Skype ID is required").
+			WithField("members[0].skypeid", "Phone number or Skype ID is required")
 		return
 	}
-
-	// Set the first member as owner to the user key
-	var pUser    *User
-	var pUserKey *datastore.Key
-	var instanceId string = req.Header.Get(HttpHeaderInstanceId)
-	if pUserKey, pUser, err = searchUser(instanceId, c); err != nil {
-		c.Errorf("%s in searching user %v", err, instanceId)
-		r = http.StatusInternalServerError
+	if e = checkDescription(item.Description); e != nil {
+		c.Errorf("Description is %d characters long", utf8.RuneCountInString(item.Description))
+		r = http.StatusBadRequest
 		return
 	}
-	item.Members[0].UserKey = pUserKey.Encode()
+	if !item.Deadline.IsZero() {
+		if e = checkDeadline(item.Deadline, time.Now()); e != nil {
+			c.Errorf("Invalid deadline %s", item.Deadline)
+			r = http.StatusBadRequest
+			return
+		}
+	}
+
+	// Set the first member as owner to the user key
+	userKey, pUser := RequestUser(req)
+	item.Members[0].UserKey = userKey
+
+	// Index the location and free slots
+	item.Geohash = encodeGeohash(item.Latitude, item.Longitude, GeohashPrecision)
+	item.Distance = nil
+	item.OpenSlots = item.People - item.Attendant
+	item.Status = ItemStatusOpen
 
 	// Set now as the creation time. Precision to a second.
 	item.CreateTime = time.Unix(time.Now().Unix(), 0)
+	item.Members[0].JoinTime = item.CreateTime
+	item.OwnerChanges = nil
+	item.Waitlist = nil
 
 	// Set GCM group name
-	item.GcmGroupName = pUserKey.Encode() + strconv.FormatInt(item.CreateTime.UnixNano(), 16)
+	item.GcmGroupName = userKey + strconv.FormatInt(item.CreateTime.UnixNano(), 16)
 
 	// Vernon debug
 	c.Debugf("Create a GCM group...")
@@ -165,9 +223,10 @@ func storeItem(rw http.ResponseWriter, req *http.Request) {
 	operation.Operation = "create"
 	operation.Notification_key_name = item.GcmGroupName
 	operation.Registration_ids = []string{pUser.RegistrationToken}
-	if gcmResponseCode = sendGroupOperationToGcm(&operation, c); gcmResponseCode != http.StatusOK {
+	if gcmResponseCode = sendGroupOperation(c, &operation); gcmResponseCode != http.StatusOK {
 		c.Errorf("Send group operation to GCM failed")
 		r = gcmResponseCode
+		e = notificationError(gcmResponseCode)
 		return
 	}
 	c.Infof("GCM group %s is created", item.GcmGroupName)
@@ -178,99 +237,93 @@ func storeItem(rw http.ResponseWriter, req *http.Request) {
 	// Vernon debug
 	c.Debugf("Store item %+v", item)
 
-	// Store item into datastore
-	pKey := datastore.NewKey(c, ItemKind, ItemRoot, 0, nil)
-	cKey, err = datastore.Put(c, datastore.NewIncompleteKey(c, ItemKind, pKey), &item)
+	// Store item into datastore with its first event
+	err = store.RunInTransaction(c, func(tc Context) error {
+		var err1 error
+		if cKey, err1 = store.Items().Create(tc, &item); err1 != nil {
+			return err1
+		}
+		event := newItemEvent(ItemEventCreated, userKey, item.CreateTime)
+		event.Attendant = item.Attendant
+		return saveItemEvents(tc, cKey, []ItemEvent{event})
+	})
 	if err != nil {
 		c.Errorf("%s in storing in datastore", err)
 		log.Println(err)
 		r = http.StatusInternalServerError
 		return
 	}
-}
 
-func queryItem(rw http.ResponseWriter, req *http.Request) {
-	// To log messages
-	c := appengine.NewContext(req)
-
-	if len(req.URL.Query()) == 0 {
-		// Get key from URL
-		tokens := strings.Split(req.URL.Path, "/")
-		var keyIndexInTokens int = 0
-		for i, v := range tokens {
-			if v == "items" {
-				keyIndexInTokens = i + 1
-			}
-		}
-		if keyIndexInTokens >= len(tokens) {
-			c.Debugf("Key is not given so that query all items")
-			queryAllItem(rw, req)
-			return
-		}
-		keyString := tokens[keyIndexInTokens]
-		if keyString == "" {
-			c.Debugf("Key is empty so that query all items")
-			queryAllItem(rw, req)
-		} else {
-			queryOneItem(rw, req, keyString)
-		}
-	} else {
-		searchItem(rw, req)
+	// Tell users whose saved searches match the new item without delaying the response
+	if err = enqueueSearchAlerts(c, cKey); err != nil {
+		c.Warningf("%s in queuing saved search alerts of item %s", err, cKey)
 	}
 }
 
-func queryAllItem(rw http.ResponseWriter, req *http.Request) {
-	// To access datastore and to log
-	c := appengine.NewContext(req)
-	c.Debugf("QueryAll()")
+// Max characters of an item description
+const MaxItemDescriptionLength = 500
 
-	// Get all entities
-	var dst []Item
-	r := 0
-	k, err := datastore.NewQuery(ItemKind).Order("-CreateTime").GetAll(c, &dst)
-	if err != nil {
-		c.Errorf("%s", err)
-		r = 1
+// Check an item description isn't too long
+func checkDescription(description string) *ApiError {
+	if utf8.RuneCountInString(description) > MaxItemDescriptionLength {
+		return NewFieldError(ErrCodeDescriptionTooLong, "description", fmt.Sprintf("Description should be at most %d characters", MaxItemDescriptionLength))
 	}
+	return nil
+}
 
-	// Map keys and items
-	for i, v := range k {
-		dst[i].Id = v.Encode()
+// The longest time an item can stay open
+const MaxItemLifetime = 90 * 24 * time.Hour
 
-		// Vernon debug
-		c.Debugf("Item from datastore %+v", dst[i])
+// Check an item deadline is in the future but not too far
+func checkDeadline(deadline time.Time, now time.Time) *ApiError {
+	if !deadline.After(now) {
+		return NewFieldError(ErrCodeInvalidDeadline, "deadline", "Deadline should be in the future")
 	}
+	if deadline.After(now.Add(MaxItemLifetime)) {
+		return NewFieldError(ErrCodeInvalidDeadline, "deadline", fmt.Sprintf("Deadline should be within %d days", MaxItemLifetime/(24*time.Hour)))
+	}
+	return nil
+}
 
-	// Return status. WriteHeader() must be called before call to Write
-	if r == 0 {
-		rw.WriteHeader(http.StatusOK)
-	} else {
-		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+// GET ./items
+// List all items, or search items when there are query parameters other than paging ones
+func queryItem(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("near") != "" {
+		searchNearItem(rw, req)
 		return
 	}
+	for key := range req.URL.Query() {
+		if !isItemPageParameter(key) {
+			searchItem(rw, req)
+			return
+		}
+	}
+	queryAllItem(rw, req)
+}
 
-	// Vernon debug
-	b, _ := json.Marshal(dst)
-	c.Debugf("Item JSON %s", b)
+func queryAllItem(rw http.ResponseWriter, req *http.Request) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("QueryAll()")
 
-	// Return body
-	encoder := json.NewEncoder(rw)
-	if err = encoder.Encode(dst); err != nil {
-		c.Errorf("%s in encoding result %v", err, dst)
-	} else {
-		c.Infof("QueryAll() returns %d items", len(dst))
-	}
+	listItems(rw, req, c, ItemQuery{Order: "-CreateTime"})
 }
 
-func queryOneItem(rw http.ResponseWriter, req *http.Request, keyString string) {
+// GET ./items/xxx, xxx: Item key
+// Return 304 Not Modified if If-None-Match has the ETag of the current version as the user sees it
+func queryOneItem(rw http.ResponseWriter, req *http.Request, params Params) {
 	// To access datastore and to log
-	c := appengine.NewContext(req)
+	c := newContext(req)
 	c.Debugf("QueryOneItem()")
+	// Item key
+	var keyString string = params.Get("id")
 
 	// Entity
-	var dst Item
+	var dst *Item = &Item{}
 	// Result
 	r := http.StatusOK
+	// Error detail
+	var e *ApiError
 
 	defer func() {
 		// Return status. WriteHeader() must be called before call to Write
@@ -281,28 +334,33 @@ func queryOneItem(rw http.ResponseWriter, req *http.Request, keyString string) {
 			if err := encoder.Encode(dst); err != nil {
 				c.Errorf("%s in encoding result %v", err, dst)
 			}
+		} else if r == http.StatusNotModified {
+			rw.WriteHeader(http.StatusNotModified)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
-	// Decode key from string
-	key, err := datastore.DecodeKey(keyString)
-	if err != nil {
-		c.Errorf("%s in decoding key string", err)
-		r = http.StatusBadRequest
+	// Get the entity
+	var err error
+	if dst, err = store.Items().Get(c, keyString); err != nil {
+		c.Errorf("%s in getting entity from datastore by key %s", err, keyString)
+		r, e = itemError(err)
 		return
 	}
 
-	// Get the entity
-	if err := datastore.Get(c, key, &dst); err != nil {
-		c.Errorf("%s in getting entity from datastore by key %s", err, keyString)
-		r = http.StatusNotFound
+	// The client already has this version. Members and strangers see different bodies.
+	userKey, _ := RequestUser(req)
+	rw.Header().Set("ETag", itemViewETag(dst, userKey))
+	rw.Header().Set("Vary", HttpHeaderInstanceId)
+	if itemNotModified(req, dst, userKey) {
+		c.Debugf("Item %s is not modified since version %d", keyString, dst.Version)
+		r = http.StatusNotModified
 		return
 	}
 
-	// Store key to item
-	dst.Id = keyString
+	// Strangers don't see contact details
+	shapeItem(dst, userKey)
 
 	// Vernon debug
 	c.Debugf("Got item %v", dst)
@@ -316,103 +374,325 @@ func queryOneItem(rw http.ResponseWriter, req *http.Request, keyString string) {
 	return
 }
 
+// GET ./items?people_gte=3&open_slots_gt=0&sort=-createtime
+// Search items. See parseItemSearch() for parameters.
 func searchItem(rw http.ResponseWriter, req *http.Request) {
 	// Appengine
-	var c appengine.Context = appengine.NewContext(req)
+	var c Context = newContext(req)
 	c.Debugf("searchItem()")
 
-	// Get all entities
-	var dst []Item
-	// Error flag
-	r := 0
 	// Query
+	f, e := parseItemSearch(req.URL.Query())
+	if e != nil {
+		c.Warningf("Invalid search %s", req.URL.RawQuery)
+		writeError(rw, http.StatusBadRequest, e)
+		return
+	}
+	c.Debugf("Search %+v", f)
+
+	listItems(rw, req, c, f)
+}
+
+// Page size of item lists
+const (
+	DefaultItemLimit = 50
+	MaxItemLimit     = 200
+)
+
+// Query parameters of item lists which are not filters
+func isItemPageParameter(key string) bool {
+	switch key {
+	case "limit", "cursor", "fields":
+		return true
+	}
+	return false
+}
+
+// Write a page of items in a JSON array
+// Query parameters:
+//	limit: the max number of items, 1~200, default 50
+//	cursor: continue from where the previous page stopped
+//	fields: comma separated JSON properties to return, e.g. "id,image,people,attendant"
+// Header Link: <url>; rel="next" points to the next page if there is.
+// Success: 200 OK
+// Failure: 400 Bad Request, 500 Internal Server Error
+func listItems(rw http.ResponseWriter, req *http.Request, c Context, f ItemQuery) {
+	listItemsBy(rw, req, c, f, store.Items().Query)
+}
+
+// Write a page of items got by a query function which works like ItemStore.Query()
+func listItemsBy(rw http.ResponseWriter, req *http.Request, c Context, f ItemQuery, query func(c Context, f ItemQuery) ([]Item, string, error)) {
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Items and the cursor of the next page
+	var dst []Item
+	var next string
+	// Selected JSON properties. All properties if it's empty.
+	var fields []string
+
+	defer func() {
+		// Return status. WriteHeader() must be called before call to Write
+		if r != http.StatusOK {
+			writeError(rw, r, e)
+			return
+		}
+		if next != "" {
+			rw.Header().Set("Link", "<"+nextPageUrl(req, next)+">; rel=\"next\"")
+		}
+		// Items are shaped for the request user
+		rw.Header().Set("Vary", HttpHeaderInstanceId)
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+
+		// Return body
+		var body interface{} = dst
+		if dst == nil {
+			body = []Item{}
+		} else if len(fields) > 0 {
+			body = selectItemFields(c, dst, fields)
+		}
+		if err := json.NewEncoder(rw).Encode(body); err != nil {
+			c.Errorf("%s in encoding result %v", err, dst)
+		} else {
+			c.Infof("Return %d items", len(dst))
+		}
+	}()
+
+	// Get paging parameters
 	q := req.URL.Query()
-	f := datastore.NewQuery(ItemKind)
-
-	for key := range q {
-		switch key {
-		case "Image":  // string
-			var v string = q.Get(key)
-			f = f.Filter(key+"=", v)
-		case "People":  // int
-			v, err := strconv.Atoi(q.Get(key))
-			if err != nil {
-				c.Errorf("%s in converting %s number\n", err, key)
-			} else {
-				f = f.Filter(key+"=", v)
-			}
-		case "Attendant":  // int
-			v, err := strconv.Atoi(q.Get(key))
-			if err != nil {
-				c.Errorf("%s in converting %s number\n", err, key)
-			} else {
-				f = f.Filter(key+"=", v)
-			}
-		case "Latitude":  // float64
-			v, err := strconv.ParseFloat(q.Get(key), 64)
-			if err != nil {
-				c.Errorf("%s in converting %s number\n", err, key)
-			} else {
-				f = f.Filter(key+"=", v)
-			}
-		case "Longitude":  // float64
-			v, err := strconv.ParseFloat(q.Get(key), 64)
-			if err != nil {
-				c.Errorf("%s in converting %s number\n", err, key)
-			} else {
-				f = f.Filter(key+"=", v)
-			}
-		case "CreateTime":  // time.Time
-			// TODO: define the format of time so that time.Parse() can correctly parse
-			var tmp string = q.Get(key)
-			v, err := time.Parse(tmp, tmp)
-			if err != nil {
-				c.Errorf("%s in converting %s number\n", err, key)
-			} else {
-				f = f.Filter(key+"=", v)
-			}
-			// Vernon debug
-			c.Debugf("%s, %s\n", key, v)
-		default:
-			c.Infof("%s is a wrong query property\n", key)
+	f.Limit = DefaultItemLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxItemLimit {
+			c.Warningf("Invalid limit %s", v)
+			r = http.StatusBadRequest
+			e = NewFieldError(ErrCodeInvalidQuery, "limit", fmt.Sprintf("Limit should be 1~%d", MaxItemLimit))
+			return
 		}
+		f.Limit = limit
 	}
-	k, err := f.GetAll(c, &dst)
-	if err != nil {
-		c.Errorf("%s in getting data from datastore\n", err)
-		r = 1
+	f.Cursor = q.Get("cursor")
+	if v := q.Get("fields"); v != "" {
+		fields = strings.Split(v, ",")
+		if e = checkItemFields(fields); e != nil {
+			c.Warningf("Invalid fields %s", v)
+			r = http.StatusBadRequest
+			return
+		}
 	}
 
-	// Map keys and items
-	for i, v := range k {
-		dst[i].Id = v.Encode()
+	// Get items
+	var err error
+	if dst, next, err = query(c, f); err != nil {
+		c.Errorf("%s in querying items %+v", err, f)
+		if err == ErrInvalidCursor {
+			r = http.StatusBadRequest
+			e = NewFieldError(ErrCodeInvalidQuery, "cursor", "Invalid cursor")
+		} else {
+			r = http.StatusInternalServerError
+		}
+		return
+	}
+	userKey, _ := RequestUser(req)
+	for i := range dst {
+		shapeItem(&dst[i], userKey)
 	}
+}
 
-	// Return status. WriteHeader() must be called before call to Write
-	if r == 0 {
-		rw.WriteHeader(http.StatusOK)
-	} else {
-		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+// Radius of nearby searches in kilometers
+const (
+	DefaultNearRadiusKm = 5
+	MaxNearRadiusKm     = 500
+)
+
+// Items read from each geohash cell of a nearby search. Large cells hold too many items to load them all.
+const MaxNearCandidatesPerCell = 300
+
+// GET ./items?near=25.0478,121.5318&radius=5
+// Search items within the radius in kilometers around a location. Nearest items come first.
+// Each item has its distance in kilometers. Parameters limit and fields work as usual but cursor doesn't.
+func searchNearItem(rw http.ResponseWriter, req *http.Request) {
+	// Appengine
+	var c Context = newContext(req)
+	c.Debugf("searchNearItem()")
+
+	// Location and radius
+	q := req.URL.Query()
+	var latitude, longitude float64
+	var radius float64 = DefaultNearRadiusKm
+	var e *ApiError
+	var err1, err2 error
+	var near []string = strings.Split(q.Get("near"), ",")
+	if len(near) == 2 {
+		latitude, err1 = strconv.ParseFloat(strings.TrimSpace(near[0]), 64)
+		longitude, err2 = strconv.ParseFloat(strings.TrimSpace(near[1]), 64)
+	}
+	if len(near) != 2 || err1 != nil || err2 != nil || latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		e = NewApiError(ErrCodeInvalidQuery, "Invalid location").WithField("near", "Location should be latitude,longitude")
+	}
+	if v := q.Get("radius"); v != "" {
+		var err error
+		if radius, err = strconv.ParseFloat(v, 64); err != nil || radius <= 0 || radius > MaxNearRadiusKm {
+			if e == nil {
+				e = NewApiError(ErrCodeInvalidQuery, "Invalid radius")
+			}
+			e.WithField("radius", fmt.Sprintf("Radius should be greater than 0 and at most %d kilometers", MaxNearRadiusKm))
+		}
+	}
+	// Geohash cells can't cover large circles near the poles. Don't scan all items instead.
+	if e == nil && geohashCover(latitude, longitude, radius) == nil {
+		e = NewFieldError(ErrCodeInvalidQuery, "radius", "Radius is too large around the location. Search a smaller one.")
+	}
+	if e != nil {
+		c.Warningf("Invalid nearby search %s", req.URL.RawQuery)
+		writeError(rw, http.StatusBadRequest, e)
 		return
 	}
 
-	// Return body
-	encoder := json.NewEncoder(rw)
-	if err = encoder.Encode(dst); err != nil {
-		log.Println(err, "in encoding result", dst)
-	} else {
-		log.Printf("SearchItem() returns %d items\n", len(dst))
+	listItemsBy(rw, req, c, ItemQuery{}, func(c Context, f ItemQuery) ([]Item, string, error) {
+		return queryNearItems(c, latitude, longitude, radius, f)
+	})
+}
+
+// Get items within the radius around a location sorted by distance.
+// Search the geohash cells covering the circle and then drop the items outside it.
+func queryNearItems(c Context, latitude float64, longitude float64, radius float64, f ItemQuery) ([]Item, string, error) {
+	if f.Cursor != "" {
+		return nil, "", ErrInvalidCursor
+	}
+
+	// Items in the cells
+	var candidates []Item
+	var prefixes []string = geohashCover(latitude, longitude, radius)
+	if prefixes == nil {
+		return nil, "", fmt.Errorf("Radius %f km around %f,%f is too large for geohash cells", radius, latitude, longitude)
+	}
+	for _, p := range prefixes {
+		v, _, err := store.Items().Query(c, ItemQuery{Filters: []ItemFilter{
+			{"Geohash", ">=", p},
+			{"Geohash", "<", p + "~"},
+		}, Limit: MaxNearCandidatesPerCell})
+		if err != nil {
+			return nil, "", err
+		}
+		if len(v) == MaxNearCandidatesPerCell {
+			c.Warningf("Geohash cell %s has more than %d items. Some of them are left out.", p, MaxNearCandidatesPerCell)
+		}
+		candidates = append(candidates, v...)
+	}
+
+	// Items in the circle, nearest first
+	var dst []Item
+	for _, v := range candidates {
+		d := distanceKm(latitude, longitude, v.Latitude, v.Longitude)
+		if d <= radius {
+			v.Distance = &d
+			dst = append(dst, v)
+		}
 	}
+	sort.Slice(dst, func(i, j int) bool {
+		if *dst[i].Distance != *dst[j].Distance {
+			return *dst[i].Distance < *dst[j].Distance
+		}
+		return dst[i].Id < dst[j].Id
+	})
+	if f.Limit > 0 && len(dst) > f.Limit {
+		dst = dst[:f.Limit]
+	}
+	return dst, "", nil
+}
+
+// URL of the next page. It's the request URL with the new cursor.
+func nextPageUrl(req *http.Request, cursor string) string {
+	q := req.URL.Query()
+	q.Set("cursor", cursor)
+	u := url.URL{Path: req.URL.Path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// Parse the limit parameter of a list
+func parsePageLimit(q url.Values, defaultLimit int, maxLimit int) (int, *ApiError) {
+	var v string = q.Get("limit")
+	if v == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return 0, NewFieldError(ErrCodeInvalidQuery, "limit", fmt.Sprintf("Limit should be 1~%d", maxLimit))
+	}
+	return limit, nil
+}
+
+// JSON property names of items
+func itemJsonFields() []string {
+	var names []string
+	t := reflect.TypeOf(Item{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Check selected fields are item JSON properties
+func checkItemFields(fields []string) (e *ApiError) {
+	var valid map[string]bool = make(map[string]bool)
+	for _, v := range itemJsonFields() {
+		valid[v] = true
+	}
+	for _, v := range fields {
+		if !valid[v] {
+			if e == nil {
+				e = NewApiError(ErrCodeInvalidQuery, "Unknown fields. Valid: "+strings.Join(itemJsonFields(), ","))
+			}
+			e.WithField("fields", "Unknown field "+v)
+		}
+	}
+	return
 }
 
-func updateItem(rw http.ResponseWriter, req *http.Request) {
+// Keep only the selected JSON properties of items
+func selectItemFields(c Context, items []Item, fields []string) []map[string]json.RawMessage {
+	var dst []map[string]json.RawMessage = make([]map[string]json.RawMessage, 0, len(items))
+	for i := range items {
+		var all map[string]json.RawMessage
+		b, err := json.Marshal(&items[i])
+		if err == nil {
+			err = json.Unmarshal(b, &all)
+		}
+		if err != nil {
+			c.Errorf("%s in selecting fields of item %s", err, items[i].Id)
+			continue
+		}
+		var selected map[string]json.RawMessage = make(map[string]json.RawMessage, len(fields))
+		for _, v := range fields {
+			if x, ok := all[v]; ok {
+				selected[v] = x
+			}
+		}
+		dst = append(dst, selected)
+	}
+	return dst
+}
+
+// PUT ./items/xxx, xxx: Item key
+// Return 412 Precondition Failed if If-Match doesn't have the ETag of the current version
+func updateItem(rw http.ResponseWriter, req *http.Request, params Params) {
 	// To access datastore and to log
-	c := appengine.NewContext(req)
+	c := newContext(req)
 	c.Debugf("UpdateItem()")
 	// Result
 	r := http.StatusOK
+	// Error detail
+	var e *ApiError
 	// Item
 	var src Item
+	// Item key
+	var keyString string = params.Get("id")
 
 	// Set response
 	defer func() {
@@ -420,89 +700,62 @@ func updateItem(rw http.ResponseWriter, req *http.Request) {
 		if r == http.StatusOK {
 			rw.WriteHeader(http.StatusOK)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
-	// Get key from URL
-	tokens := strings.Split(req.URL.Path, "/")
-	var keyIndexInTokens int = 0
-	for i, v := range tokens {
-		if v == "items" {
-			keyIndexInTokens = i + 1
-		}
-	}
-	if keyIndexInTokens >= len(tokens) {
-		c.Debugf("Key is not given")
-		r = http.StatusBadRequest
-		return
-	}
-	keyString := tokens[keyIndexInTokens]
-	if keyString == "" {
-		c.Debugf("Key is empty")
-		r = http.StatusBadRequest
-		return
-	}
-
-	// Decode key from string
-	key, err := datastore.DecodeKey(keyString)
-	if err != nil {
-		c.Errorf("%s in decoding key string", err)
-		r = http.StatusBadRequest
-		return
-	}
-
 	// Get data from body
 	b, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		c.Errorf("%s in reading body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
 		return
 	}
 	if err = json.Unmarshal(b, &src); err != nil {
 		c.Errorf("%s in decoding body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be an item in JSON")
 		return
 	}
 
 	// Organize data
-	var pUser    *User
-	var pKeyUser *datastore.Key
-	var instanceId string = req.Header.Get(HttpHeaderInstanceId)
-	if pKeyUser, pUser, err = searchUser(instanceId, c); err != nil {
-		c.Errorf("%s in searching user instance ID %s", err, instanceId)
-		r = http.StatusInternalServerError
-		return
-	}
-	if pKeyUser == nil {
-		c.Errorf("User instance ID %s is not found", instanceId)
-		r = http.StatusInternalServerError
-		return
-	}
+	userKey, pUser := RequestUser(req)
 	if src.Members == nil || len(src.Members) == 0 {
 		src.Members = make([]ItemMember, 1)
 	}
-	src.Members[0].UserKey = pKeyUser.Encode()
+	src.Members[0].UserKey = userKey
 	src.Attendant = src.Members[0].Attendant
 
 	// Existing item got from datastore
 	var dst Item
 	var state UpdateItemState = stateLast
 	var notification ItemUpdateNotification
+	// Waitlisted users who become members
+	var promoted []ItemMember
 	// Update datastore in a transaction
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+	err = store.RunInTransaction(c, func(tc Context) error {
 		var err1 error
-		r, state, err1 = updateOneItemInDatastore(c, key, src, &dst, pUser, pKeyUser, &notification)
+		r, state, err1 = updateOneItemInDatastore(tc, keyString, req.Header.Get("If-Match"), src, &dst, pUser, userKey, &notification, &promoted)
 		return err1
-	}, nil)
+	})
 	if r != http.StatusOK || err != nil {
 		c.Errorf("%s in updating item in datastore", err)
+		if r == http.StatusOK {
+			// The transaction failed to commit
+			r, e = itemError(err)
+		} else {
+			e, _ = err.(*ApiError)
+		}
 		return
 	}
 
 	// Indicate that the item is deleted
 	if state == stateDeleteItem {
 		r = http.StatusNotFound
+		e = NewApiError(ErrCodeItemNotFound, "Item is deleted because its last member left")
+	} else {
+		rw.Header().Set("ETag", itemETag(&dst))
 	}
 
 	// Response code received from GCM server
@@ -510,12 +763,15 @@ func updateItem(rw http.ResponseWriter, req *http.Request) {
 
 	// Notify members through Google Cloud Messaging
 	notification.ItemId = keyString
-	notification.RequestUserId = pKeyUser.Encode()
+	notification.RequestUserId = userKey
 	if gcmResponseCode = sendItemGcmMessage(c, &dst, &notification); gcmResponseCode != http.StatusOK {
 		c.Warningf("Send notification to all members failed")
 		// Keep going even in failure because datastore has updated
 	}
 
+	// Add promoted members before removing the leaving one so that the group never becomes empty
+	notifyPromotedMembers(c, &dst, promoted)
+
 	// Update Google Cloud Messaging group
 	if gcmResponseCode = updateItemGcmGroup(c, state, &dst, pUser); gcmResponseCode != http.StatusOK {
 		c.Warningf("Update GCM group failed")
@@ -526,40 +782,72 @@ func updateItem(rw http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func updateOneItemInDatastore(c                appengine.Context,
-                              key             *datastore.Key,
+func updateOneItemInDatastore(c                Context,
+                              key              string,
+                              ifMatch          string,
                               src              Item,
                               dst             *Item,
                               pRequestUser    *User,
-                              pRequestUserKey *datastore.Key,
-                              pNotification   *ItemUpdateNotification) (r int, state UpdateItemState, err error) {
+                              requestUserKey   string,
+                              pNotification   *ItemUpdateNotification,
+                              pPromoted       *[]ItemMember) (r int, state UpdateItemState, err error) {
 	// Update state
 	state = stateLast
+	*pPromoted = nil
 
 	// Initial variables
 	r = http.StatusOK
 	err = nil
+	// History of this update
+	var events []ItemEvent
+	var now time.Time = time.Unix(time.Now().Unix(), 0)
 
 	// Get the entity
-	if err = datastore.Get(c, key, dst); err != nil {
-		c.Errorf("%s in getting entity from datastore by key %s", err, key.Encode())
-		r = http.StatusNotFound
+	var pItem *Item
+	if pItem, err = store.Items().Get(c, key); err != nil {
+		c.Errorf("%s in getting entity from datastore by key %s", err, key)
+		var e *ApiError
+		if r, e = itemError(err); e != nil {
+			err = e
+		}
 		return
 	}
+	*dst = *pItem
+	// The item to keep if it's deleted. Members are modified in place below.
+	var original Item = *pItem
+	original.Members = append([]ItemMember(nil), pItem.Members...)
 
 	// Vernon debug
 	c.Debugf("Got from user %+v", src)
 	c.Debugf("Got from server %+v", dst)
 
+	// The client changes the version it has
+	if e := checkItemIfMatch(ifMatch, dst); e != nil {
+		c.Warningf("Item %s is version %d but If-Match is %s", key, dst.Version, ifMatch)
+		r = http.StatusPreconditionFailed
+		err = e
+		return
+	}
+
+	// Closed and cancelled items can't be changed
+	if !isItemActive(dst) {
+		c.Warningf("Item %s is %s. Ignore.", key, dst.Status)
+		r = http.StatusConflict
+		err = NewApiError(ErrCodeItemNotActive, fmt.Sprintf("Item is %s", dst.Status))
+		return
+	}
+
 	// Modify attendant
 	switch {
 	case dst.Attendant + src.Attendant > dst.People:
 		c.Warningf("Too many attendants. %d + %d > %d", dst.Attendant, src.Attendant, dst.People)
 		r = http.StatusBadRequest
+		err = NewFieldError(ErrCodeItemFull, "attendant", fmt.Sprintf("Only %d more people can attend", dst.People - dst.Attendant))
 		return
 	case dst.Attendant + src.Attendant < 0:
 		c.Warningf("Too few attendants. %d%d < 0", dst.Attendant, src.Attendant)
 		r = http.StatusBadRequest
+		err = NewFieldError(ErrCodeTooFewAttendants, "attendant", fmt.Sprintf("At most %d attendants can leave", dst.Attendant))
 		return
 	default:
 		dst.Attendant += src.Attendant
@@ -580,13 +868,27 @@ func updateOneItemInDatastore(c                appengine.Context,
 		// Non-existing has no attendant to decrease
 		c.Warningf("Duplicate leave. Ignore.")
 		r = http.StatusBadRequest
+		err = NewApiError(ErrCodeDuplicateLeave, "User is not a member of the item")
 		return
 	}
 	
+	if i == len(a) && containsString(dst.Banned, m.UserKey) {
+		c.Warningf("User %s is banned from item %s", m.UserKey, key)
+		r = http.StatusForbidden
+		err = NewApiError(ErrCodeBannedFromItem, "Owner banned the user from the item")
+		return
+	}
+
 	if i == len(a) {
 		// Append the new member
 		state = stateAppendMember
+		m.JoinTime = now
 		a = append(a, m)
+		event := newItemEvent(ItemEventJoined, m.UserKey, now)
+		event.Attendant = m.Attendant
+		events = append(events, event)
+		// The user no longer waits
+		dst.Waitlist = removeWaitlisted(dst.Waitlist, m.UserKey)
 		pNotification.Message += fmt.Sprintf("A new user attended and now item reaches %d/%d. ",
 		                                    dst.Attendant,
 		                                    dst.People)
@@ -603,20 +905,35 @@ func updateOneItemInDatastore(c                appengine.Context,
 		// Vernon debug
 		c.Infof("Existing member %s attends %d more in item %s and reaches %d/%d", pRequestUser.InstanceId, m.Attendant, dst.GcmGroupName, dst.Attendant, dst.People)
 	}
+	if state == stateAddAttendant && a[i].Attendant != 0 && m.Attendant != 0 {
+		event := newItemEvent(ItemEventAttendantChanged, m.UserKey, now)
+		event.Attendant = m.Attendant
+		events = append(events, event)
+	}
 	if a[i].Attendant == 0 {
 		// The member leaves
-		if i == 0 {
-			// Delete item because its owner leaves
+		event := newItemEvent(ItemEventLeft, m.UserKey, now)
+		event.Attendant = m.Attendant
+		events = append(events, event)
+		if len(a) == 1 && !waitlistFits(dst) {
+			// Delete item because its last member leaves
 			state = stateDeleteItem
-			pNotification.Message += "Item is closed because its owner left. "
+			pNotification.Message += "Item is closed because its last member left. "
 			// Vernon debug
-			c.Infof("Item %s is closed because its owner %s leaves", dst.GcmGroupName, pRequestUser.InstanceId)
+			c.Infof("Item %s is closed because its last member %s leaves", dst.GcmGroupName, pRequestUser.InstanceId)
 		} else {
-			// Delete the member from the item
+			if i == 0 && len(a) > 1 {
+				// Hand the item over to the longest-standing member. The leaving owner becomes the second.
+				dst.Members = a
+				handOverItem(dst, longestStandingMember(a), requestUserKey, ItemOwnerChangeLeft, now, pNotification)
+				events = append(events, ownerChangedEvent(dst))
+				a = dst.Members
+				i = 1
+				c.Infof("Owner %s leaves. Item %s is handed over to %s", requestUserKey, dst.GcmGroupName, a[0].UserKey)
+			}
+			// Delete the member from the item. Keep the joining order.
 			state = stateDeleteMember
-			a[i] = a[len(a)-1]
-			a[len(a)-1] = ItemMember{UserKey:"", Attendant:0}
-			a = a[:len(a)-1]
+			a = append(a[:i], a[i+1:]...)
 			pNotification.Message += fmt.Sprintf("A member left and item is now %d/%d. ",
 		                                        dst.Attendant,
 		                                        dst.People)
@@ -627,17 +944,40 @@ func updateOneItemInDatastore(c                appengine.Context,
 		// Only the owner can update other properties
 		// Flag indicates whether item properties are modified
 		var flagModified bool = false
+		// Modified properties
+		var modified []string
 		if (src.Image != "") {
 			dst.Image = src.Image
 			flagModified = true
+			modified = append(modified, "image")
 		}
 		if (src.Thumbnail != "") {
 			dst.Thumbnail = src.Thumbnail
 			flagModified = true
+			modified = append(modified, "thumbnail")
 		}
 		if (src.People != 0) {
+			// Members who have joined keep their slots
+			if src.People < 0 || src.People < dst.Attendant {
+				c.Warningf("Item people %d can't be less than attendant %d", src.People, dst.Attendant)
+				r = http.StatusBadRequest
+				err = NewFieldError(ErrCodeInvalidPeople, "people", "People should be at least attendant")
+				return
+			}
 			dst.People = src.People
 			flagModified = true
+			modified = append(modified, fmt.Sprintf("people=%d", dst.People))
+		}
+		if src.Description != "" && src.Description != dst.Description {
+			if e := checkDescription(src.Description); e != nil {
+				c.Warningf("Description is %d characters long", utf8.RuneCountInString(src.Description))
+				r = http.StatusBadRequest
+				err = e
+				return
+			}
+			dst.Description = src.Description
+			flagModified = true
+			modified = append(modified, "description")
 		}
 		if flagModified == true {
 			// Set now as the creation time. Precision to a second.
@@ -647,36 +987,88 @@ func updateOneItemInDatastore(c                appengine.Context,
 			// Vernon debug
 			c.Infof("Item %s information updated. ", dst.GcmGroupName)
 		}
+		if !src.Deadline.IsZero() && !src.Deadline.Equal(dst.Deadline) {
+			if e := checkDeadline(src.Deadline, time.Now()); e != nil {
+				c.Warningf("Invalid deadline %s", src.Deadline)
+				r = http.StatusBadRequest
+				err = e
+				return
+			}
+			dst.Deadline = src.Deadline
+			modified = append(modified, "deadline="+dst.Deadline.Format(time.RFC3339))
+			pNotification.Message += fmt.Sprintf("Item deadline is changed to %s. ", dst.Deadline.Format(time.RFC3339))
+			c.Infof("Item %s deadline is changed to %s", dst.GcmGroupName, dst.Deadline)
+		}
+		if len(modified) > 0 {
+			event := newItemEvent(ItemEventUpdated, requestUserKey, now)
+			event.Detail = strings.Join(modified, ", ")
+			events = append(events, event)
+		}
 	}
 	// Appending and removing a member will make a point to another memory. So assign back.
 	dst.Members = a
 
-	// Check whether item is finished
-	if dst.Attendant == dst.People {
-		pNotification.Message += "Item is finished. Please get together! "
-		c.Infof("Item %s is finished. ", dst.GcmGroupName)
+	// Fill the open slots with waitlisted users
+	if state != stateDeleteItem {
+		*pPromoted = promoteWaitlist(dst, now)
+		for _, v := range *pPromoted {
+			event := newItemEvent(ItemEventPromoted, v.UserKey, now)
+			event.Attendant = v.Attendant
+			events = append(events, event)
+			pNotification.Message += fmt.Sprintf("A waitlisted user attended %d and now item reaches %d/%d. ",
+			                                    v.Attendant,
+			                                    dst.Attendant,
+			                                    dst.People)
+			c.Infof("Waitlisted user %s is promoted in item %s", v.UserKey, dst.GcmGroupName)
+		}
+		if len(*pPromoted) > 0 && len(a) == 0 {
+			// The owner left alone. The first promoted user becomes the owner.
+			handOverItem(dst, 0, requestUserKey, ItemOwnerChangeLeft, now, pNotification)
+			events = append(events, ownerChangedEvent(dst))
+		}
+	}
+	// Index the location and free slots. Items created before the indexes existed get them here.
+	dst.Geohash = encodeGeohash(dst.Latitude, dst.Longitude, GeohashPrecision)
+	dst.OpenSlots = dst.People - dst.Attendant
+
+	// Follow the attendants between open and full
+	if status := attendantItemStatus(dst); state != stateDeleteItem && status != itemStatus(dst) {
+		if e := transitItem(dst, status, pNotification); e != nil {
+			r = http.StatusConflict
+			err = e
+			return
+		}
+		events = append(events, statusChangedEvent(requestUserKey, dst.Status, now))
+		c.Infof("Item %s is %s. ", dst.GcmGroupName, dst.Status)
+	}
+	dst.Status = itemStatus(dst)
+
+	// Record the history along with the change
+	if err = saveItemEvents(c, key, events); err != nil {
+		r = http.StatusInternalServerError
+		return
 	}
 
 	// Modify item in datastore
 	if state == stateDeleteItem {
 		// Vernon debug
-		c.Debugf("Item %s is going to be deleted from datastore", key.Encode())
+		c.Debugf("Item %s is going to be deleted from datastore", key)
 
-		// Delete item from datastore
-		if err = datastore.Delete(c, key); err != nil {
+		// Delete item from datastore. It can be restored for a while.
+		if err = softDeleteItem(c, key, &original, requestUserKey, now); err != nil {
 			c.Errorf("%s, in deleting entity by key", err)
 			r = http.StatusInternalServerError
 			return
 		}
-		c.Infof("Item %s is deleted from datastore", key.Encode())
+		c.Infof("Item %s is deleted from datastore", key)
 	} else {
 		// Vernon debug
-		c.Debugf("Item %s is going to be modified in datastore", key.Encode())
+		c.Debugf("Item %s is going to be modified in datastore", key)
 
 		// Update item in datastore
-		_, err = datastore.Put(c, key, dst)
+		err = store.Items().Update(c, key, dst)
 		if err != nil {
-			c.Errorf("%s in storing in datastore with key %s", err, key.Encode())
+			c.Errorf("%s in storing in datastore with key %s", err, key)
 			r = http.StatusInternalServerError
 			return
 		}
@@ -688,63 +1080,35 @@ func updateOneItemInDatastore(c                appengine.Context,
 
 // Send a Google Cloud Messaging message to all the members in the item
 // Success: return 200 OK
-// Failure: return 500 Internal Server Error
-func sendItemGcmMessage(c appengine.Context, pItem *Item, pNotification *ItemUpdateNotification) (r int) {
+// Failure: return 400 Bad Request, 500 Internal Server Error
+func sendItemGcmMessage(c Context, pItem *Item, pNotification *ItemUpdateNotification) (r int) {
 	// Initial variables
 	r = http.StatusOK
 
-	// Make GCM message body
-	var bodyString string = fmt.Sprintf(`
-		{
-			"to":"%s",
-			"data": {
-				"message":"%s",
-				"itemid":"%s",
-				"requestuserid":"%s"
-			}
-		}`, pItem.GcmGroupKey, pNotification.Message, pNotification.ItemId, pNotification.RequestUserId)
-
-	// Make a POST request for GCM
-	pReq, err := http.NewRequest("POST", GcmURL, strings.NewReader(bodyString))
-	if err != nil {
-		c.Errorf("%s in makeing a HTTP request", err)
-		r = http.StatusInternalServerError
-		return
+	// Make message data
+	var data map[string]string = map[string]string{
+		"message":       pNotification.Message,
+		"itemid":        pNotification.ItemId,
+		"requestuserid": pNotification.RequestUserId,
+		"status":        itemStatus(pItem),
 	}
-	defer pReq.Body.Close()
-	pReq.Header.Add("Content-Type", "application/json")
-	pReq.Header.Add("Authorization", "key="+GcmApiKey)
-	// Debug
-	c.Infof("Send request to GCM server %s", *pReq)
-
-	// Send request
-	var client = urlfetch.Client(c)
-	resp, err := client.Do(pReq)
-	if err != nil {
-		c.Errorf("%s in sending request", err)
-		r = http.StatusInternalServerError
-		return
+	if len(pItem.Members) > 0 {
+		data["owneruserid"] = pItem.Members[0].UserKey
 	}
-	defer resp.Body.Close()
 
-	// Check response
-	c.Infof("%d %s", resp.StatusCode, resp.Status)
-
-	// Get response body
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		c.Errorf("%s in reading response body", err)
-		r = http.StatusInternalServerError
+	// Send to the item group
+	if err := notifier.SendToGroup(c, pItem.GcmGroupKey, data); err != nil {
+		c.Errorf("%s in sending message to group %s", err, pItem.GcmGroupName)
+		r = notificationErrorCode(err)
 		return
 	}
-	c.Infof("Body: %s", respBody)
 	return
 }
 
 // Modify the item's Google Cloud Messaging group
 // Success: 200 OK
 // Failure: 400 Bad Request, 403 Forbidden, 500 Internal Server Error
-func updateItemGcmGroup(c appengine.Context, state UpdateItemState, pItem *Item, pUser *User) (r int) {
+func updateItemGcmGroup(c Context, state UpdateItemState, pItem *Item, pUser *User) (r int) {
 	// The operation structure which will be sent to GCM server
 	var operation GroupOperation
 	// The response code received from GCM server
@@ -786,27 +1150,21 @@ func updateItemGcmGroup(c appengine.Context, state UpdateItemState, pItem *Item,
 
 		// Set all members' registration token
 		for _, v := range pItem.Members {
-			var user User
-			var pUserKey *datastore.Key
+			var pMember *User
 
 			// Search user registration token
-			if pUserKey, err = datastore.DecodeKey(v.UserKey); err != nil {
-				// This should never happen
-				c.Errorf("%s in decodeing user key %s of existing member in group %s. This should never happen.", err, v.UserKey, pItem.GcmGroupName)
-				continue
-			}
-			if err = datastore.Get(c, pUserKey, &user); err != nil {
+			if pMember, err = store.Users().Get(c, v.UserKey); err != nil {
 				// This should never happen
 				c.Errorf("%s in getting user from datastore with key %s. This should never happen.", err, v.UserKey)
 				continue
 			}
 
-			operation.Registration_ids = append(operation.Registration_ids, user.RegistrationToken)
+			operation.Registration_ids = append(operation.Registration_ids, pMember.RegistrationToken)
 		}
 	}
 
 	// Send the operation to GCM server
-	if gcmResponseCode = sendGroupOperationToGcm(&operation, c); gcmResponseCode != http.StatusOK {
+	if gcmResponseCode = sendGroupOperation(c, &operation); gcmResponseCode != http.StatusOK {
 		c.Errorf("Send group operation %+v to GCM faied", operation)
 		r = gcmResponseCode
 		return
@@ -816,87 +1174,96 @@ func updateItemGcmGroup(c appengine.Context, state UpdateItemState, pItem *Item,
 	return
 }
 
-func deleteItem(rw http.ResponseWriter, req *http.Request) {
-	// To log
-	c := appengine.NewContext(req)
-	// Get key from URL
-	tokens := strings.Split(req.URL.Path, "/")
-	var keyIndexInTokens int = 0
-	for i, v := range tokens {
-		if v == "items" {
-			keyIndexInTokens = i + 1
-		}
-	}
-	if keyIndexInTokens >= len(tokens) {
-		c.Infof("Key is not given so that delete all items")
-		deleteAllItem(rw, req)
-		return
-	}
-	keyString := tokens[keyIndexInTokens]
-	if keyString == "" {
-		c.Infof("Key is empty so that delete all items")
-		deleteAllItem(rw, req)
-	} else {
-		deleteOneItem(rw, req, keyString)
-	}
-}
-
-func deleteAllItem(rw http.ResponseWriter, req *http.Request) {
+// DELETE ./items/xxx, xxx: Item key
+// Only the owner or an administrator can delete an item. Members are notified and the GCM group is removed.
+// The item can be restored within the restore window.
+// Success: 204 No Content
+// Failure: 400 Bad Request, 403 Forbidden, 404 Not Found, 412 Precondition Failed
+func deleteOneItem(rw http.ResponseWriter, req *http.Request, params Params) {
 	// To access datastore and to log
-	c := appengine.NewContext(req)
-	c.Infof("deleteAll()")
-
-	// Delete root entity after other entities
-	r := 0
-	pKey := datastore.NewKey(c, ItemKind, ItemRoot, 0, nil)
-	if keys, err := datastore.NewQuery(ItemKind).KeysOnly().GetAll(c, nil); err != nil {
-		c.Errorf("%s", err)
-		r = 1
-	} else if err := datastore.DeleteMulti(c, keys); err != nil {
-		c.Errorf("%s", err)
-		r = 1
-	} else if err := datastore.Delete(c, pKey); err != nil {
-		c.Errorf("%s", err)
-		r = 1
-	}
-
-	// Return status. WriteHeader() must be called before call to Write
-	if r == 0 {
-		rw.WriteHeader(http.StatusOK)
-	} else {
-		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-	}
-}
-
-func deleteOneItem(rw http.ResponseWriter, req *http.Request, keyString string) {
-	// To access datastore and to log
-	c := appengine.NewContext(req)
+	c := newContext(req)
 	c.Infof("deleteOneItem()")
+	// Item key
+	var keyString string = params.Get("id")
 
 	// Result
 	r := http.StatusNoContent
+	// Error detail
+	var e *ApiError
 	defer func() {
 		// Return status. WriteHeader() must be called before call to Write
 		if r == http.StatusNoContent {
 			rw.WriteHeader(http.StatusNoContent)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
-	key, err := datastore.DecodeKey(keyString)
+	// Delete the entity
+	userKey, _ := RequestUser(req)
+	var dst Item
+	err := store.RunInTransaction(c, func(tc Context) error {
+		pItem, err1 := store.Items().Get(tc, keyString)
+		if err1 != nil {
+			return err1
+		}
+		dst = *pItem
+		if e1 := checkItemIfMatch(req.Header.Get("If-Match"), &dst); e1 != nil {
+			return e1
+		}
+		if !isItemOwner(&dst, userKey) && !isAdmin(req) {
+			return NewApiError(ErrCodeNotItemOwner, "Only the item owner can delete the item")
+		}
+		return softDeleteItem(tc, keyString, &dst, userKey, time.Unix(time.Now().Unix(), 0))
+	})
 	if err != nil {
-		c.Errorf("%s in decoding key string", err)
-		r = http.StatusBadRequest
+		c.Errorf("%s, in deleting entity by key", err)
+		if e1, ok := err.(*ApiError); ok {
+			e = e1
+			if e.Code == ErrCodeNotItemOwner {
+				r = http.StatusForbidden
+			} else {
+				r = http.StatusPreconditionFailed
+			}
+		} else {
+			r, e = itemError(err)
+		}
 		return
 	}
+	c.Infof("Key %s is deleted by %s", keyString, userKey)
 
-	// Delete the entity
-	if err := datastore.Delete(c, key); err != nil {
-		c.Errorf("%s, in deleting entity by key", err)
-		r = http.StatusNotFound
-		return
+	var message string = "Owner deleted the item. "
+	if !isItemOwner(&dst, userKey) {
+		message = "Administrator deleted the item. "
 	}
-	c.Infof("Key %s is deleted", keyString)
+	notifyItemDeleted(c, &dst, message, userKey)
 }
 
+// Tell the members that the item is deleted and remove its GCM group.
+// Keep going in failure because datastore has updated.
+func notifyItemDeleted(c Context, pItem *Item, message string, requestUserKey string) {
+	var notification ItemUpdateNotification = ItemUpdateNotification{
+		Message:       message,
+		ItemId:        pItem.Id,
+		RequestUserId: requestUserKey,
+	}
+	if gcmResponseCode := sendItemGcmMessage(c, pItem, &notification); gcmResponseCode != http.StatusOK {
+		c.Warningf("Send notification to all members failed")
+	}
+	if gcmResponseCode := updateItemGcmGroup(c, stateDeleteItem, pItem, nil); gcmResponseCode != http.StatusOK {
+		c.Warningf("Remove GCM group of item %s failed", pItem.Id)
+	}
+}
+
+// Map a store error about an item to the response status and error
+func itemError(err error) (int, *ApiError) {
+	switch err {
+	case ErrInvalidId:
+		return http.StatusBadRequest, NewApiError(ErrCodeInvalidId, "Invalid item ID")
+	case ErrNotFound:
+		return http.StatusNotFound, NewApiError(ErrCodeItemNotFound, "Item is not found")
+	case ErrConcurrentTransaction:
+		return http.StatusConflict, NewApiError(ErrCodeConflict, "Item is being modified by others. Please retry.")
+	}
+	return http.StatusInternalServerError, nil
+}
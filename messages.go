@@ -1,20 +1,14 @@
 package aliza
 
 import (
-	"appengine"
-	"appengine/datastore"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strings"
-	"fmt"
-	"appengine/urlfetch"
 )
 
 // HTTP body of sending a message to a user
 type UserMessage struct {
-	// To authentication
-	InstanceId           string    `json:"instanceid"`
 	// To the target user
 	UserId               string    `json:"userid"`      // Datastore user kind key string
 	Message              string    `json:"message"`
@@ -22,8 +16,6 @@ type UserMessage struct {
 
 // HTTP body of sending a message to a topic
 type TopicMessage struct {
-	// To authentication
-	InstanceId           string    `json:"instanceid"`
 	// To the target user
 	Topic                string    `json:"topic"`
 	Message              string    `json:"message"`
@@ -31,27 +23,24 @@ type TopicMessage struct {
 
 // HTTP body of sending a message to a group
 type GroupMessage struct {
-	// To authentication
-	InstanceId           string    `json:"instanceid"`
 	// To the target user
 	GroupName            string    `json:"groupname"`
 	Message              string    `json:"message"`
 }
 
-// GCM server
-const GcmURL = "https://gcm-http.googleapis.com/gcm/send"
-
 // Receive a message from an APP instance.
-// Check it's instancd ID.
 // Send the message back.
 // POST ./user-messages"
+// Header {"Instance-Id":"..."}
 // Success: 204 No Content
 // Failure: 400 Bad Request, 403 Forbidden
 func SendUserMessage(rw http.ResponseWriter, req *http.Request) {
 	// Appengine
-	var c appengine.Context = appengine.NewContext(req)
+	var c Context = newContext(req)
 	// Result, 0: success, 1: failed
 	var r int = http.StatusNoContent
+	// Error detail
+	var e *ApiError
 
 	// Return code
 	defer func() {
@@ -59,16 +48,8 @@ func SendUserMessage(rw http.ResponseWriter, req *http.Request) {
 		if r == http.StatusNoContent {
 			// Changing the header after a call to WriteHeader (or Write) has no effect.
 			rw.WriteHeader(http.StatusNoContent)
-		} else if r == http.StatusBadRequest {
-			//			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			http.Error(rw, `Please follow https://aaa.appspot.com/api/0.1/user-messages
-			                {
-			                    "instanceid":""
-			                    "userid":""
-			                    "message":""
-			                }`, http.StatusBadRequest)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
@@ -77,102 +58,60 @@ func SendUserMessage(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		c.Errorf("%s in reading body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
 		return
 	}
 	var message UserMessage
 	if err = json.Unmarshal(b, &message); err != nil {
 		c.Errorf("%s in decoding body %s", err, b)
 		r = http.StatusBadRequest
+		e = messageBodyError("userid", "message")
 		return
 	}
-
-	// Authenticate sender
-	var isValid bool = false
-	isValid, err = verifyRequest(message.InstanceId, c)
-	if err != nil {
-		c.Errorf("%s in authenticating request", err)
-		r = http.StatusBadRequest
-		return
-	}
-	if isValid == false {
-		c.Warningf("Invalid request, ignore")
-		r = http.StatusForbidden
-		return
-	}
-
-	// Decode datastore key from string
-	key, err := datastore.DecodeKey(message.UserId)
-	if err != nil {
-		c.Errorf("%s in decoding key string", err)
+	if message.UserId == "" {
+		c.Warningf("Missing userid. Ignore the request.")
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeFieldRequired, "userid", "Userid is required")
 		return
 	}
 
 	// Get target user from datastore
-	var dst User
-	if err := datastore.Get(c, key, &dst); err != nil {
+	var dst *User
+	if dst, err = store.Users().Get(c, message.UserId); err != nil {
 		c.Errorf("%s in getting entity from datastore by key %s", err, message.UserId)
-		r = http.StatusNotFound
-		return
-	}
-
-	// Make GCM message body
-	var bodyString string = fmt.Sprintf(`
-		{
-			"to":"%s",
-			"data": {
-				"message":"%s"
-			}
-		}`, dst.RegistrationToken, message.Message)
-
-
-	// Make a POST request for GCM
-	pReq, err := http.NewRequest("POST", GcmURL, strings.NewReader(bodyString))
-	if err != nil {
-		c.Errorf("%s in makeing a HTTP request", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	defer pReq.Body.Close()
-	pReq.Header.Add("Content-Type", "application/json")
-	pReq.Header.Add("Authorization", "key="+GcmApiKey)
-	// Debug
-	c.Infof("%s", *pReq)
-
-	// Send request
-	var client = urlfetch.Client(c)
-	resp, err := client.Do(pReq)
-	if err != nil {
-		c.Errorf("%s in sending request", err)
-		r = http.StatusInternalServerError
+		if err == ErrInvalidId {
+			r = http.StatusBadRequest
+			e = NewFieldError(ErrCodeInvalidId, "userid", "Invalid user ID")
+		} else {
+			r = http.StatusNotFound
+			e = NewApiError(ErrCodeUserNotFound, "Target user is not found")
+		}
 		return
 	}
-	defer resp.Body.Close()
 
-	// Check response
-	c.Infof("%d %s", resp.StatusCode, resp.Status)
-
-	// Get response body
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		c.Errorf("%s in reading response body", err)
-		r = http.StatusInternalServerError
+	// Send message to the target user
+	var data map[string]string = map[string]string{"message": message.Message}
+	if err = notifier.SendToToken(c, dst.RegistrationToken, data); err != nil {
+		c.Errorf("%s in sending message to user %s", err, message.UserId)
+		r = notificationErrorCode(err)
+		e = notificationError(r)
 		return
 	}
-	c.Infof("%s", respBody)
 }
 
 // Receive a message from an APP instance.
-// Check it's instancd ID.
 // Send the message to the topic.
 // POST ./topic-messages"
+// Header {"Instance-Id":"..."}
 // Success: 204 No Content
 // Failure: 400 Bad Request, 403 Forbidden, 404 NotFound, 500 InternalError
 func SendTopicMessage(rw http.ResponseWriter, req *http.Request) {
 	// Appengine
-	var c appengine.Context = appengine.NewContext(req)
+	var c Context = newContext(req)
 	// Result, 0: success, 1: failed
 	var r int = http.StatusNoContent
+	// Error detail
+	var e *ApiError
 
 	// Return code
 	defer func() {
@@ -180,16 +119,8 @@ func SendTopicMessage(rw http.ResponseWriter, req *http.Request) {
 		if r == http.StatusNoContent {
 			// Changing the header after a call to WriteHeader (or Write) has no effect.
 			rw.WriteHeader(http.StatusNoContent)
-		} else if r == http.StatusBadRequest {
-			//			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			http.Error(rw, `Please follow https://aaa.appspot.com/api/0.1/topic-messages
-			                {
-			                    "instanceid":""
-			                    "topic":""
-			                    "message":""
-			                }`, http.StatusBadRequest)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
@@ -198,86 +129,46 @@ func SendTopicMessage(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		c.Errorf("%s in reading body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
 		return
 	}
 	var message TopicMessage
 	if err = json.Unmarshal(b, &message); err != nil {
 		c.Errorf("%s in decoding body %s", err, b)
 		r = http.StatusBadRequest
+		e = messageBodyError("topic", "message")
 		return
 	}
-
-	// Authenticate sender
-	var isValid bool = false
-	isValid, err = verifyRequest(message.InstanceId, c)
-	if err != nil {
-		c.Errorf("%s in authenticating request", err)
+	if message.Topic == "" {
+		c.Warningf("Missing topic. Ignore the request.")
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeFieldRequired, "topic", "Topic is required")
 		return
 	}
-	if isValid == false {
-		c.Warningf("Invalid request, ignore")
-		r = http.StatusForbidden
-		return
-	}
-
-	// Make GCM message body
-	var bodyString string = fmt.Sprintf(`
-		{
-			"to":"/topics/%s",
-			"data": {
-				"message":"%s"
-			}
-		}`, message.Topic, message.Message)
-
-
-	// Make a POST request for GCM
-	pReq, err := http.NewRequest("POST", GcmURL, strings.NewReader(bodyString))
-	if err != nil {
-		c.Errorf("%s in makeing a HTTP request", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	defer pReq.Body.Close()
-	pReq.Header.Add("Content-Type", "application/json")
-	pReq.Header.Add("Authorization", "key="+GcmApiKey)
-	// Debug
-	c.Infof("%s", *pReq)
-
-	// Send request
-	var client = urlfetch.Client(c)
-	resp, err := client.Do(pReq)
-	if err != nil {
-		c.Errorf("%s in sending request", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	defer resp.Body.Close()
-
-	// Check response
-	c.Infof("%d %s", resp.StatusCode, resp.Status)
 
-	// Get response body
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		c.Errorf("%s in reading response body", err)
-		r = http.StatusInternalServerError
+	// Send message to the topic
+	var data map[string]string = map[string]string{"message": message.Message}
+	if err = notifier.SendToTopic(c, message.Topic, data); err != nil {
+		c.Errorf("%s in sending message to topic %s", err, message.Topic)
+		r = notificationErrorCode(err)
+		e = notificationError(r)
 		return
 	}
-	c.Infof("%s", respBody)
 }
 
 // Receive a message from an APP instance.
-// Check it's instancd ID.
 // Send the message to the gruop.
 // POST ./group-messages"
+// Header {"Instance-Id":"..."}
 // Success: 204 No Content
 // Failure: 400 Bad Request, 403 Forbidden, 404 NotFound, 500 InternalError
 func SendGroupMessage(rw http.ResponseWriter, req *http.Request) {
 	// Appengine
-	var c appengine.Context = appengine.NewContext(req)
+	var c Context = newContext(req)
 	// Result, 0: success, 1: failed
 	var r int = http.StatusNoContent
+	// Error detail
+	var e *ApiError
 
 	// Return code
 	defer func() {
@@ -285,16 +176,8 @@ func SendGroupMessage(rw http.ResponseWriter, req *http.Request) {
 		if r == http.StatusNoContent {
 			// Changing the header after a call to WriteHeader (or Write) has no effect.
 			rw.WriteHeader(http.StatusNoContent)
-		} else if r == http.StatusBadRequest {
-			//			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			http.Error(rw, `Please follow https://aaa.appspot.com/api/0.1/group-messages
-			                {
-			                    "instanceid":""
-			                    "groupName":""
-			                    "message":""
-			                }`, http.StatusBadRequest)
 		} else {
-			http.Error(rw, http.StatusText(r), r)
+			writeError(rw, r, e)
 		}
 	}()
 
@@ -303,86 +186,53 @@ func SendGroupMessage(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		c.Errorf("%s in reading body %s", err, b)
 		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
 		return
 	}
 	var message GroupMessage
 	if err = json.Unmarshal(b, &message); err != nil {
 		c.Errorf("%s in decoding body %s", err, b)
 		r = http.StatusBadRequest
+		e = messageBodyError("groupname", "message")
 		return
 	}
-
-	// Authenticate sender
-	var isValid bool = false
-	isValid, err = verifyRequest(message.InstanceId, c)
-	if err != nil {
-		c.Errorf("%s in authenticating request", err)
+	if message.GroupName == "" {
+		c.Warningf("Missing groupname. Ignore the request.")
 		r = http.StatusBadRequest
-		return
-	}
-	if isValid == false {
-		c.Warningf("Invalid request, ignore")
-		r = http.StatusForbidden
+		e = NewFieldError(ErrCodeFieldRequired, "groupname", "Groupname is required")
 		return
 	}
 
 	// Search for existing group
-	var cKey *datastore.Key
 	var pGroup *Group
-	cKey, pGroup, err = searchGroup(message.GroupName, c)
+	_, pGroup, err = searchGroup(message.GroupName, c)
 	if err != nil {
 		c.Errorf("%s in searching existing group %s", err, message.GroupName)
 		r = http.StatusInternalServerError
 		return
 	}
-	if cKey == nil {
+	if pGroup == nil {
 		c.Warningf("Group %s is not found", message.GroupName)
 		r = http.StatusBadRequest
+		e = NewFieldError(ErrCodeGroupNotFound, "groupname", "Group is not found")
 		return
 	}
 
-	// Make GCM message body
-	var bodyString string = fmt.Sprintf(`
-		{
-			"to":"%s",
-			"data": {
-				"message":"%s"
-			}
-		}`, pGroup.NotificationKey, message.Message)
-
-
-	// Make a POST request for GCM
-	pReq, err := http.NewRequest("POST", GcmURL, strings.NewReader(bodyString))
-	if err != nil {
-		c.Errorf("%s in makeing a HTTP request", err)
-		r = http.StatusInternalServerError
-		return
-	}
-	defer pReq.Body.Close()
-	pReq.Header.Add("Content-Type", "application/json")
-	pReq.Header.Add("Authorization", "key="+GcmApiKey)
-	// Debug
-	c.Infof("Send request to GCM server %s", *pReq)
-
-	// Send request
-	var client = urlfetch.Client(c)
-	resp, err := client.Do(pReq)
-	if err != nil {
-		c.Errorf("%s in sending request", err)
-		r = http.StatusInternalServerError
+	// Send message to the group
+	var data map[string]string = map[string]string{"message": message.Message}
+	if err = notifier.SendToGroup(c, pGroup.NotificationKey, data); err != nil {
+		c.Errorf("%s in sending message to group %s", err, message.GroupName)
+		r = notificationErrorCode(err)
+		e = notificationError(r)
 		return
 	}
-	defer resp.Body.Close()
-
-	// Check response
-	c.Infof("%d %s", resp.StatusCode, resp.Status)
+}
 
-	// Get response body
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		c.Errorf("%s in reading response body", err)
-		r = http.StatusInternalServerError
-		return
+// Error of an undecodable message body. List the fields the body should have.
+func messageBodyError(fields ...string) *ApiError {
+	e := NewApiError(ErrCodeInvalidBody, "Body should be a JSON object with "+strings.Join(fields, ", "))
+	for _, v := range fields {
+		e.WithField(v, "Expected string")
 	}
-	c.Infof("%s", respBody)
+	return e
 }
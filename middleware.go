@@ -0,0 +1,244 @@
+package aliza
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler to do something before or after it
+type Middleware func(h HandlerFunc) HandlerFunc
+
+// Wrap a handler with middlewares. The first middleware is the outermost one.
+func Chain(h HandlerFunc, middlewares ...Middleware) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Keys of values in request contexts
+type contextKey int
+
+const (
+	originalRequestKey contextKey = iota
+	requestIdKey
+	requestUserKey
+	accessLogKey
+)
+
+// HTTP headers
+const HttpHeaderRequestId = "X-Request-Id"
+
+// The authenticated user of a request
+type requestUser struct {
+	key  string
+	user *User
+}
+
+// Get the request which the server received before middlewares derived new ones from it.
+// APP Engine services need it.
+func OriginalRequest(req *http.Request) *http.Request {
+	if v, ok := req.Context().Value(originalRequestKey).(*http.Request); ok {
+		return v
+	}
+	return req
+}
+
+// Get the request ID. Return "" if RequestIdMiddleware isn't applied.
+func RequestId(req *http.Request) string {
+	v, _ := req.Context().Value(requestIdKey).(string)
+	return v
+}
+
+// Get the user key and the user authenticated by AuthenticateMiddleware.
+// Return "" and nil if the request isn't authenticated.
+func RequestUser(req *http.Request) (string, *User) {
+	if v, ok := req.Context().Value(requestUserKey).(requestUser); ok {
+		return v.key, v.user
+	}
+	return "", nil
+}
+
+// Remember the original request so that derived requests can still reach it
+func withOriginalRequest(req *http.Request) *http.Request {
+	if _, ok := req.Context().Value(originalRequestKey).(*http.Request); ok {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), originalRequestKey, req))
+}
+
+// Attach a request ID to the request context and the response header.
+// Take the client's X-Request-Id if it's reasonable. Otherwise generate one.
+func RequestIdMiddleware(h HandlerFunc) HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request, params Params) {
+		var id string = req.Header.Get(HttpHeaderRequestId)
+		if !isValidRequestId(id) {
+			id = newRequestId()
+		}
+		rw.Header().Set(HttpHeaderRequestId, id)
+		req = withOriginalRequest(req)
+		h(rw, req.WithContext(context.WithValue(req.Context(), requestIdKey, id)), params)
+	}
+}
+
+// Accept at most 64 printable ASCII characters without spaces
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Records the response status and size for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Turn panics into 500 Internal Server Error and log the stack
+func RecoverMiddleware(h HandlerFunc) HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request, params Params) {
+		recorder := &statusRecorder{ResponseWriter: rw}
+		defer func() {
+			if v := recover(); v != nil {
+				c := newContext(req)
+				c.Errorf("Panic in serving %s %s: %v\n%s", req.Method, req.URL.Path, v, debug.Stack())
+				// The response can't be changed once it's started
+				if recorder.status == 0 {
+					writeError(recorder, http.StatusInternalServerError, nil)
+				}
+			}
+		}()
+		h(recorder, req, params)
+	}
+}
+
+// One access log line
+type accessLog struct {
+	RequestId string  `json:"requestid"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Query     string  `json:"query,omitempty"`
+	Status    int     `json:"status"`
+	Bytes     int     `json:"bytes"`
+	Duration  float64 `json:"durationms"`
+	RemoteIP  string  `json:"remoteip"`
+	UserKey   string  `json:"userkey,omitempty"`
+	UserAgent string  `json:"useragent,omitempty"`
+}
+
+// Write one JSON access log line per request
+func AccessLogMiddleware(h HandlerFunc) HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request, params Params) {
+		var start time.Time = time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw}
+		// Inner middlewares fill the entry, e.g. the authenticated user
+		var entry *accessLog = &accessLog{
+			RequestId: RequestId(req),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Query:     req.URL.RawQuery,
+			RemoteIP:  req.RemoteAddr,
+			UserAgent: req.UserAgent(),
+		}
+		req = withOriginalRequest(req)
+		h(recorder, req.WithContext(context.WithValue(req.Context(), accessLogKey, entry)), params)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		entry.Status = recorder.status
+		entry.Bytes = recorder.bytes
+		entry.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		newContext(req).Infof("access %s", b)
+	}
+}
+
+// Authenticate the user by Instance-Id header and put the user into the request context.
+// Unknown users get 403 Forbidden.
+func AuthenticateMiddleware(h HandlerFunc) HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request, params Params) {
+		c := newContext(req)
+		var instanceId string = req.Header.Get(HttpHeaderInstanceId)
+		if instanceId == "" {
+			c.Warningf("Missing instance ID. Ignore the request.")
+			writeError(rw, http.StatusForbidden, NewApiError(ErrCodeUnauthenticated, "Header Instance-Id is required"))
+			return
+		}
+		key, pUser, err := searchUser(instanceId, c)
+		if err != nil {
+			c.Errorf("%s in searching user %v", err, instanceId)
+			writeError(rw, http.StatusInternalServerError, nil)
+			return
+		}
+		if pUser == nil {
+			c.Warningf("Invalid instance ID %s is not found in datastore. Ignore the request", instanceId)
+			writeError(rw, http.StatusForbidden, NewApiError(ErrCodeUnauthenticated, "Instance ID is not registered"))
+			return
+		}
+		if entry, ok := req.Context().Value(accessLogKey).(*accessLog); ok {
+			entry.UserKey = key
+		}
+		req = withOriginalRequest(req)
+		h(rw, req.WithContext(context.WithValue(req.Context(), requestUserKey, requestUser{key, pUser})), params)
+	}
+}
+
+// Whether the request user is an administrator
+func isAdmin(req *http.Request) bool {
+	_, pUser := RequestUser(req)
+	return pUser != nil && config.IsAdmin(pUser.InstanceId)
+}
+
+// Let only administrators through. Other users get 403 Forbidden. Must run after AuthenticateMiddleware.
+func AdminMiddleware(h HandlerFunc) HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request, params Params) {
+		if !isAdmin(req) {
+			c := newContext(req)
+			userKey, _ := RequestUser(req)
+			c.Warningf("User %s is not an administrator. Ignore the request.", userKey)
+			writeError(rw, http.StatusForbidden, NewApiError(ErrCodeAdminRequired, "Only administrators can do it"))
+			return
+		}
+		h(rw, req, params)
+	}
+}
@@ -0,0 +1,77 @@
+package aliza
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Notifier delivers push notifications to APP instances and manages device groups.
+// Data is the key-value payload delivered to the APP.
+type Notifier interface {
+	// Send to a single APP instance by its registration token
+	SendToToken(c Context, token string, data map[string]string) error
+	// Send to all APP instances subscribing a topic
+	SendToTopic(c Context, topic string, data map[string]string) error
+	// Send to all APP instances in a device group by its group key
+	SendToGroup(c Context, groupKey string, data map[string]string) error
+	// Create a device group with a unique name. Return the group key.
+	CreateGroup(c Context, name string, tokens []string) (string, error)
+	// Add APP instances to a device group
+	AddToGroup(c Context, name string, groupKey string, tokens []string) error
+	// Remove APP instances from a device group. The group is removed with its last instance.
+	RemoveFromGroup(c Context, name string, groupKey string, tokens []string) error
+}
+
+// The push server refused the request, e.g. an invalid token or group
+var ErrNotificationRejected = errors.New("Notification is rejected by the push server")
+
+// The push provider used by all handlers. It's FCM on APP Engine.
+var notifier Notifier = unavailableNotifier{errors.New("Push provider is not configured")}
+
+// Replace the push provider. Call it before serving requests.
+func SetNotifier(n Notifier) {
+	notifier = n
+}
+
+// Map a notifier error to an HTTP response code
+func notificationErrorCode(err error) int {
+	if err == ErrNotificationRejected {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// A notifier which fails every call because the push provider can't be initialized
+type unavailableNotifier struct {
+	err error
+}
+
+func (n unavailableNotifier) SendToToken(c Context, token string, data map[string]string) error {
+	c.Errorf("Push provider is unavailable: %s", n.err)
+	return n.err
+}
+
+func (n unavailableNotifier) SendToTopic(c Context, topic string, data map[string]string) error {
+	c.Errorf("Push provider is unavailable: %s", n.err)
+	return n.err
+}
+
+func (n unavailableNotifier) SendToGroup(c Context, groupKey string, data map[string]string) error {
+	c.Errorf("Push provider is unavailable: %s", n.err)
+	return n.err
+}
+
+func (n unavailableNotifier) CreateGroup(c Context, name string, tokens []string) (string, error) {
+	c.Errorf("Push provider is unavailable: %s", n.err)
+	return "", n.err
+}
+
+func (n unavailableNotifier) AddToGroup(c Context, name string, groupKey string, tokens []string) error {
+	c.Errorf("Push provider is unavailable: %s", n.err)
+	return n.err
+}
+
+func (n unavailableNotifier) RemoveFromGroup(c Context, name string, groupKey string, tokens []string) error {
+	c.Errorf("Push provider is unavailable: %s", n.err)
+	return n.err
+}
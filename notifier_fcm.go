@@ -0,0 +1,236 @@
+package aliza
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// HTTP body to send a message to FCM HTTP v1 API
+type fcmRequest struct {
+	Message fcmMessage `json:"message"`
+}
+
+// Exactly one of Token and Topic is set. Token is a registration token or a device group key.
+type fcmMessage struct {
+	Token string            `json:"token,omitempty"`
+	Topic string            `json:"topic,omitempty"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+// HTTP error body received from FCM HTTP v1 API
+type fcmErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// Default FCM servers
+const FcmBaseURL = "https://fcm.googleapis.com/v1/projects/"
+const FcmGroupURL = "https://fcm.googleapis.com/fcm/notification"
+
+// OAuth2 scope to send messages
+const FcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// Default service account key file deployed with the APP
+const FcmServiceAccountFile = "service-account.json"
+
+// Push provider on Firebase Cloud Messaging HTTP v1 API. Reference: https://firebase.google.com/docs/cloud-messaging/send-message
+// Requests are authorized with OAuth2 access tokens of a service account.
+type FcmNotifier struct {
+	// FCM HTTP v1 API base URL. Messages are sent to BaseURL + ProjectId + "/messages:send".
+	BaseURL   string
+	// Device group management URL
+	GroupURL  string
+	ProjectId string
+	// GCM sender ID, i.e. the project number, to manage device groups
+	SenderId  string
+	// Get an HTTP client of the request
+	Client    func(c Context) *http.Client
+	tokens    *serviceAccountTokenSource
+}
+
+func NewFcmNotifier(account *ServiceAccount, senderId string) (*FcmNotifier, error) {
+	tokens, err := newServiceAccountTokenSource(account, FcmScope)
+	if err != nil {
+		return nil, err
+	}
+	return &FcmNotifier{
+		BaseURL:   FcmBaseURL,
+		GroupURL:  FcmGroupURL,
+		ProjectId: account.ProjectId,
+		SenderId:  senderId,
+		Client:    func(c Context) *http.Client { return httpClient(c) },
+		tokens:    tokens,
+	}, nil
+}
+
+// Create an FCM notifier with the servers and the service account in the configuration
+func NewFcmNotifierFromConfig(cfg *Config) (*FcmNotifier, error) {
+	account, err := LoadServiceAccount(cfg.FcmServiceAccountFile)
+	if err != nil {
+		return nil, err
+	}
+	n, err := NewFcmNotifier(account, cfg.GaeProjectNumber)
+	if err != nil {
+		return nil, err
+	}
+	n.BaseURL = cfg.FcmBaseURL
+	n.GroupURL = cfg.FcmGroupURL
+	return n, nil
+}
+
+func (n *FcmNotifier) SendToToken(c Context, token string, data map[string]string) error {
+	return n.send(c, fcmMessage{Token: token, Data: data})
+}
+
+func (n *FcmNotifier) SendToTopic(c Context, topic string, data map[string]string) error {
+	return n.send(c, fcmMessage{Topic: topic, Data: data})
+}
+
+// FCM HTTP v1 API sends to a device group by setting its key as the token
+func (n *FcmNotifier) SendToGroup(c Context, groupKey string, data map[string]string) error {
+	return n.send(c, fcmMessage{Token: groupKey, Data: data})
+}
+
+func (n *FcmNotifier) CreateGroup(c Context, name string, tokens []string) (string, error) {
+	var operation GroupOperation = GroupOperation{
+		Operation:             "create",
+		Notification_key_name: name,
+		Registration_ids:      tokens,
+	}
+	if err := n.groupOperation(c, &operation); err != nil {
+		return "", err
+	}
+	return operation.Notification_key, nil
+}
+
+func (n *FcmNotifier) AddToGroup(c Context, name string, groupKey string, tokens []string) error {
+	return n.groupOperation(c, &GroupOperation{
+		Operation:             "add",
+		Notification_key_name: name,
+		Notification_key:      groupKey,
+		Registration_ids:      tokens,
+	})
+}
+
+func (n *FcmNotifier) RemoveFromGroup(c Context, name string, groupKey string, tokens []string) error {
+	return n.groupOperation(c, &GroupOperation{
+		Operation:             "remove",
+		Notification_key_name: name,
+		Notification_key:      groupKey,
+		Registration_ids:      tokens,
+	})
+}
+
+// Send a message to FCM HTTP v1 API
+func (n *FcmNotifier) send(c Context, message fcmMessage) error {
+	b, err := json.Marshal(fcmRequest{Message: message})
+	if err != nil {
+		c.Errorf("%s in encoding a message as JSON", err)
+		return err
+	}
+	pReq, err := http.NewRequest("POST", n.BaseURL+n.ProjectId+"/messages:send", bytes.NewReader(b))
+	if err != nil {
+		c.Errorf("%s in makeing a HTTP request", err)
+		return err
+	}
+	// Payloads, registration tokens and group keys aren't logged
+	var target string = "token"
+	if message.Topic != "" {
+		target = "topic"
+	}
+
+	resp, respBody, err := n.do(c, pReq)
+	if err != nil {
+		return err
+	}
+	c.Debugf("FCM message to a %s is replied %d", target, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		var e fcmErrorResponse
+		json.Unmarshal(respBody, &e)
+		c.Errorf("FCM server replied %d %s %s", resp.StatusCode, e.Error.Status, e.Error.Message)
+		return fcmError(resp.StatusCode)
+	}
+	return nil
+}
+
+// Send a Device Group operation to FCM server
+// Success: store the notification key from server to the operation structure
+func (n *FcmNotifier) groupOperation(c Context, pOperation *GroupOperation) error {
+	// Registration tokens and group keys aren't logged
+	c.Debugf("FCM operation %s on group %s", pOperation.Operation, pOperation.Notification_key_name)
+
+	b, err := json.Marshal(pOperation)
+	if err != nil {
+		c.Errorf("%s in encoding an operation as JSON", err)
+		return err
+	}
+	pReq, err := http.NewRequest("POST", n.GroupURL, bytes.NewReader(b))
+	if err != nil {
+		c.Errorf("%s in makeing a HTTP request", err)
+		return err
+	}
+	pReq.Header.Add("project_id", n.SenderId)
+	pReq.Header.Add("access_token_auth", "true")
+
+	resp, respBody, err := n.do(c, pReq)
+	if err != nil {
+		return err
+	}
+	var operationResponse GroupOperationResponse
+	if err = json.Unmarshal(respBody, &operationResponse); err != nil {
+		c.Errorf("%s in decoding JSON response body", err)
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.Errorf("FCM server replied %d %s", resp.StatusCode, operationResponse.Error)
+		return fcmError(resp.StatusCode)
+	}
+	// Success. Write Notification Key to operation structure
+	pOperation.Notification_key = operationResponse.Notification_key
+	return nil
+}
+
+// Authorize and send a request. Return the response with its body read.
+func (n *FcmNotifier) do(c Context, pReq *http.Request) (*http.Response, []byte, error) {
+	var client *http.Client = n.Client(c)
+	token, err := n.tokens.Token(c, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	pReq.Header.Set("Content-Type", "application/json")
+	pReq.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(pReq)
+	if err != nil {
+		c.Errorf("%s in sending request", err)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	c.Infof("%d %s", resp.StatusCode, resp.Status)
+
+	// The token may be revoked. Get a new one next time.
+	if resp.StatusCode == http.StatusUnauthorized {
+		n.tokens.Invalidate()
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Errorf("%s in reading response body", err)
+		return nil, nil, err
+	}
+	return resp, b, nil
+}
+
+// Map an FCM response code to a notifier error
+func fcmError(statusCode int) error {
+	if statusCode >= 400 && statusCode < 500 {
+		return ErrNotificationRejected
+	}
+	return errors.New("FCM server is temporary unavailable")
+}
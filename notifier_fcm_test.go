@@ -0,0 +1,158 @@
+package aliza
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A fake FCM server with a token endpoint, HTTP v1 API and device group management
+type fakeFcmServer struct {
+	t        *testing.T
+	tokens   *fakeTokenEndpoint
+	// Received messages and group operations
+	messages   []fcmMessage
+	operations []GroupOperation
+	// Reply this status instead of success if it's set
+	status   int
+}
+
+func (f *fakeFcmServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		f.tokens.ServeHTTP(rw, req)
+		return
+	}
+	if v := req.Header.Get("Authorization"); v != fmt.Sprintf("Bearer token-%d", f.tokens.issued) {
+		f.t.Errorf("Authorization = %q with %d tokens issued", v, f.tokens.issued)
+	}
+	b, _ := ioutil.ReadAll(req.Body)
+	rw.Header().Set("Content-Type", "application/json")
+	switch req.URL.Path {
+	case "/v1/projects/aliza-test/messages:send":
+		var body fcmRequest
+		if err := json.Unmarshal(b, &body); err != nil {
+			f.t.Errorf("%s in decoding message %s", err, b)
+		}
+		f.messages = append(f.messages, body.Message)
+		if f.status != 0 {
+			rw.WriteHeader(f.status)
+			fmt.Fprintf(rw, `{"error": {"code": %d, "message": "fake", "status": "FAKE"}}`, f.status)
+			return
+		}
+		fmt.Fprint(rw, `{"name": "projects/aliza-test/messages/1"}`)
+	case "/fcm/notification":
+		if req.Header.Get("project_id") != "123456" || req.Header.Get("access_token_auth") != "true" {
+			f.t.Errorf("Group operation headers = %v", req.Header)
+		}
+		var operation GroupOperation
+		if err := json.Unmarshal(b, &operation); err != nil {
+			f.t.Errorf("%s in decoding group operation %s", err, b)
+		}
+		f.operations = append(f.operations, operation)
+		if f.status != 0 {
+			rw.WriteHeader(f.status)
+			fmt.Fprint(rw, `{"error": "fake"}`)
+			return
+		}
+		fmt.Fprintf(rw, `{"notification_key": "key-%s"}`, operation.Notification_key_name)
+	default:
+		f.t.Errorf("Unexpected request %s %s", req.Method, req.URL)
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Start a fake FCM server and a notifier which uses it
+func newTestFcmNotifier(t *testing.T) (*FcmNotifier, *fakeFcmServer, func()) {
+	fake := &fakeFcmServer{t: t, tokens: &fakeTokenEndpoint{t: t, key: &testPrivateKey(t).PublicKey}}
+	server := httptest.NewServer(fake)
+	n, err := NewFcmNotifier(testServiceAccount(t, server.URL+"/token"), "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.BaseURL = server.URL + "/v1/projects/"
+	n.GroupURL = server.URL + "/fcm/notification"
+	n.Client = func(c Context) *http.Client { return http.DefaultClient }
+	return n, fake, server.Close
+}
+
+func TestFcmSendToToken(t *testing.T) {
+	n, fake, stop := newTestFcmNotifier(t)
+	defer stop()
+	c := NewBackgroundLogContext("test")
+
+	if err := n.SendToToken(c, "registration-token", map[string]string{"message": "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SendToTopic(c, "news", map[string]string{"message": "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.messages) != 2 || fake.messages[0].Token != "registration-token" || fake.messages[0].Data["message"] != "hi" || fake.messages[1].Topic != "news" {
+		t.Errorf("Got messages %+v", fake.messages)
+	}
+	// Both requests share one access token
+	if fake.tokens.issued != 1 {
+		t.Errorf("Exchanged %d times", fake.tokens.issued)
+	}
+}
+
+func TestFcmSendErrors(t *testing.T) {
+	n, fake, stop := newTestFcmNotifier(t)
+	defer stop()
+	c := NewBackgroundLogContext("test")
+
+	fake.status = http.StatusNotFound
+	if err := n.SendToToken(c, "unregistered", nil); err != ErrNotificationRejected {
+		t.Errorf("Got %v for a rejected message", err)
+	}
+	fake.status = http.StatusServiceUnavailable
+	if err := n.SendToToken(c, "registration-token", nil); err == nil || err == ErrNotificationRejected {
+		t.Errorf("Got %v for an unavailable server", err)
+	}
+	// A revoked access token is exchanged again
+	fake.status = http.StatusUnauthorized
+	n.SendToToken(c, "registration-token", nil)
+	fake.status = 0
+	if err := n.SendToToken(c, "registration-token", nil); err != nil || fake.tokens.issued != 2 {
+		t.Errorf("Got %v after %d exchanges", err, fake.tokens.issued)
+	}
+}
+
+func TestFcmGroupOperations(t *testing.T) {
+	n, fake, stop := newTestFcmNotifier(t)
+	defer stop()
+	c := NewBackgroundLogContext("test")
+
+	key, err := n.CreateGroup(c, "group", []string{"a"})
+	if err != nil || key != "key-group" {
+		t.Fatalf("Created group %s, %v", key, err)
+	}
+	if err = n.AddToGroup(c, "group", key, []string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.RemoveFromGroup(c, "group", key, []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.SendToGroup(c, key, map[string]string{"message": "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []GroupOperation = []GroupOperation{
+		{Operation: "create", Notification_key_name: "group", Registration_ids: []string{"a"}},
+		{Operation: "add", Notification_key_name: "group", Notification_key: "key-group", Registration_ids: []string{"b", "c"}},
+		{Operation: "remove", Notification_key_name: "group", Notification_key: "key-group", Registration_ids: []string{"b"}},
+	}
+	if fmt.Sprint(fake.operations) != fmt.Sprint(expected) {
+		t.Errorf("Got operations %+v", fake.operations)
+	}
+	if len(fake.messages) != 1 || fake.messages[0].Token != "key-group" {
+		t.Errorf("Got messages %+v", fake.messages)
+	}
+
+	fake.status = http.StatusBadRequest
+	if _, err = n.CreateGroup(c, "group", []string{"a"}); err != ErrNotificationRejected {
+		t.Errorf("Got %v for a rejected operation", err)
+	}
+}
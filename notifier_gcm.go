@@ -0,0 +1,180 @@
+package aliza
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// HTTP body received from Google Cloud Messaging server
+type GroupOperationResponse struct {
+	Notification_key     string    `json:"notification_key"`       // A unique key to identify a group
+	Error                string    `json:"error"`                  // Error message
+}
+
+// HTTP body to send a message to Google Cloud Messaging server
+type gcmMessage struct {
+	To   string            `json:"to"`
+	Data map[string]string `json:"data"`
+}
+
+// Push provider on the legacy Google Cloud Messaging HTTP API
+type gcmNotifier struct {
+	ApiKey        Secret
+	ProjectNumber string
+	SendURL       string
+	GroupURL      string
+	// Get an HTTP client of the request
+	Client        func(c Context) *http.Client
+}
+
+func NewGcmNotifier(cfg *Config) Notifier {
+	return &gcmNotifier{
+		ApiKey:        cfg.GcmApiKey,
+		ProjectNumber: cfg.GaeProjectNumber,
+		SendURL:       cfg.GcmURL,
+		GroupURL:      cfg.GcmGroupURL,
+		Client:        func(c Context) *http.Client { return httpClient(c) },
+	}
+}
+
+func (n *gcmNotifier) SendToToken(c Context, token string, data map[string]string) error {
+	return n.send(c, &gcmMessage{To: token, Data: data})
+}
+
+func (n *gcmNotifier) SendToTopic(c Context, topic string, data map[string]string) error {
+	return n.send(c, &gcmMessage{To: "/topics/" + topic, Data: data})
+}
+
+func (n *gcmNotifier) SendToGroup(c Context, groupKey string, data map[string]string) error {
+	return n.send(c, &gcmMessage{To: groupKey, Data: data})
+}
+
+func (n *gcmNotifier) CreateGroup(c Context, name string, tokens []string) (string, error) {
+	var operation GroupOperation = GroupOperation{
+		Operation:             "create",
+		Notification_key_name: name,
+		Registration_ids:      tokens,
+	}
+	if err := n.groupOperation(c, &operation); err != nil {
+		return "", err
+	}
+	return operation.Notification_key, nil
+}
+
+func (n *gcmNotifier) AddToGroup(c Context, name string, groupKey string, tokens []string) error {
+	return n.groupOperation(c, &GroupOperation{
+		Operation:             "add",
+		Notification_key_name: name,
+		Notification_key:      groupKey,
+		Registration_ids:      tokens,
+	})
+}
+
+func (n *gcmNotifier) RemoveFromGroup(c Context, name string, groupKey string, tokens []string) error {
+	return n.groupOperation(c, &GroupOperation{
+		Operation:             "remove",
+		Notification_key_name: name,
+		Notification_key:      groupKey,
+		Registration_ids:      tokens,
+	})
+}
+
+// Send a message to GCM server
+func (n *gcmNotifier) send(c Context, pMessage *gcmMessage) error {
+	b, err := json.Marshal(pMessage)
+	if err != nil {
+		c.Errorf("%s in encoding a message as JSON", err)
+		return err
+	}
+
+	// Make a POST request for GCM
+	pReq, err := http.NewRequest("POST", n.SendURL, bytes.NewReader(b))
+	if err != nil {
+		c.Errorf("%s in makeing a HTTP request", err)
+		return err
+	}
+	pReq.Header.Add("Content-Type", "application/json")
+	pReq.Header.Add("Authorization", "key="+string(n.ApiKey))
+	// Debug
+	c.Infof("Send body to GCM server %s", b)
+
+	// Send request
+	resp, err := n.Client(c).Do(pReq)
+	if err != nil {
+		c.Errorf("%s in sending request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Get response body
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Errorf("%s in reading response body", err)
+		return err
+	}
+	c.Infof("%d %s", resp.StatusCode, resp.Status)
+	c.Infof("Body: %s", respBody)
+
+	// Check response
+	if resp.StatusCode != http.StatusOK {
+		return ErrNotificationRejected
+	}
+	return nil
+}
+
+// Send a Google Cloud Messaging Device Group operation to GCM server
+// Success: store the notification key from server to the operation structure
+func (n *gcmNotifier) groupOperation(c Context, pOperation *GroupOperation) error {
+	// Vernon debug
+	c.Debugf("GCM operation %+v", pOperation)
+
+	// Make a POST request for GCM
+	b, err := json.Marshal(pOperation)
+	if err != nil {
+		c.Errorf("%s in encoding an operation as JSON", err)
+		return err
+	}
+	pReq, err := http.NewRequest("POST", n.GroupURL, bytes.NewReader(b))
+	if err != nil {
+		c.Errorf("%s in makeing a HTTP request", err)
+		return err
+	}
+	pReq.Header.Add("Content-Type", "application/json")
+	pReq.Header.Add("Authorization", "key="+string(n.ApiKey))
+	pReq.Header.Add("project_id", n.ProjectNumber)
+	// Debug
+	c.Debugf("Send body to GCM server %s", b)
+
+	// Send request
+	resp, err := n.Client(c).Do(pReq)
+	if err != nil {
+		c.Errorf("%s in sending request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Get response body
+	var respBody GroupOperationResponse
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Errorf("%s in reading response body", err)
+		return err
+	}
+	c.Infof("Receive body %s", b)
+	if err = json.Unmarshal(b, &respBody); err != nil {
+		c.Errorf("%s in decoding JSON response body", err)
+		return err
+	}
+
+	// Check response
+	c.Infof("%d %s", resp.StatusCode, resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		c.Errorf("GCM server replied that %s", respBody.Error)
+		return ErrNotificationRejected
+	}
+	// Success. Write Notification Key to operation structure
+	pOperation.Notification_key = respBody.Notification_key
+	return nil
+}
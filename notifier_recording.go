@@ -0,0 +1,132 @@
+package aliza
+
+import (
+	"sync"
+)
+
+// A notification recorded by RecordingNotifier
+type RecordedNotification struct {
+	// "token", "topic" or "group"
+	Kind string
+	// Registration token, topic or group key
+	To   string
+	Data map[string]string
+}
+
+// A fake push provider which records everything instead of sending it. For tests.
+type RecordingNotifier struct {
+	mu            sync.Mutex
+	notifications []RecordedNotification
+	operations    []GroupOperation
+	// Group key -> registration tokens in the group
+	groups        map[string][]string
+	// Err is returned by every call when it's set
+	Err           error
+}
+
+func NewRecordingNotifier() *RecordingNotifier {
+	return &RecordingNotifier{groups: make(map[string][]string)}
+}
+
+func (n *RecordingNotifier) SendToToken(c Context, token string, data map[string]string) error {
+	return n.record("token", token, data)
+}
+
+func (n *RecordingNotifier) SendToTopic(c Context, topic string, data map[string]string) error {
+	return n.record("topic", topic, data)
+}
+
+func (n *RecordingNotifier) SendToGroup(c Context, groupKey string, data map[string]string) error {
+	return n.record("group", groupKey, data)
+}
+
+func (n *RecordingNotifier) CreateGroup(c Context, name string, tokens []string) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Err != nil {
+		return "", n.Err
+	}
+	var groupKey string = "group-key-" + name
+	n.groups[groupKey] = append([]string(nil), tokens...)
+	n.operations = append(n.operations, GroupOperation{"create", name, groupKey, tokens})
+	return groupKey, nil
+}
+
+func (n *RecordingNotifier) AddToGroup(c Context, name string, groupKey string, tokens []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Err != nil {
+		return n.Err
+	}
+	n.groups[groupKey] = append(n.groups[groupKey], tokens...)
+	n.operations = append(n.operations, GroupOperation{"add", name, groupKey, tokens})
+	return nil
+}
+
+func (n *RecordingNotifier) RemoveFromGroup(c Context, name string, groupKey string, tokens []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Err != nil {
+		return n.Err
+	}
+	var remaining []string
+	for _, v := range n.groups[groupKey] {
+		var removed bool = false
+		for _, t := range tokens {
+			if v == t {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			remaining = append(remaining, v)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(n.groups, groupKey)
+	} else {
+		n.groups[groupKey] = remaining
+	}
+	n.operations = append(n.operations, GroupOperation{"remove", name, groupKey, tokens})
+	return nil
+}
+
+func (n *RecordingNotifier) record(kind string, to string, data map[string]string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Err != nil {
+		return n.Err
+	}
+	n.notifications = append(n.notifications, RecordedNotification{kind, to, data})
+	return nil
+}
+
+// Notifications sent so far
+func (n *RecordingNotifier) Notifications() []RecordedNotification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]RecordedNotification(nil), n.notifications...)
+}
+
+// Group operations done so far
+func (n *RecordingNotifier) Operations() []GroupOperation {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]GroupOperation(nil), n.operations...)
+}
+
+// Registration tokens in a group. Nil if the group doesn't exist.
+func (n *RecordingNotifier) GroupMembers(groupKey string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.groups[groupKey]...)
+}
+
+// Forget everything recorded
+func (n *RecordingNotifier) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notifications = nil
+	n.operations = nil
+	n.groups = make(map[string][]string)
+}
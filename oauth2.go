@@ -0,0 +1,199 @@
+package aliza
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google service account key file downloaded from Google Cloud console
+type ServiceAccount struct {
+	Type         string `json:"type"`
+	ProjectId    string `json:"project_id"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   Secret `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// HTTP response body from OAuth2 token endpoint
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Error       string `json:"error"`
+}
+
+// Google OAuth2 token endpoint
+const GoogleTokenURL = "https://oauth2.googleapis.com/token"
+
+// Refresh access tokens a bit earlier than they expire
+const accessTokenExpiryMargin = time.Minute
+
+// Lifetime of a signed JWT assertion. Google accepts at most an hour.
+const jwtAssertionLifetime = time.Hour
+
+// Read a service account key file
+func LoadServiceAccount(path string) (*ServiceAccount, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account ServiceAccount
+	if err = json.Unmarshal(b, &account); err != nil {
+		return nil, err
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("Service account key file misses client_email or private_key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = GoogleTokenURL
+	}
+	return &account, nil
+}
+
+// Exchange service account JWT assertions for OAuth2 access tokens and cache them until they expire
+type serviceAccountTokenSource struct {
+	account *ServiceAccount
+	scopes  []string
+	key     *rsa.PrivateKey
+	// Protects the cached token
+	mu      sync.Mutex
+	token   string
+	expiry  time.Time
+	// Get current time. Replaceable in tests.
+	now     func() time.Time
+}
+
+func newServiceAccountTokenSource(account *ServiceAccount, scopes ...string) (*serviceAccountTokenSource, error) {
+	key, err := parseRSAPrivateKey(string(account.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &serviceAccountTokenSource{
+		account: account,
+		scopes:  scopes,
+		key:     key,
+		now:     time.Now,
+	}, nil
+}
+
+// Parse a PEM encoded PKCS#8 or PKCS#1 RSA private key
+func parseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("Private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// Get a valid access token. Exchange a new one when the cached one expires.
+func (s *serviceAccountTokenSource) Token(c Context, client *http.Client) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && s.now().Before(s.expiry) {
+		return s.token, nil
+	}
+
+	// Sign a JWT assertion
+	assertion, err := s.signAssertion()
+	if err != nil {
+		c.Errorf("%s in signing JWT assertion", err)
+		return "", err
+	}
+
+	// Exchange the assertion for an access token
+	var form url.Values = url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := client.PostForm(s.account.TokenURI, form)
+	if err != nil {
+		c.Errorf("%s in requesting an access token", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Errorf("%s in reading token response body", err)
+		return "", err
+	}
+	var token oauth2TokenResponse
+	if err = json.Unmarshal(b, &token); err != nil {
+		c.Errorf("%s in decoding token response body %s", err, b)
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		c.Errorf("Token endpoint replied %d %s", resp.StatusCode, token.Error)
+		return "", errors.New("Failed to get an access token")
+	}
+
+	// Cache the token
+	s.token = token.AccessToken
+	s.expiry = s.now().Add(time.Duration(token.ExpiresIn)*time.Second - accessTokenExpiryMargin)
+	c.Infof("Got an access token for %s which expires in %d seconds", s.account.ClientEmail, token.ExpiresIn)
+	return s.token, nil
+}
+
+// Drop the cached access token
+func (s *serviceAccountTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// Sign a JWT assertion with RS256. Reference: https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+func (s *serviceAccountTokenSource) signAssertion() (string, error) {
+	var now time.Time = s.now()
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.account.PrivateKeyId,
+	}
+	claims := map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": strings.Join(s.scopes, " "),
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(jwtAssertionLifetime).Unix(),
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	var unsigned string = base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,238 @@
+package aliza
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A key shared by tests because generating one is slow
+var testRSAKey *rsa.PrivateKey
+
+func testPrivateKey(t *testing.T) *rsa.PrivateKey {
+	if testRSAKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRSAKey = key
+	}
+	return testRSAKey
+}
+
+func testServiceAccount(t *testing.T, tokenURI string) *ServiceAccount {
+	var block pem.Block = pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testPrivateKey(t))}
+	return &ServiceAccount{
+		Type:         "service_account",
+		ProjectId:    "aliza-test",
+		PrivateKeyId: "key-1",
+		PrivateKey:   Secret(pem.EncodeToMemory(&block)),
+		ClientEmail:  "aliza@aliza-test.iam.gserviceaccount.com",
+		TokenURI:     tokenURI,
+	}
+}
+
+// A fake OAuth2 token endpoint which verifies JWT assertions and counts issued tokens
+type fakeTokenEndpoint struct {
+	t      *testing.T
+	key    *rsa.PublicKey
+	issued int32
+	// Reply this status with an error instead of a token if it's set
+	status int
+}
+
+func (f *fakeTokenEndpoint) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		f.t.Errorf("%s in parsing token request", err)
+	}
+	if v := req.PostForm.Get("grant_type"); v != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		f.t.Errorf("grant_type = %q", v)
+	}
+	f.verifyAssertion(req.PostForm.Get("assertion"), "http://"+req.Host+req.URL.Path)
+	rw.Header().Set("Content-Type", "application/json")
+	if f.status != 0 {
+		rw.WriteHeader(f.status)
+		fmt.Fprint(rw, `{"error": "invalid_grant"}`)
+		return
+	}
+	n := atomic.AddInt32(&f.issued, 1)
+	fmt.Fprintf(rw, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": 3600}`, n)
+}
+
+func (f *fakeTokenEndpoint) verifyAssertion(assertion string, audience string) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		f.t.Errorf("Assertion %q isn't a JWT", assertion)
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest[:], signature) != nil {
+		f.t.Errorf("Assertion signature is invalid")
+	}
+	var header map[string]string
+	var claims map[string]interface{}
+	decodeSegment(f.t, parts[0], &header)
+	decodeSegment(f.t, parts[1], &claims)
+	if header["alg"] != "RS256" || header["kid"] != "key-1" {
+		f.t.Errorf("Header = %v", header)
+	}
+	if claims["iss"] != "aliza@aliza-test.iam.gserviceaccount.com" || claims["scope"] != FcmScope || claims["aud"] != audience {
+		f.t.Errorf("Claims = %v", claims)
+	}
+	iat, _ := claims["iat"].(float64)
+	exp, _ := claims["exp"].(float64)
+	if time.Duration(exp-iat)*time.Second != jwtAssertionLifetime {
+		f.t.Errorf("Assertion lives %v seconds", exp-iat)
+	}
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Errorf("%s in decoding JWT segment %q", err, segment)
+		return
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		t.Errorf("%s in decoding JWT segment %s", err, b)
+	}
+}
+
+// Start a fake token endpoint and a token source which uses it with a controllable clock
+func newTestTokenSource(t *testing.T) (*serviceAccountTokenSource, *fakeTokenEndpoint, *time.Time, func()) {
+	endpoint := &fakeTokenEndpoint{t: t, key: &testPrivateKey(t).PublicKey}
+	server := httptest.NewServer(endpoint)
+	s, err := newServiceAccountTokenSource(testServiceAccount(t, server.URL+"/token"), FcmScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now time.Time = time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	return s, endpoint, &now, server.Close
+}
+
+func TestTokenSourceExchangesAssertion(t *testing.T) {
+	s, endpoint, _, stop := newTestTokenSource(t)
+	defer stop()
+
+	token, err := s.Token(NewBackgroundLogContext("test"), http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token-1" || endpoint.issued != 1 {
+		t.Errorf("Got %s after %d exchanges", token, endpoint.issued)
+	}
+}
+
+func TestTokenSourceCachesUntilExpiry(t *testing.T) {
+	s, endpoint, now, stop := newTestTokenSource(t)
+	defer stop()
+	c := NewBackgroundLogContext("test")
+
+	for i := 0; i < 3; i++ {
+		if token, err := s.Token(c, http.DefaultClient); err != nil || token != "token-1" {
+			t.Fatalf("Got %s, %v from cache", token, err)
+		}
+	}
+	// Still valid just before the margin
+	*now = now.Add(time.Hour - accessTokenExpiryMargin - time.Second)
+	if token, _ := s.Token(c, http.DefaultClient); token != "token-1" {
+		t.Errorf("Got %s before expiry", token)
+	}
+	// Refreshed within the margin
+	*now = now.Add(time.Second)
+	if token, _ := s.Token(c, http.DefaultClient); token != "token-2" {
+		t.Errorf("Got %s after expiry", token)
+	}
+	if endpoint.issued != 2 {
+		t.Errorf("Exchanged %d times", endpoint.issued)
+	}
+}
+
+func TestTokenSourceInvalidate(t *testing.T) {
+	s, _, _, stop := newTestTokenSource(t)
+	defer stop()
+	c := NewBackgroundLogContext("test")
+
+	s.Token(c, http.DefaultClient)
+	s.Invalidate()
+	if token, _ := s.Token(c, http.DefaultClient); token != "token-2" {
+		t.Errorf("Got %s after invalidating", token)
+	}
+}
+
+func TestTokenSourceRejected(t *testing.T) {
+	s, endpoint, _, stop := newTestTokenSource(t)
+	defer stop()
+	c := NewBackgroundLogContext("test")
+
+	endpoint.status = http.StatusBadRequest
+	if token, err := s.Token(c, http.DefaultClient); err == nil {
+		t.Fatalf("Got %s from a rejecting endpoint", token)
+	}
+	// Failures aren't cached
+	endpoint.status = 0
+	if token, err := s.Token(c, http.DefaultClient); err != nil || token != "token-1" {
+		t.Errorf("Got %s, %v after the endpoint recovers", token, err)
+	}
+}
+
+func TestParseRSAPrivateKeyPKCS8(t *testing.T) {
+	b, err := x509.MarshalPKCS8PrivateKey(testPrivateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseRSAPrivateKey(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})))
+	if err != nil || key.N.Cmp(testPrivateKey(t).N) != 0 {
+		t.Errorf("Got %v, %v", key, err)
+	}
+	if _, err = parseRSAPrivateKey("not a key"); err == nil {
+		t.Errorf("Parsed a key which isn't PEM encoded")
+	}
+}
+
+func TestLoadServiceAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aliza")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Secret hides the private key in JSON, so write the key file by hand
+	var account ServiceAccount = *testServiceAccount(t, "")
+	b, _ := json.Marshal(map[string]string{
+		"type":         account.Type,
+		"project_id":   account.ProjectId,
+		"private_key":  string(account.PrivateKey),
+		"client_email": account.ClientEmail,
+	})
+	var path string = filepath.Join(dir, "service-account.json")
+	ioutil.WriteFile(path, b, 0600)
+	pAccount, err := LoadServiceAccount(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pAccount.TokenURI != GoogleTokenURL || pAccount.ClientEmail != account.ClientEmail {
+		t.Errorf("Got %+v", pAccount)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"client_email": "aliza@aliza-test.iam.gserviceaccount.com"}`), 0600)
+	if _, err = LoadServiceAccount(path); err == nil {
+		t.Errorf("Loaded a key file without a private key")
+	}
+}
@@ -0,0 +1,122 @@
+package aliza
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Path parameters of a request, e.g. {"id": "..."} for the route "/items/{id}"
+type Params map[string]string
+
+// Get a path parameter. Return "" if it's not in the route.
+func (p Params) Get(name string) string {
+	return p[name]
+}
+
+// Handler with the path parameters of the matched route
+type HandlerFunc func(rw http.ResponseWriter, req *http.Request, params Params)
+
+type route struct {
+	method   string
+	segments []string
+	handler  HandlerFunc
+}
+
+// Router dispatches requests by method and path. Paths are declared relative to a prefix,
+// e.g. "/items/{id}" where {id} matches one path segment.
+// Unknown paths get 404 Not Found. Known paths with unknown methods get 405 Method Not Allowed with an Allow header.
+type Router struct {
+	prefix      string
+	routes      []route
+	middlewares []Middleware
+}
+
+func NewRouter(prefix string) *Router {
+	return &Router{prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// Register a handler for a method and a path pattern
+func (r *Router) Handle(method string, pattern string, h HandlerFunc) {
+	r.routes = append(r.routes, route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+}
+
+// Register a handler without path parameters
+func (r *Router) HandleFunc(method string, pattern string, f http.HandlerFunc) {
+	r.Handle(method, pattern, func(rw http.ResponseWriter, req *http.Request, params Params) {
+		f(rw, req)
+	})
+}
+
+// Wrap all requests with middlewares, including the ones which don't match any route.
+// The first middleware is the outermost one.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	Chain(r.dispatch, r.middlewares...)(rw, req, nil)
+}
+
+// Find the route of a request and call its handler
+func (r *Router) dispatch(rw http.ResponseWriter, req *http.Request, _ Params) {
+	if !strings.HasPrefix(req.URL.Path, r.prefix) {
+		writeError(rw, http.StatusNotFound, nil)
+		return
+	}
+	var segments []string = splitPath(strings.TrimPrefix(req.URL.Path, r.prefix))
+
+	// Methods allowed on the path
+	var allowed []string
+	for _, v := range r.routes {
+		params, ok := matchRoute(v.segments, segments)
+		if !ok {
+			continue
+		}
+		if v.method == req.Method {
+			v.handler(rw, req, params)
+			return
+		}
+		allowed = append(allowed, v.method)
+	}
+
+	if len(allowed) == 0 {
+		writeError(rw, http.StatusNotFound, nil)
+		return
+	}
+	sort.Strings(allowed)
+	rw.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(rw, http.StatusMethodNotAllowed, nil)
+}
+
+// Split a path into segments ignoring leading and trailing slashes
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// Match path segments against a route. Return the path parameters.
+func matchRoute(pattern []string, segments []string) (Params, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	var params Params = Params{}
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
@@ -0,0 +1,420 @@
+package aliza
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const SavedSearchKind = "SavedSearch"
+
+// Radius of saved searches in kilometers
+const MaxSavedSearchRadiusKm = 50
+
+// Limits of saved searches of a user and their keywords
+const (
+	MaxSavedSearchesPerUser  = 10
+	MaxSavedSearchKeywords   = 5
+	MaxSavedSearchKeywordLen = 30
+)
+
+const SearchAlertQuotaKind = "SearchAlertQuota"
+
+// A user gets at most MaxSearchAlertsPerWindow alerts of new items in a SearchAlertWindow
+const (
+	MaxSearchAlertsPerWindow = 5
+	SearchAlertWindow        = time.Hour
+)
+
+// A search which a user saves to be told about new matching items nearby
+type SavedSearch struct {
+	Id           string    `json:"id"           datastore:"-"`
+	UserKey      string    `json:"userkey"`
+	Latitude     float64   `json:"latitude"     datastore:",noindex"`
+	Longitude    float64   `json:"longitude"    datastore:",noindex"`
+	// Geohash of the center to find searches around a new item
+	Geohash      string    `json:"-"`
+	// Kilometers around the center
+	Radius       float64   `json:"radius"       datastore:",noindex"`
+	// Items should have at least these free slots
+	MinOpenSlots int       `json:"minopenslots" datastore:",noindex"`
+	// Lowercase words which should all appear in the item description
+	Keywords     []string  `json:"keywords"     datastore:",noindex"`
+	CreateTime   time.Time `json:"createtime"`
+}
+
+// Saved search alerts a user got in the current rate limit window, which starts at WindowStart.
+// It isn't a part of the user so that counting alerts doesn't contend with other users.
+type SearchAlertQuota struct {
+	Count       int       `datastore:",noindex"`
+	WindowStart time.Time `datastore:",noindex"`
+}
+
+type SavedSearchRequestBody struct {
+	Latitude     float64  `json:"latitude"`
+	Longitude    float64  `json:"longitude"`
+	// Default to DefaultNearRadiusKm
+	Radius       float64  `json:"radius"`
+	MinOpenSlots int      `json:"minopenslots"`
+	Keywords     []string `json:"keywords"`
+}
+
+// Check a saved search request and lowercase its keywords
+func checkSavedSearch(body *SavedSearchRequestBody) *ApiError {
+	if body.Latitude < -90 || body.Latitude > 90 {
+		return NewFieldError(ErrCodeInvalidLocation, "latitude", "Latitude should be -90~90")
+	}
+	if body.Longitude < -180 || body.Longitude > 180 {
+		return NewFieldError(ErrCodeInvalidLocation, "longitude", "Longitude should be -180~180")
+	}
+	if body.Radius == 0 {
+		body.Radius = DefaultNearRadiusKm
+	}
+	if body.Radius < 0 || body.Radius > MaxSavedSearchRadiusKm {
+		return NewFieldError(ErrCodeInvalidRadius, "radius", fmt.Sprintf("Radius should be greater than 0 and at most %d kilometers", MaxSavedSearchRadiusKm))
+	}
+	if body.MinOpenSlots < 0 {
+		return NewFieldError(ErrCodeInvalidMinOpenSlots, "minopenslots", "Minimum free slots should not be negative")
+	}
+	if len(body.Keywords) > MaxSavedSearchKeywords {
+		return NewFieldError(ErrCodeInvalidKeywords, "keywords", fmt.Sprintf("At most %d keywords", MaxSavedSearchKeywords))
+	}
+	var keywords []string
+	for _, v := range body.Keywords {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" || utf8.RuneCountInString(v) > MaxSavedSearchKeywordLen {
+			return NewFieldError(ErrCodeInvalidKeywords, "keywords", fmt.Sprintf("Keywords should be 1~%d characters", MaxSavedSearchKeywordLen))
+		}
+		keywords = append(keywords, v)
+	}
+	body.Keywords = keywords
+	return nil
+}
+
+// Whether a new item matches a saved search
+func matchSavedSearch(pSearch *SavedSearch, pItem *Item) bool {
+	if pItem.OpenSlots < pSearch.MinOpenSlots {
+		return false
+	}
+	if distanceKm(pSearch.Latitude, pSearch.Longitude, pItem.Latitude, pItem.Longitude) > pSearch.Radius {
+		return false
+	}
+	var description string = strings.ToLower(pItem.Description)
+	for _, v := range pSearch.Keywords {
+		if !strings.Contains(description, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// POST ./saved-searches
+// Save a search to get pushes of new matching items
+// Success: 201 Created with the saved search and its URL in the Location header
+// Failure: 400 Bad Request, 409 Conflict, 500 Internal Server Error
+func storeSavedSearch(rw http.ResponseWriter, req *http.Request) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("StoreSavedSearch()")
+	// Result
+	r := http.StatusCreated
+	// Error detail
+	var e *ApiError
+	// Saved search
+	var search SavedSearch
+
+	// Set response
+	defer func() {
+		if r == http.StatusCreated {
+			rw.Header().Set("Location", req.URL.String()+"/"+search.Id)
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusCreated)
+			if err := json.NewEncoder(rw).Encode(search); err != nil {
+				c.Errorf("%s in encoding saved search %s", err, search.Id)
+			}
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	// Get data from body
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		c.Errorf("%s in reading body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Failed to read the request body")
+		return
+	}
+	var body SavedSearchRequestBody
+	if err = json.Unmarshal(b, &body); err != nil {
+		c.Errorf("%s in decoding body %s", err, b)
+		r = http.StatusBadRequest
+		e = NewApiError(ErrCodeInvalidBody, "Body should be a saved search in JSON")
+		return
+	}
+	if e = checkSavedSearch(&body); e != nil {
+		c.Warningf("Invalid saved search %+v", body)
+		r = http.StatusBadRequest
+		return
+	}
+
+	userKey, _ := RequestUser(req)
+	// Saved searches aren't in one entity group. Concurrent requests may exceed the limit slightly.
+	searches, err := store.SavedSearches().ListByUser(c, userKey)
+	if err != nil {
+		c.Errorf("%s in listing saved searches of user %s", err, userKey)
+		r = http.StatusInternalServerError
+		return
+	}
+	if len(searches) >= MaxSavedSearchesPerUser {
+		c.Warningf("User %s has %d saved searches", userKey, len(searches))
+		r = http.StatusConflict
+		e = NewApiError(ErrCodeTooManySavedSearches, fmt.Sprintf("Users can save at most %d searches", MaxSavedSearchesPerUser))
+		return
+	}
+
+	search = SavedSearch{
+		UserKey:      userKey,
+		Latitude:     body.Latitude,
+		Longitude:    body.Longitude,
+		Geohash:      encodeGeohash(body.Latitude, body.Longitude, GeohashPrecision),
+		Radius:       body.Radius,
+		MinOpenSlots: body.MinOpenSlots,
+		Keywords:     body.Keywords,
+		CreateTime:   time.Unix(time.Now().Unix(), 0),
+	}
+	if _, err = store.SavedSearches().Create(c, &search); err != nil {
+		c.Errorf("%s in storing saved search %+v", err, search)
+		r = http.StatusInternalServerError
+		return
+	}
+	if search.Keywords == nil {
+		search.Keywords = []string{}
+	}
+	c.Infof("User %s saved search %s", userKey, search.Id)
+}
+
+// GET ./saved-searches
+// The request user's saved searches in creation order
+// Success: 200 OK
+// Failure: 500 Internal Server Error
+func listSavedSearches(rw http.ResponseWriter, req *http.Request) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("ListSavedSearches()")
+	// Result
+	r := http.StatusOK
+	// Error detail
+	var e *ApiError
+	// Saved searches
+	var searches []SavedSearch
+
+	defer func() {
+		if r == http.StatusOK {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusOK)
+			if searches == nil {
+				searches = []SavedSearch{}
+			}
+			if err := json.NewEncoder(rw).Encode(searches); err != nil {
+				c.Errorf("%s in encoding saved searches", err)
+			}
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	userKey, _ := RequestUser(req)
+	var err error
+	if searches, err = store.SavedSearches().ListByUser(c, userKey); err != nil {
+		c.Errorf("%s in listing saved searches of user %s", err, userKey)
+		r = http.StatusInternalServerError
+		return
+	}
+	for i := range searches {
+		if searches[i].Keywords == nil {
+			searches[i].Keywords = []string{}
+		}
+	}
+}
+
+// DELETE ./saved-searches/xxx, xxx: Saved search key
+// Users delete only their own saved searches. Others' are reported not found.
+// Success: 204 No Content
+// Failure: 404 Not Found, 500 Internal Server Error
+func deleteSavedSearch(rw http.ResponseWriter, req *http.Request, params Params) {
+	// To access datastore and to log
+	c := newContext(req)
+	c.Debugf("DeleteSavedSearch()")
+	// Result
+	r := http.StatusNoContent
+	// Error detail
+	var e *ApiError
+	// Saved search key
+	var keyString string = params.Get("id")
+
+	// Set response
+	defer func() {
+		if r == http.StatusNoContent {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			writeError(rw, r, e)
+		}
+	}()
+
+	userKey, _ := RequestUser(req)
+	pSearch, err := store.SavedSearches().Get(c, keyString)
+	if err == nil && pSearch.UserKey != userKey {
+		c.Warningf("Saved search %s belongs to user %s instead of %s", keyString, pSearch.UserKey, userKey)
+		err = ErrNotFound
+	}
+	if err == nil {
+		err = store.SavedSearches().Delete(c, keyString)
+	}
+	if err == ErrNotFound || err == ErrInvalidId {
+		c.Warningf("%s in deleting saved search %s", err, keyString)
+		r = http.StatusNotFound
+		e = NewApiError(ErrCodeSavedSearchNotFound, "Saved search is not found")
+		return
+	} else if err != nil {
+		c.Errorf("%s in deleting saved search %s", err, keyString)
+		r = http.StatusInternalServerError
+		return
+	}
+	c.Infof("User %s deleted saved search %s", userKey, keyString)
+}
+
+// Count an alert against the user's rate limit in the user's own quota entity.
+// Return false if the user has got too many alerts in the window.
+func takeSearchAlert(c Context, userKey string, now time.Time) (ok bool, err error) {
+	err = store.RunInTransaction(c, func(tc Context) error {
+		ok = false
+		v, err1 := store.SearchAlertQuotas().Get(tc, userKey)
+		if err1 == ErrNotFound {
+			v, err1 = &SearchAlertQuota{}, nil
+		}
+		if err1 != nil {
+			return err1
+		}
+		if !now.Before(v.WindowStart.Add(SearchAlertWindow)) {
+			v.WindowStart = now
+			v.Count = 0
+		}
+		if v.Count >= MaxSearchAlertsPerWindow {
+			return nil
+		}
+		v.Count++
+		if err1 = store.SearchAlertQuotas().Put(tc, userKey, v); err1 != nil {
+			return err1
+		}
+		ok = true
+		return nil
+	})
+	return
+}
+
+// Send saved search alerts of a stored item outside the request. It's a task on APP Engine.
+var enqueueSearchAlerts func(c Context, itemId string) error = alertSavedSearchesInBackground
+
+func alertSavedSearchesInBackground(c Context, itemId string) error {
+	go alertSavedSearches(NewBackgroundLogContext("search-alerts "+itemId), itemId)
+	return nil
+}
+
+// Push a new item to users whose saved searches match it, once per user.
+// Return an error only if nobody is alerted yet so that a retry doesn't alert anyone twice.
+func alertSavedSearches(c Context, itemId string) error {
+	pItem, err := store.Items().Get(c, itemId)
+	if err == ErrNotFound || err == ErrInvalidId {
+		c.Infof("Item %s is gone before alerting saved searches", itemId)
+		return nil
+	} else if err != nil {
+		c.Errorf("%s in getting item %s to alert saved searches", err, itemId)
+		return err
+	}
+	// A saved search matches only if its center is within its radius from the item.
+	// Don't scan all searches where geohash cells are too small, e.g. near the poles.
+	var prefixes []string = geohashCover(pItem.Latitude, pItem.Longitude, MaxSavedSearchRadiusKm)
+	if prefixes == nil {
+		c.Warningf("No geohash cells cover %d km around item %s. Skip alerts.", MaxSavedSearchRadiusKm, itemId)
+		return nil
+	}
+	// The first matching search of each user
+	var matched map[string]*SavedSearch = make(map[string]*SavedSearch)
+	var users []string
+	for _, prefix := range prefixes {
+		searches, err := store.SavedSearches().FindByGeohashPrefix(c, prefix)
+		if err != nil {
+			c.Errorf("%s in finding saved searches with geohash prefix %s", err, prefix)
+			return err
+		}
+		for i := range searches {
+			pSearch := &searches[i]
+			if isItemOwner(pItem, pSearch.UserKey) || matched[pSearch.UserKey] != nil || !matchSavedSearch(pSearch, pItem) {
+				continue
+			}
+			matched[pSearch.UserKey] = pSearch
+			users = append(users, pSearch.UserKey)
+		}
+	}
+
+	var now time.Time = time.Unix(time.Now().Unix(), 0)
+	for _, userKey := range users {
+		pSearch := matched[userKey]
+		ok, err := takeSearchAlert(c, userKey, now)
+		if err != nil {
+			c.Errorf("%s in counting alerts of user %s", err, userKey)
+			continue
+		}
+		if !ok {
+			c.Infof("User %s got too many alerts. Skip saved search %s.", userKey, pSearch.Id)
+			continue
+		}
+		pUser, err := store.Users().Get(c, userKey)
+		if err != nil {
+			c.Errorf("%s in getting user %s to alert", err, userKey)
+			continue
+		}
+		var data map[string]string = map[string]string{
+			"message":  "New item matches your saved search. ",
+			"itemid":   itemId,
+			"searchid": pSearch.Id,
+		}
+		if err = notifier.SendToToken(c, pUser.RegistrationToken, data); err != nil {
+			c.Warningf("%s in alerting user %s of item %s", err, userKey, itemId)
+			continue
+		}
+		c.Infof("User %s is alerted of item %s by saved search %s", userKey, itemId, pSearch.Id)
+	}
+	return nil
+}
+
+// POST ./tasks/search-alerts/xxx, xxx: Item key
+// Alert saved searches of a new item. Only task queues can call it, and they retry on failures.
+func searchAlertTask(rw http.ResponseWriter, req *http.Request, params Params) {
+	// Appengine
+	var c Context = newContext(req)
+	// Result
+	var r int = http.StatusOK
+
+	defer func() {
+		if r == http.StatusOK {
+			rw.WriteHeader(r)
+		} else {
+			writeError(rw, r, nil)
+		}
+	}()
+
+	if req.Header.Get(HttpHeaderAppengineQueueName) == "" {
+		c.Warningf("Request is not from a task queue. Ignore.")
+		r = http.StatusForbidden
+		return
+	}
+	if err := alertSavedSearches(c, params.Get("id")); err != nil {
+		r = http.StatusInternalServerError
+	}
+}
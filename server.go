@@ -1,85 +1,97 @@
 package aliza
 
 import (
-	"appengine"
 	"net/http"
 )
 
 const BaseUrl = "/api/0.1/"
 
-func init() {
-	http.HandleFunc(BaseUrl, rootPage)
-	http.HandleFunc(BaseUrl+"queryAll", queryAllItem)
-	http.HandleFunc(BaseUrl+"storeImage", storeImage)
-	http.HandleFunc(BaseUrl+"deleteAll", deleteAllItem)
-	http.HandleFunc(BaseUrl+"images", images)
-	http.HandleFunc(BaseUrl+"items", items)
-	http.HandleFunc(BaseUrl+"items/", items)
-	http.HandleFunc(BaseUrl+"myself", UpdateMyself)  // PUT
-	http.HandleFunc(BaseUrl+"groups", groups)  // PUT
-	http.HandleFunc(BaseUrl+"groups/", groups)  // DELETE
-	http.HandleFunc(BaseUrl+"user-messages", SendUserMessage)  // POST
-	http.HandleFunc(BaseUrl+"topic-messages", SendTopicMessage)  // POST
-	http.HandleFunc(BaseUrl+"group-messages", SendGroupMessage)  // POST
+// Register API handlers on a mux. On APP Engine they are registered on http.DefaultServeMux.
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle(BaseUrl, NewApiRouter())
 }
 
+// Routes of the API relative to BaseUrl
+func NewApiRouter() *Router {
+	r := NewRouter(BaseUrl)
+	r.Use(RequestIdMiddleware, AccessLogMiddleware, RecoverMiddleware)
+	r.HandleFunc("GET", "/", rootPage)
+	// Legacy routes
+	r.Handle("GET", "/queryAll", authenticated(queryAllItem))
+	r.Handle("POST", "/storeImage", authenticated(storeImage))
+	// Images
+	r.Handle("POST", "/images", authenticated(storeImage))
+	// Items
+	r.Handle("GET", "/items", authenticated(queryItem))
+	r.Handle("POST", "/items", idempotent(withoutParams(storeItem)))
+	r.Handle("GET", "/items/{id}", AuthenticateMiddleware(queryOneItem))
+	r.Handle("PUT", "/items/{id}", idempotent(updateItem))
+	r.Handle("DELETE", "/items/{id}", idempotent(deleteOneItem))
+	r.Handle("POST", "/items/{id}/restore", idempotent(restoreItem))
+	r.Handle("PUT", "/items/{id}/status", idempotent(updateItemStatus))
+	r.Handle("PUT", "/items/{id}/owner", idempotent(updateItemOwner))
+	r.Handle("PUT", "/items/{id}/waitlist", idempotent(joinItemWaitlist))
+	r.Handle("DELETE", "/items/{id}/waitlist", idempotent(leaveItemWaitlist))
+	r.Handle("DELETE", "/items/{id}/members/{userkey}", idempotent(removeItemMember))
+	r.Handle("DELETE", "/items/{id}/bans/{userkey}", idempotent(unbanItemMember))
+	r.Handle("PUT", "/items/{id}/contact", idempotent(updateItemContact))
+	r.Handle("GET", "/items/{id}/events", AuthenticateMiddleware(listItemEvents))
+	r.Handle("POST", "/items/{id}/comments", idempotent(storeItemComment))
+	r.Handle("GET", "/items/{id}/comments", AuthenticateMiddleware(listItemComments))
+	r.Handle("DELETE", "/items/{id}/comments/{commentid}", idempotent(deleteItemComment))
+	// Saved searches
+	r.Handle("POST", "/saved-searches", idempotent(withoutParams(storeSavedSearch)))
+	r.Handle("GET", "/saved-searches", authenticated(listSavedSearches))
+	r.Handle("DELETE", "/saved-searches/{id}", idempotent(deleteSavedSearch))
+	// Users. Registration is verified by Google Instance ID service instead.
+	r.HandleFunc("PUT", "/myself", UpdateMyself)
+	// Groups
+	r.Handle("PUT", "/groups", authenticated(JoinGroup))
+	r.Handle("DELETE", "/groups/{name}", AuthenticateMiddleware(LeaveGroup))
+	// Messages
+	r.Handle("POST", "/user-messages", authenticated(SendUserMessage))
+	r.Handle("POST", "/topic-messages", authenticated(SendTopicMessage))
+	r.Handle("POST", "/group-messages", authenticated(SendGroupMessage))
+	// Administration
+	r.Handle("POST", "/admin/item-deletions", admin(deleteItems))
+	r.Handle("GET", "/admin/item-deletions/{id}", admin(queryItemDeletion))
+	// Cron jobs and tasks. Only APP Engine keeps external requests away from them.
+	// Other servers sweep and run tasks by themselves.
+	if cronTasksEnabled {
+		r.HandleFunc("GET", "/tasks/expire-items", expireItemsTask)
+		r.Handle("POST", "/tasks/item-deletions/{id}", itemDeletionTask)
+		r.Handle("POST", "/tasks/search-alerts/{id}", searchAlertTask)
+	}
+	return r
+}
+
+// Whether to serve cron jobs and tasks. Set on APP Engine, which removes X-Appengine-Cron and
+// X-Appengine-Queuename from external requests.
+var cronTasksEnabled bool
+
 func rootPage(rw http.ResponseWriter, req *http.Request) {
-	c := appengine.NewContext(req)
+	c := newContext(req)
 	c.Debugf("This is root")
 }
 
-func images(rw http.ResponseWriter, req *http.Request) {
-	// Authenticate request
-	if isValid := VerifyRequest(req); isValid == false {
-		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return
-	}
-
-	switch req.Method {
-	// case "GET":
-		// queryImage(rw, req)
-	case "POST":
-		storeImage(rw, req)
-	// case "DELETE":
-	// 	deleteImage(rw, req)
-	default:
-		// queryAllImage(rw, req)
-	}
+// Wrap a handler without path parameters with AuthenticateMiddleware
+func authenticated(f http.HandlerFunc) HandlerFunc {
+	return AuthenticateMiddleware(withoutParams(f))
 }
 
-func items(rw http.ResponseWriter, req *http.Request) {
-	// Authenticate request
-	if isValid := VerifyRequest(req); isValid == false {
-		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return
-	}
+// Wrap a handler which modifies items with AuthenticateMiddleware and IdempotencyMiddleware
+func idempotent(h HandlerFunc) HandlerFunc {
+	return AuthenticateMiddleware(IdempotencyMiddleware(h))
+}
 
-	// Check HTTP method
-	switch req.Method {
-	case "GET":
-		queryItem(rw, req)
-	case "POST":
-		storeItem(rw, req)
-	case "PUT":
-		updateItem(rw, req)
-	case "DELETE":
-		deleteItem(rw, req)
-	default:
-		queryAllItem(rw, req)
-	}
+// Wrap a handler which only administrators can call
+func admin(h HandlerFunc) HandlerFunc {
+	return AuthenticateMiddleware(AdminMiddleware(h))
 }
 
-func groups(rw http.ResponseWriter, req *http.Request) {
-	switch req.Method {
-	//	case "GET":
-	//		listMember(rw, req)
-	//	case "POST":
-	//		SendMessage(rw, req)
-	case "PUT":
-		JoinGroup(rw, req)
-	case "DELETE":
-		LeaveGroup(rw, req)
-	default:
-		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+// Adapt a handler without path parameters
+func withoutParams(f http.HandlerFunc) HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request, params Params) {
+		f(rw, req)
 	}
 }
@@ -0,0 +1,55 @@
+//go:build appengine
+// +build appengine
+
+package aliza
+
+import (
+	"appengine"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+	"net/http"
+)
+
+// On APP Engine, use its services and serve on http.DefaultServeMux
+// Panic on invalid configuration so that broken deployments fail fast.
+func init() {
+	cfg, err := LoadConfig(ConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	SetConfig(cfg)
+	n, err := NewFcmNotifierFromConfig(cfg)
+	if err != nil {
+		panic(err)
+	}
+	notifier = n
+
+	newContext = func(req *http.Request) Context {
+		// APP Engine only knows the request it passed to the APP
+		return appengine.NewContext(OriginalRequest(req))
+	}
+	httpClient = urlfetchClient
+	store = NewDatastoreStore()
+	blobStore = NewGcsBlobStore("")
+	cronTasksEnabled = true
+	enqueueItemDeletion = enqueueItemDeletionTask
+	enqueueSearchAlerts = enqueueSearchAlertTask
+	RegisterHandlers(http.DefaultServeMux)
+}
+
+// Queue a task to run the next batch of an item deletion job on the default queue
+func enqueueItemDeletionTask(c Context, jobId string) error {
+	_, err := taskqueue.Add(appengineContext(c), taskqueue.NewPOSTTask(BaseUrl+"tasks/item-deletions/"+jobId, nil), "")
+	return err
+}
+
+// Queue a task to alert saved searches of a new item on the default queue
+func enqueueSearchAlertTask(c Context, itemId string) error {
+	_, err := taskqueue.Add(appengineContext(c), taskqueue.NewPOSTTask(BaseUrl+"tasks/search-alerts/"+itemId, nil), "")
+	return err
+}
+
+// HTTP client on APP Engine URL fetch service
+func urlfetchClient(c Context) *http.Client {
+	return urlfetch.Client(appengineContext(c))
+}
@@ -0,0 +1,192 @@
+package aliza
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors returned by repositories
+var (
+	// The entity with the given ID doesn't exist
+	ErrNotFound = errors.New("Entity not found")
+	// The ID is malformed so that it can't be decoded by the repository
+	ErrInvalidId = errors.New("Invalid entity ID")
+	// The transaction collided with another one. Retry later.
+	ErrConcurrentTransaction = errors.New("Concurrent transaction")
+	// A transaction is run inside another one, which datastore doesn't support
+	ErrNestedTransaction = errors.New("Nested transaction")
+	// The cursor is malformed or belongs to another query
+	ErrInvalidCursor = errors.New("Invalid cursor")
+)
+
+// A filter on an item property, e.g. {"People", "=", 3}.
+// Operators are "=", "<", "<=", ">", ">=".
+type ItemFilter struct {
+	Property string
+	Operator string
+	Value    interface{}
+}
+
+// An item query. Order is a property name, prefixed with "-" for descending order.
+// Limit is the max number of items to return. 0 means no limit.
+// Cursor is an opaque string returned by a previous query to continue from where it stopped.
+type ItemQuery struct {
+	Filters []ItemFilter
+	Order   string
+	Limit   int
+	Cursor  string
+}
+
+// Repository of items. IDs are opaque strings which are also used as Item.Id.
+type ItemStore interface {
+	// Get returns ErrNotFound if the item doesn't exist
+	Get(c Context, id string) (*Item, error)
+	// Query returns items with Item.Id set, and the cursor of the next page which is "" after the last page.
+	// It returns ErrInvalidCursor if the cursor can't be decoded.
+	Query(c Context, q ItemQuery) ([]Item, string, error)
+	// Create stores a new item at version 1 and returns its ID
+	Create(c Context, item *Item) (string, error)
+	// Update overwrites an existing item and increments item.Version.
+	// It returns ErrNotFound if the item doesn't exist.
+	Update(c Context, id string, item *Item) error
+	// Delete returns ErrNotFound if the item doesn't exist
+	Delete(c Context, id string) error
+	// Count returns the number of all items without reading them
+	Count(c Context) (int, error)
+}
+
+// Repository of users
+type UserStore interface {
+	// Get returns ErrNotFound if the user doesn't exist
+	Get(c Context, id string) (*User, error)
+	// FindByInstanceId returns an empty ID and a nil user if the user doesn't exist
+	FindByInstanceId(c Context, instanceId string) (string, *User, error)
+	Create(c Context, user *User) (string, error)
+	Update(c Context, id string, user *User) error
+}
+
+// Repository of groups
+type GroupStore interface {
+	// FindByName returns an empty ID and a nil group if the group doesn't exist
+	FindByName(c Context, name string) (string, *Group, error)
+	Create(c Context, group *Group) (string, error)
+	Update(c Context, id string, group *Group) error
+	Delete(c Context, id string) error
+}
+
+// Repository of item events. Events are immutable and belong to an item.
+type ItemEventStore interface {
+	// Create appends an event to the item and returns its ID. Event.Id is set too.
+	Create(c Context, itemId string, event *ItemEvent) (string, error)
+	// List returns events of the item in time order with Id set, and the cursor of the next page
+	// which is "" after the last page. It returns ErrInvalidCursor if the cursor can't be decoded.
+	List(c Context, itemId string, cursor string, limit int) ([]ItemEvent, string, error)
+}
+
+// Repository of item comments. Comments belong to an item.
+type ItemCommentStore interface {
+	// Get returns ErrNotFound if the comment doesn't exist in the item
+	Get(c Context, itemId string, id string) (*ItemComment, error)
+	// List returns comments of the item in time order with Id set, and the cursor of the next page
+	// which is "" after the last page. It returns ErrInvalidCursor if the cursor can't be decoded.
+	List(c Context, itemId string, cursor string, limit int) ([]ItemComment, string, error)
+	// Create adds a comment to the item and returns its ID. Comment.Id is set too.
+	Create(c Context, itemId string, comment *ItemComment) (string, error)
+	// Delete returns ErrNotFound if the comment doesn't exist in the item
+	Delete(c Context, itemId string, id string) error
+}
+
+// Repository of soft deleted items. They keep their item IDs, events and comments until they are purged.
+type DeletedItemStore interface {
+	// Get returns ErrNotFound if the item isn't deleted
+	Get(c Context, id string) (*DeletedItem, error)
+	// Create keeps an item which is deleted from the items
+	Create(c Context, id string, item *DeletedItem) error
+	// Restore moves a deleted item back to the items and increments item.Version.
+	// It returns ErrNotFound if the item isn't deleted or purging has started.
+	Restore(c Context, id string, item *Item) error
+	// Purge deletes a deleted item with its events and comments for good, never the item itself.
+	// It returns ErrNotFound if the item isn't deleted, e.g. it's restored.
+	Purge(c Context, id string) error
+	// Expired returns at most limit items deleted before the time, oldest first, with Item.Id set
+	Expired(c Context, before time.Time, limit int) ([]DeletedItem, error)
+	// FindByBlob returns at most limit deleted items whose image or thumbnail is the URL with Item.Id set
+	FindByBlob(c Context, blobUrl string, limit int) ([]DeletedItem, error)
+}
+
+// Repository of saved searches
+type SavedSearchStore interface {
+	// Get returns ErrNotFound if the saved search doesn't exist
+	Get(c Context, id string) (*SavedSearch, error)
+	// ListByUser returns the saved searches of a user in creation order with Id set
+	ListByUser(c Context, userKey string) ([]SavedSearch, error)
+	// FindByGeohashPrefix returns saved searches whose center geohashes start with the prefix with Id set
+	FindByGeohashPrefix(c Context, prefix string) ([]SavedSearch, error)
+	// Create stores a new saved search and returns its ID. SavedSearch.Id is set too.
+	Create(c Context, search *SavedSearch) (string, error)
+	// Delete returns ErrNotFound if the saved search doesn't exist
+	Delete(c Context, id string) error
+}
+
+// Repository of saved search alert quotas. Keys are user keys.
+type SearchAlertQuotaStore interface {
+	// Get returns ErrNotFound if the user has never been alerted
+	Get(c Context, userKey string) (*SearchAlertQuota, error)
+	// Put creates or overwrites the quota of a user
+	Put(c Context, userKey string, quota *SearchAlertQuota) error
+}
+
+// Repository of item backfill progress. Keys are names of passes.
+type ItemBackfillStore interface {
+	// Get returns ErrNotFound if the pass hasn't started
+	Get(c Context, name string) (*ItemBackfill, error)
+	// Put creates or overwrites the progress of a pass
+	Put(c Context, name string, backfill *ItemBackfill) error
+}
+
+// Repository of bulk item deletion jobs
+type ItemDeletionJobStore interface {
+	// Get returns ErrNotFound if the job doesn't exist
+	Get(c Context, id string) (*ItemDeletionJob, error)
+	// Create stores a new job and returns its ID. ItemDeletionJob.Id is set too.
+	Create(c Context, job *ItemDeletionJob) (string, error)
+	Update(c Context, id string, job *ItemDeletionJob) error
+}
+
+// Repository of idempotency records. Keys are chosen by callers.
+type IdempotencyStore interface {
+	// Get returns ErrNotFound if the record doesn't exist or expired before now
+	Get(c Context, key string, now time.Time) (*IdempotencyRecord, error)
+	// Put creates or overwrites a record
+	Put(c Context, key string, record *IdempotencyRecord) error
+	Delete(c Context, key string) error
+	// DeleteExpired deletes records which expired before now and returns the number of them
+	DeleteExpired(c Context, now time.Time) (int, error)
+}
+
+// A storage backend which holds all repositories
+type Store interface {
+	Items() ItemStore
+	Users() UserStore
+	Groups() GroupStore
+	ItemEvents() ItemEventStore
+	ItemComments() ItemCommentStore
+	DeletedItems() DeletedItemStore
+	SavedSearches() SavedSearchStore
+	SearchAlertQuotas() SearchAlertQuotaStore
+	ItemDeletionJobs() ItemDeletionJobStore
+	ItemBackfills() ItemBackfillStore
+	Idempotency() IdempotencyStore
+	// RunInTransaction runs f in a transaction. Repositories must be accessed with tc inside f.
+	// Transactions can't be nested.
+	// Changes are discarded if f returns an error.
+	RunInTransaction(c Context, f func(tc Context) error) error
+}
+
+// The storage backend used by all handlers. It's datastore on APP Engine.
+var store Store = NewMemoryStore()
+
+// Replace the storage backend. Call it before serving requests.
+func SetStore(s Store) {
+	store = s
+}
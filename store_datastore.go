@@ -0,0 +1,805 @@
+//go:build appengine
+// +build appengine
+
+package aliza
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Storage backend on Google APP Engine datastore. Requires an appengine.Context.
+type datastoreStore struct {
+	items       datastoreItemStore
+	users       datastoreUserStore
+	groups      datastoreGroupStore
+	events      datastoreItemEventStore
+	comments    datastoreItemCommentStore
+	deleted     datastoreDeletedItemStore
+	searches    datastoreSavedSearchStore
+	quotas      datastoreSearchAlertQuotaStore
+	deletions   datastoreItemDeletionJobStore
+	backfills   datastoreItemBackfillStore
+	idempotency datastoreIdempotencyStore
+}
+
+type datastoreItemStore struct{}
+type datastoreUserStore struct{}
+type datastoreGroupStore struct{}
+type datastoreItemEventStore struct{}
+type datastoreItemCommentStore struct{}
+type datastoreDeletedItemStore struct{}
+type datastoreSavedSearchStore struct{}
+type datastoreSearchAlertQuotaStore struct{}
+type datastoreItemDeletionJobStore struct{}
+type datastoreItemBackfillStore struct{}
+type datastoreIdempotencyStore struct{}
+
+func NewDatastoreStore() Store {
+	return &datastoreStore{}
+}
+
+func (s *datastoreStore) Items() ItemStore {
+	return &s.items
+}
+
+func (s *datastoreStore) Users() UserStore {
+	return &s.users
+}
+
+func (s *datastoreStore) Groups() GroupStore {
+	return &s.groups
+}
+
+func (s *datastoreStore) ItemEvents() ItemEventStore {
+	return &s.events
+}
+
+func (s *datastoreStore) ItemComments() ItemCommentStore {
+	return &s.comments
+}
+
+func (s *datastoreStore) DeletedItems() DeletedItemStore {
+	return &s.deleted
+}
+
+func (s *datastoreStore) SavedSearches() SavedSearchStore {
+	return &s.searches
+}
+
+func (s *datastoreStore) SearchAlertQuotas() SearchAlertQuotaStore {
+	return &s.quotas
+}
+
+func (s *datastoreStore) ItemDeletionJobs() ItemDeletionJobStore {
+	return &s.deletions
+}
+
+func (s *datastoreStore) ItemBackfills() ItemBackfillStore {
+	return &s.backfills
+}
+
+func (s *datastoreStore) Idempotency() IdempotencyStore {
+	return &s.idempotency
+}
+
+func (s *datastoreStore) RunInTransaction(c Context, f func(tc Context) error) error {
+	err := datastore.RunInTransaction(appengineContext(c), func(tc appengine.Context) error {
+		return f(tc)
+	}, nil)
+	if err == datastore.ErrConcurrentTransaction {
+		return ErrConcurrentTransaction
+	}
+	return err
+}
+
+// Get the APP Engine context underneath
+func appengineContext(c Context) appengine.Context {
+	ac, ok := c.(appengine.Context)
+	if !ok {
+		panic("datastore backend requires an appengine.Context")
+	}
+	return ac
+}
+
+// Decode a key string and check its kind
+func decodeKey(id string, kind string) (key *datastore.Key, err error) {
+	if key, err = datastore.DecodeKey(id); err != nil || key.Kind() != kind {
+		return nil, ErrInvalidId
+	}
+	return
+}
+
+// Map datastore errors to repository errors
+func datastoreError(err error) error {
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *datastoreItemStore) Get(c Context, id string) (*Item, error) {
+	var item Item
+	key, err := decodeKey(id, ItemKind)
+	if err != nil {
+		return nil, err
+	}
+	if err = datastore.Get(appengineContext(c), key, &item); err != nil {
+		return nil, datastoreError(err)
+	}
+	item.Id = id
+	return &item, nil
+}
+
+func (s *datastoreItemStore) Query(c Context, q ItemQuery) ([]Item, string, error) {
+	var dst []Item
+	f := datastore.NewQuery(ItemKind)
+	for _, v := range q.Filters {
+		f = f.Filter(v.Property+v.Operator, v.Value)
+	}
+	if q.Order != "" {
+		f = f.Order(q.Order)
+	}
+	if q.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		f = f.Start(cursor)
+	}
+	if q.Limit > 0 {
+		// Get one more item to know whether there is a next page
+		f = f.Limit(q.Limit + 1)
+	}
+
+	var cursor datastore.Cursor
+	it := f.Run(appengineContext(c))
+	for {
+		var item Item
+		key, err := it.Next(&item)
+		if err == datastore.Done {
+			return dst, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if q.Limit > 0 && len(dst) == q.Limit {
+			// There is a next page. Continue after the last returned item.
+			return dst, cursor.String(), nil
+		}
+		item.Id = key.Encode()
+		dst = append(dst, item)
+		if q.Limit > 0 && len(dst) == q.Limit {
+			if cursor, err = it.Cursor(); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+}
+
+// Count keys only so that items aren't read
+func (s *datastoreItemStore) Count(c Context) (int, error) {
+	return datastore.NewQuery(ItemKind).KeysOnly().Count(appengineContext(c))
+}
+
+func (s *datastoreItemStore) Create(c Context, item *Item) (string, error) {
+	ac := appengineContext(c)
+	pKey := datastore.NewKey(ac, ItemKind, ItemRoot, 0, nil)
+	item.Version = 1
+	cKey, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, ItemKind, pKey), item)
+	if err != nil {
+		return "", err
+	}
+	return cKey.Encode(), nil
+}
+
+func (s *datastoreItemStore) Update(c Context, id string, item *Item) error {
+	ac := appengineContext(c)
+	key, err := decodeKey(id, ItemKind)
+	if err != nil {
+		return err
+	}
+	// datastore.Put() would create a deleted item again
+	var old Item
+	if err = datastore.Get(ac, key, &old); err != nil {
+		return datastoreError(err)
+	}
+	item.Version++
+	_, err = datastore.Put(ac, key, item)
+	return err
+}
+
+func (s *datastoreItemStore) Delete(c Context, id string) error {
+	ac := appengineContext(c)
+	key, err := decodeKey(id, ItemKind)
+	if err != nil {
+		return err
+	}
+	// datastore.Delete() doesn't complain about a non-existing entity
+	var item Item
+	if err = datastore.Get(ac, key, &item); err != nil {
+		return datastoreError(err)
+	}
+	return datastore.Delete(ac, key)
+}
+
+func (s *datastoreUserStore) Get(c Context, id string) (*User, error) {
+	var user User
+	key, err := decodeKey(id, UserKind)
+	if err != nil {
+		return nil, err
+	}
+	if err = datastore.Get(appengineContext(c), key, &user); err != nil {
+		return nil, datastoreError(err)
+	}
+	return &user, nil
+}
+
+func (s *datastoreUserStore) FindByInstanceId(c Context, instanceId string) (id string, user *User, err error) {
+	var v []User
+	f := datastore.NewQuery(UserKind).Filter("InstanceId=", instanceId)
+	k, err := f.GetAll(appengineContext(c), &v)
+	if err != nil {
+		c.Errorf("%s in getting data from datastore\n", err)
+		err = errors.New("Datastore is temporary unavailable")
+		return
+	}
+	if len(k) == 0 {
+		return
+	}
+	id = k[0].Encode()
+	user = &v[0]
+	return
+}
+
+func (s *datastoreUserStore) Create(c Context, user *User) (string, error) {
+	ac := appengineContext(c)
+	pKey := datastore.NewKey(ac, UserKind, UserRoot, 0, nil)
+	cKey, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, UserKind, pKey), user)
+	if err != nil {
+		return "", err
+	}
+	return cKey.Encode(), nil
+}
+
+func (s *datastoreUserStore) Update(c Context, id string, user *User) error {
+	key, err := decodeKey(id, UserKind)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(appengineContext(c), key, user)
+	return err
+}
+
+func (s *datastoreGroupStore) FindByName(c Context, name string) (id string, group *Group, err error) {
+	var v []Group
+	f := datastore.NewQuery(GroupKind).Filter("Name=", name)
+	k, err := f.GetAll(appengineContext(c), &v)
+	if err != nil {
+		c.Errorf("%s in getting data from datastore\n", err)
+		err = errors.New("Datastore is temporary unavailable")
+		return
+	}
+	if len(k) == 0 {
+		return
+	}
+	id = k[0].Encode()
+	group = &v[0]
+	return
+}
+
+func (s *datastoreGroupStore) Create(c Context, group *Group) (string, error) {
+	ac := appengineContext(c)
+	pKey := datastore.NewKey(ac, GroupKind, GroupRoot, 0, nil)
+	cKey, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, GroupKind, pKey), group)
+	if err != nil {
+		return "", err
+	}
+	return cKey.Encode(), nil
+}
+
+func (s *datastoreGroupStore) Update(c Context, id string, group *Group) error {
+	key, err := decodeKey(id, GroupKind)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(appengineContext(c), key, group)
+	return err
+}
+
+func (s *datastoreGroupStore) Delete(c Context, id string) error {
+	key, err := decodeKey(id, GroupKind)
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(appengineContext(c), key)
+}
+
+// Events are children of the item so that they are stored in the transactions of the item
+func (s *datastoreItemEventStore) Create(c Context, itemId string, event *ItemEvent) (string, error) {
+	ac := appengineContext(c)
+	pKey, err := decodeKey(itemId, ItemKind)
+	if err != nil {
+		return "", err
+	}
+	key, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, ItemEventKind, pKey), event)
+	if err != nil {
+		return "", err
+	}
+	event.Id = key.Encode()
+	return event.Id, nil
+}
+
+func (s *datastoreItemEventStore) List(c Context, itemId string, cursor string, limit int) ([]ItemEvent, string, error) {
+	ac := appengineContext(c)
+	pKey, err := decodeKey(itemId, ItemKind)
+	if err != nil {
+		return nil, "", err
+	}
+	f := datastore.NewQuery(ItemEventKind).Ancestor(pKey).Order("Time")
+	if cursor != "" {
+		v, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		f = f.Start(v)
+	}
+	if limit > 0 {
+		// Get one more event to know whether there is a next page
+		f = f.Limit(limit + 1)
+	}
+
+	var dst []ItemEvent
+	var next datastore.Cursor
+	it := f.Run(ac)
+	for {
+		var event ItemEvent
+		key, err := it.Next(&event)
+		if err == datastore.Done {
+			return dst, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if limit > 0 && len(dst) == limit {
+			// There is a next page. Continue after the last returned event.
+			return dst, next.String(), nil
+		}
+		event.Id = key.Encode()
+		dst = append(dst, event)
+		if limit > 0 && len(dst) == limit {
+			if next, err = it.Cursor(); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+}
+
+// Decode a comment key and check it belongs to the item
+func decodeCommentKey(itemId string, id string) (*datastore.Key, error) {
+	pKey, err := decodeKey(itemId, ItemKind)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(id, ItemCommentKind)
+	if err != nil {
+		return nil, err
+	}
+	if !key.Parent().Equal(pKey) {
+		return nil, ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *datastoreItemCommentStore) Get(c Context, itemId string, id string) (*ItemComment, error) {
+	key, err := decodeCommentKey(itemId, id)
+	if err != nil {
+		return nil, err
+	}
+	var comment ItemComment
+	if err = datastore.Get(appengineContext(c), key, &comment); err != nil {
+		return nil, datastoreError(err)
+	}
+	comment.Id = id
+	return &comment, nil
+}
+
+func (s *datastoreItemCommentStore) List(c Context, itemId string, cursor string, limit int) ([]ItemComment, string, error) {
+	ac := appengineContext(c)
+	pKey, err := decodeKey(itemId, ItemKind)
+	if err != nil {
+		return nil, "", err
+	}
+	f := datastore.NewQuery(ItemCommentKind).Ancestor(pKey).Order("CreateTime")
+	if cursor != "" {
+		v, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		f = f.Start(v)
+	}
+	if limit > 0 {
+		// Get one more comment to know whether there is a next page
+		f = f.Limit(limit + 1)
+	}
+
+	var dst []ItemComment
+	var next datastore.Cursor
+	it := f.Run(ac)
+	for {
+		var comment ItemComment
+		key, err := it.Next(&comment)
+		if err == datastore.Done {
+			return dst, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if limit > 0 && len(dst) == limit {
+			// There is a next page. Continue after the last returned comment.
+			return dst, next.String(), nil
+		}
+		comment.Id = key.Encode()
+		dst = append(dst, comment)
+		if limit > 0 && len(dst) == limit {
+			if next, err = it.Cursor(); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+}
+
+// Comments are children of the item like events
+func (s *datastoreItemCommentStore) Create(c Context, itemId string, comment *ItemComment) (string, error) {
+	ac := appengineContext(c)
+	pKey, err := decodeKey(itemId, ItemKind)
+	if err != nil {
+		return "", err
+	}
+	key, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, ItemCommentKind, pKey), comment)
+	if err != nil {
+		return "", err
+	}
+	comment.Id = key.Encode()
+	return comment.Id, nil
+}
+
+func (s *datastoreItemCommentStore) Delete(c Context, itemId string, id string) error {
+	ac := appengineContext(c)
+	key, err := decodeCommentKey(itemId, id)
+	if err != nil {
+		return err
+	}
+	// datastore.Delete() doesn't complain about a non-existing entity
+	var comment ItemComment
+	if err = datastore.Get(ac, key, &comment); err != nil {
+		return datastoreError(err)
+	}
+	return datastore.Delete(ac, key)
+}
+
+// Deleted items are kept beside the items in the same entity group with the same IDs,
+// so that their events and comments stay under the item keys
+func deletedItemKey(ac appengine.Context, id string) (*datastore.Key, *datastore.Key, error) {
+	key, err := decodeKey(id, ItemKind)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, datastore.NewKey(ac, DeletedItemKind, "", key.IntID(), key.Parent()), nil
+}
+
+func (s *datastoreDeletedItemStore) Get(c Context, id string) (*DeletedItem, error) {
+	ac := appengineContext(c)
+	_, dKey, err := deletedItemKey(ac, id)
+	if err != nil {
+		return nil, err
+	}
+	var item DeletedItem
+	if err = datastore.Get(ac, dKey, &item); err != nil {
+		return nil, datastoreError(err)
+	}
+	item.Item.Id = id
+	return &item, nil
+}
+
+func (s *datastoreDeletedItemStore) Create(c Context, id string, item *DeletedItem) error {
+	ac := appengineContext(c)
+	_, dKey, err := deletedItemKey(ac, id)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(ac, dKey, item)
+	return err
+}
+
+func (s *datastoreDeletedItemStore) Restore(c Context, id string, item *Item) error {
+	ac := appengineContext(c)
+	key, dKey, err := deletedItemKey(ac, id)
+	if err != nil {
+		return err
+	}
+	var deleted DeletedItem
+	if err = datastore.Get(ac, dKey, &deleted); err != nil {
+		return datastoreError(err)
+	}
+	if deleted.Purging {
+		return ErrNotFound
+	}
+	item.Version++
+	if _, err = datastore.Put(ac, key, item); err != nil {
+		return err
+	}
+	return datastore.Delete(ac, dKey)
+}
+
+// Datastore writes at most 500 entities in a transaction
+const purgeBatchSize = 500
+
+// Purge in transactions on the item's entity group so that restoring can't interleave. Each transaction
+// checks the item is still deleted and deletes a batch of its events and comments. The deleted item is
+// marked purging after the first batch so that it can't be restored with part of its history, and it's
+// deleted along with the last batch. A purge which stops halfway is resumed by the next sweep.
+func (s *datastoreDeletedItemStore) Purge(c Context, id string) error {
+	ac := appengineContext(c)
+	key, dKey, err := deletedItemKey(ac, id)
+	if err != nil {
+		return err
+	}
+	for {
+		var finished bool
+		err = datastore.RunInTransaction(ac, func(tc appengine.Context) error {
+			var deleted DeletedItem
+			if err1 := datastore.Get(tc, dKey, &deleted); err1 != nil {
+				return datastoreError(err1)
+			}
+			var item Item
+			if err1 := datastore.Get(tc, key, &item); err1 == nil {
+				// Restored in between
+				return ErrNotFound
+			} else if err1 != datastore.ErrNoSuchEntity {
+				return err1
+			}
+
+			// Only events and comments are under the item key once the item is gone
+			var keys []*datastore.Key
+			for _, kind := range []string{ItemEventKind, ItemCommentKind} {
+				v, err1 := datastore.NewQuery(kind).Ancestor(key).KeysOnly().Limit(purgeBatchSize-1-len(keys)).GetAll(tc, nil)
+				if err1 != nil {
+					return err1
+				}
+				keys = append(keys, v...)
+			}
+			if len(keys) < purgeBatchSize-1 {
+				finished = true
+				keys = append(keys, dKey)
+			} else if !deleted.Purging {
+				deleted.Purging = true
+				if _, err1 := datastore.Put(tc, dKey, &deleted); err1 != nil {
+					return err1
+				}
+			}
+			return datastore.DeleteMulti(tc, keys)
+		}, nil)
+		if err != nil || finished {
+			return err
+		}
+	}
+}
+
+func (s *datastoreDeletedItemStore) Expired(c Context, before time.Time, limit int) ([]DeletedItem, error) {
+	ac := appengineContext(c)
+	f := datastore.NewQuery(DeletedItemKind).Filter("DeleteTime <", before).Order("DeleteTime")
+	if limit > 0 {
+		f = f.Limit(limit)
+	}
+	var dst []DeletedItem
+	keys, err := f.GetAll(ac, &dst)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range keys {
+		dst[i].Item.Id = datastore.NewKey(ac, ItemKind, "", v.IntID(), v.Parent()).Encode()
+	}
+	return dst, nil
+}
+
+// Nested properties are indexed by their dotted names
+func (s *datastoreDeletedItemStore) FindByBlob(c Context, blobUrl string, limit int) ([]DeletedItem, error) {
+	ac := appengineContext(c)
+	var dst []DeletedItem
+	for _, property := range []string{"Item.Image", "Item.Thumbnail"} {
+		f := datastore.NewQuery(DeletedItemKind).Filter(property+" =", blobUrl)
+		if limit > 0 {
+			f = f.Limit(limit)
+		}
+		var v []DeletedItem
+		keys, err := f.GetAll(ac, &v)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			v[i].Item.Id = datastore.NewKey(ac, ItemKind, "", key.IntID(), key.Parent()).Encode()
+		}
+		dst = append(dst, v...)
+	}
+	if limit > 0 && len(dst) > limit {
+		dst = dst[:limit]
+	}
+	return dst, nil
+}
+
+func (s *datastoreSavedSearchStore) Get(c Context, id string) (*SavedSearch, error) {
+	key, err := decodeKey(id, SavedSearchKind)
+	if err != nil {
+		return nil, err
+	}
+	var search SavedSearch
+	if err = datastore.Get(appengineContext(c), key, &search); err != nil {
+		return nil, datastoreError(err)
+	}
+	search.Id = id
+	return &search, nil
+}
+
+// Run a saved search query and set IDs
+func getAllSavedSearches(ac appengine.Context, f *datastore.Query) ([]SavedSearch, error) {
+	var dst []SavedSearch
+	keys, err := f.GetAll(ac, &dst)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range keys {
+		dst[i].Id = v.Encode()
+	}
+	return dst, nil
+}
+
+func (s *datastoreSavedSearchStore) ListByUser(c Context, userKey string) ([]SavedSearch, error) {
+	// Sort here instead of the query so that no composite index is needed
+	dst, err := getAllSavedSearches(appengineContext(c), datastore.NewQuery(SavedSearchKind).Filter("UserKey =", userKey))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(dst, func(i, j int) bool {
+		return dst[i].CreateTime.Before(dst[j].CreateTime)
+	})
+	return dst, nil
+}
+
+func (s *datastoreSavedSearchStore) FindByGeohashPrefix(c Context, prefix string) ([]SavedSearch, error) {
+	f := datastore.NewQuery(SavedSearchKind)
+	if prefix != "" {
+		f = f.Filter("Geohash >=", prefix).Filter("Geohash <", prefix+"~")
+	}
+	return getAllSavedSearches(appengineContext(c), f)
+}
+
+// Saved searches are root entities
+func (s *datastoreSavedSearchStore) Create(c Context, search *SavedSearch) (string, error) {
+	ac := appengineContext(c)
+	key, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, SavedSearchKind, nil), search)
+	if err != nil {
+		return "", err
+	}
+	search.Id = key.Encode()
+	return search.Id, nil
+}
+
+func (s *datastoreSavedSearchStore) Delete(c Context, id string) error {
+	ac := appengineContext(c)
+	key, err := decodeKey(id, SavedSearchKind)
+	if err != nil {
+		return err
+	}
+	// datastore.Delete() doesn't complain about a non-existing entity
+	var search SavedSearch
+	if err = datastore.Get(ac, key, &search); err != nil {
+		return datastoreError(err)
+	}
+	return datastore.Delete(ac, key)
+}
+
+// Quotas are root entities named by user keys so that counting alerts doesn't contend with users
+func (s *datastoreSearchAlertQuotaStore) Get(c Context, userKey string) (*SearchAlertQuota, error) {
+	var quota SearchAlertQuota
+	ac := appengineContext(c)
+	if err := datastore.Get(ac, datastore.NewKey(ac, SearchAlertQuotaKind, userKey, 0, nil), &quota); err != nil {
+		return nil, datastoreError(err)
+	}
+	return &quota, nil
+}
+
+func (s *datastoreSearchAlertQuotaStore) Put(c Context, userKey string, quota *SearchAlertQuota) error {
+	ac := appengineContext(c)
+	_, err := datastore.Put(ac, datastore.NewKey(ac, SearchAlertQuotaKind, userKey, 0, nil), quota)
+	return err
+}
+
+func (s *datastoreItemDeletionJobStore) Get(c Context, id string) (*ItemDeletionJob, error) {
+	key, err := decodeKey(id, ItemDeletionJobKind)
+	if err != nil {
+		return nil, err
+	}
+	var job ItemDeletionJob
+	if err = datastore.Get(appengineContext(c), key, &job); err != nil {
+		return nil, datastoreError(err)
+	}
+	job.Id = id
+	return &job, nil
+}
+
+// Jobs are root entities so that updating them doesn't contend with items
+func (s *datastoreItemDeletionJobStore) Create(c Context, job *ItemDeletionJob) (string, error) {
+	ac := appengineContext(c)
+	key, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, ItemDeletionJobKind, nil), job)
+	if err != nil {
+		return "", err
+	}
+	job.Id = key.Encode()
+	return job.Id, nil
+}
+
+func (s *datastoreItemDeletionJobStore) Update(c Context, id string, job *ItemDeletionJob) error {
+	key, err := decodeKey(id, ItemDeletionJobKind)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(appengineContext(c), key, job)
+	return err
+}
+
+// Progress is kept in root entities named by passes
+func (s *datastoreItemBackfillStore) Get(c Context, name string) (*ItemBackfill, error) {
+	var backfill ItemBackfill
+	ac := appengineContext(c)
+	if err := datastore.Get(ac, datastore.NewKey(ac, ItemBackfillKind, name, 0, nil), &backfill); err != nil {
+		return nil, datastoreError(err)
+	}
+	return &backfill, nil
+}
+
+func (s *datastoreItemBackfillStore) Put(c Context, name string, backfill *ItemBackfill) error {
+	ac := appengineContext(c)
+	_, err := datastore.Put(ac, datastore.NewKey(ac, ItemBackfillKind, name, 0, nil), backfill)
+	return err
+}
+
+// Records are root entities named by their keys so that each one is its own entity group
+func (s *datastoreIdempotencyStore) Get(c Context, key string, now time.Time) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	ac := appengineContext(c)
+	if err := datastore.Get(ac, datastore.NewKey(ac, IdempotencyKind, key, 0, nil), &record); err != nil {
+		return nil, datastoreError(err)
+	}
+	if record.ExpireTime.Before(now) {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+func (s *datastoreIdempotencyStore) Put(c Context, key string, record *IdempotencyRecord) error {
+	ac := appengineContext(c)
+	_, err := datastore.Put(ac, datastore.NewKey(ac, IdempotencyKind, key, 0, nil), record)
+	return err
+}
+
+func (s *datastoreIdempotencyStore) Delete(c Context, key string) error {
+	ac := appengineContext(c)
+	return datastore.Delete(ac, datastore.NewKey(ac, IdempotencyKind, key, 0, nil))
+}
+
+// Delete at most a batch in a call. The rest are deleted next time.
+func (s *datastoreIdempotencyStore) DeleteExpired(c Context, now time.Time) (int, error) {
+	ac := appengineContext(c)
+	keys, err := datastore.NewQuery(IdempotencyKind).Filter("ExpireTime <", now).KeysOnly().Limit(500).GetAll(ac, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err = datastore.DeleteMulti(ac, keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,1076 @@
+package aliza
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage backend in memory. It's safe for concurrent use and supports transactions,
+// so that handlers can run without APP Engine, e.g. in tests.
+type memoryStore struct {
+	// Protects all data below. A transaction holds it until the transaction ends,
+	// so that nobody sees the changes before they are committed.
+	mu          sync.Mutex
+	// The last allocated ID
+	lastId      int64
+	items       map[string]Item
+	users       map[string]User
+	groups      map[string]Group
+	// Events of each item in time order
+	events      map[string][]ItemEvent
+	// Comments of each item in time order
+	comments    map[string][]ItemComment
+	deleted     map[string]DeletedItem
+	searches    map[string]SavedSearch
+	quotas      map[string]SearchAlertQuota
+	deletions   map[string]ItemDeletionJob
+	backfills   map[string]ItemBackfill
+	idempotency map[string]IdempotencyRecord
+}
+
+type memoryItemStore struct{ s *memoryStore }
+type memoryUserStore struct{ s *memoryStore }
+type memoryGroupStore struct{ s *memoryStore }
+type memoryItemEventStore struct{ s *memoryStore }
+type memoryItemCommentStore struct{ s *memoryStore }
+type memoryDeletedItemStore struct{ s *memoryStore }
+type memorySavedSearchStore struct{ s *memoryStore }
+type memorySearchAlertQuotaStore struct{ s *memoryStore }
+type memoryItemDeletionJobStore struct{ s *memoryStore }
+type memoryItemBackfillStore struct{ s *memoryStore }
+type memoryIdempotencyStore struct{ s *memoryStore }
+
+// A transaction records the original values of the entities it modifies
+// so that they can be restored when the transaction fails
+type memoryTransaction struct {
+	items       map[string]*Item
+	users       map[string]*User
+	groups      map[string]*Group
+	events      map[string][]ItemEvent
+	comments    map[string][]ItemComment
+	deleted     map[string]*DeletedItem
+	searches    map[string]*SavedSearch
+	quotas      map[string]*SearchAlertQuota
+	deletions   map[string]*ItemDeletionJob
+	backfills   map[string]*ItemBackfill
+	idempotency map[string]*IdempotencyRecord
+}
+
+// The context passed to a transaction function
+type memoryTransactionContext struct {
+	Context
+	tx *memoryTransaction
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		items:       make(map[string]Item),
+		users:       make(map[string]User),
+		groups:      make(map[string]Group),
+		events:      make(map[string][]ItemEvent),
+		comments:    make(map[string][]ItemComment),
+		deleted:     make(map[string]DeletedItem),
+		searches:    make(map[string]SavedSearch),
+		quotas:      make(map[string]SearchAlertQuota),
+		deletions:   make(map[string]ItemDeletionJob),
+		backfills:   make(map[string]ItemBackfill),
+		idempotency: make(map[string]IdempotencyRecord),
+	}
+}
+
+func (s *memoryStore) Items() ItemStore {
+	return memoryItemStore{s}
+}
+
+func (s *memoryStore) Users() UserStore {
+	return memoryUserStore{s}
+}
+
+func (s *memoryStore) Groups() GroupStore {
+	return memoryGroupStore{s}
+}
+
+func (s *memoryStore) ItemEvents() ItemEventStore {
+	return memoryItemEventStore{s}
+}
+
+func (s *memoryStore) ItemComments() ItemCommentStore {
+	return memoryItemCommentStore{s}
+}
+
+func (s *memoryStore) DeletedItems() DeletedItemStore {
+	return memoryDeletedItemStore{s}
+}
+
+func (s *memoryStore) SavedSearches() SavedSearchStore {
+	return memorySavedSearchStore{s}
+}
+
+func (s *memoryStore) SearchAlertQuotas() SearchAlertQuotaStore {
+	return memorySearchAlertQuotaStore{s}
+}
+
+func (s *memoryStore) ItemDeletionJobs() ItemDeletionJobStore {
+	return memoryItemDeletionJobStore{s}
+}
+
+func (s *memoryStore) ItemBackfills() ItemBackfillStore {
+	return memoryItemBackfillStore{s}
+}
+
+func (s *memoryStore) Idempotency() IdempotencyStore {
+	return memoryIdempotencyStore{s}
+}
+
+func (s *memoryStore) RunInTransaction(c Context, f func(tc Context) error) error {
+	if _, ok := c.(*memoryTransactionContext); ok {
+		// Datastore doesn't support nested transactions either
+		return ErrNestedTransaction
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTransaction{
+		items:       make(map[string]*Item),
+		users:       make(map[string]*User),
+		groups:      make(map[string]*Group),
+		events:      make(map[string][]ItemEvent),
+		comments:    make(map[string][]ItemComment),
+		deleted:     make(map[string]*DeletedItem),
+		searches:    make(map[string]*SavedSearch),
+		quotas:      make(map[string]*SearchAlertQuota),
+		deletions:   make(map[string]*ItemDeletionJob),
+		backfills:   make(map[string]*ItemBackfill),
+		idempotency: make(map[string]*IdempotencyRecord),
+	}
+	err := f(&memoryTransactionContext{Context: c, tx: tx})
+	if err != nil {
+		s.rollback(tx)
+	}
+	return err
+}
+
+// Restore the entities modified in the transaction. Caller must hold s.mu.
+func (s *memoryStore) rollback(tx *memoryTransaction) {
+	for id, v := range tx.items {
+		if v == nil {
+			delete(s.items, id)
+		} else {
+			s.items[id] = *v
+		}
+	}
+	for id, v := range tx.users {
+		if v == nil {
+			delete(s.users, id)
+		} else {
+			s.users[id] = *v
+		}
+	}
+	for id, v := range tx.groups {
+		if v == nil {
+			delete(s.groups, id)
+		} else {
+			s.groups[id] = *v
+		}
+	}
+	for id, v := range tx.events {
+		s.events[id] = v
+	}
+	for id, v := range tx.comments {
+		s.comments[id] = v
+	}
+	for id, v := range tx.deleted {
+		if v == nil {
+			delete(s.deleted, id)
+		} else {
+			s.deleted[id] = *v
+		}
+	}
+	for id, v := range tx.searches {
+		if v == nil {
+			delete(s.searches, id)
+		} else {
+			s.searches[id] = *v
+		}
+	}
+	for key, v := range tx.quotas {
+		if v == nil {
+			delete(s.quotas, key)
+		} else {
+			s.quotas[key] = *v
+		}
+	}
+	for id, v := range tx.deletions {
+		if v == nil {
+			delete(s.deletions, id)
+		} else {
+			s.deletions[id] = *v
+		}
+	}
+	for name, v := range tx.backfills {
+		if v == nil {
+			delete(s.backfills, name)
+		} else {
+			s.backfills[name] = *v
+		}
+	}
+	for key, v := range tx.idempotency {
+		if v == nil {
+			delete(s.idempotency, key)
+		} else {
+			s.idempotency[key] = *v
+		}
+	}
+}
+
+// Lock the data unless the context is in a transaction, which holds the lock already.
+// Return the function to unlock.
+func (s *memoryStore) lock(c Context) func() {
+	if memoryTransactionOf(c) != nil {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// Get the transaction of the context. Return nil if the context is not in a transaction.
+func memoryTransactionOf(c Context) *memoryTransaction {
+	if tc, ok := c.(*memoryTransactionContext); ok {
+		return tc.tx
+	}
+	return nil
+}
+
+// Allocate a new ID. Caller must hold s.mu.
+func (s *memoryStore) newId() string {
+	s.lastId++
+	return strconv.FormatInt(s.lastId, 10)
+}
+
+// Record the original item before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalItem(c Context, id string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.items[id]; ok {
+		return
+	}
+	if v, ok := s.items[id]; ok {
+		tx.items[id] = &v
+	} else {
+		tx.items[id] = nil
+	}
+}
+
+// Record the original user before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalUser(c Context, id string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.users[id]; ok {
+		return
+	}
+	if v, ok := s.users[id]; ok {
+		tx.users[id] = &v
+	} else {
+		tx.users[id] = nil
+	}
+}
+
+// Record the original group before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalGroup(c Context, id string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.groups[id]; ok {
+		return
+	}
+	if v, ok := s.groups[id]; ok {
+		tx.groups[id] = &v
+	} else {
+		tx.groups[id] = nil
+	}
+}
+
+// Record the original events of an item before modifying them in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalEvents(c Context, itemId string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.events[itemId]; !ok {
+		tx.events[itemId] = append([]ItemEvent(nil), s.events[itemId]...)
+	}
+}
+
+// Record the original deleted item before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalDeletedItem(c Context, id string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.deleted[id]; ok {
+		return
+	}
+	if v, ok := s.deleted[id]; ok {
+		tx.deleted[id] = &v
+	} else {
+		tx.deleted[id] = nil
+	}
+}
+
+// Record the original comments of an item before modifying them in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalComments(c Context, itemId string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.comments[itemId]; !ok {
+		tx.comments[itemId] = append([]ItemComment(nil), s.comments[itemId]...)
+	}
+}
+
+// Record the original saved search before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalSavedSearch(c Context, id string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.searches[id]; ok {
+		return
+	}
+	if v, ok := s.searches[id]; ok {
+		tx.searches[id] = &v
+	} else {
+		tx.searches[id] = nil
+	}
+}
+
+// Record the original search alert quota before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalSearchAlertQuota(c Context, userKey string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.quotas[userKey]; ok {
+		return
+	}
+	if v, ok := s.quotas[userKey]; ok {
+		tx.quotas[userKey] = &v
+	} else {
+		tx.quotas[userKey] = nil
+	}
+}
+
+// Record the original item deletion job before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalItemDeletionJob(c Context, id string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.deletions[id]; ok {
+		return
+	}
+	if v, ok := s.deletions[id]; ok {
+		tx.deletions[id] = &v
+	} else {
+		tx.deletions[id] = nil
+	}
+}
+
+// Record the original item backfill before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalItemBackfill(c Context, name string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.backfills[name]; ok {
+		return
+	}
+	if v, ok := s.backfills[name]; ok {
+		tx.backfills[name] = &v
+	} else {
+		tx.backfills[name] = nil
+	}
+}
+
+// Record the original idempotency record before modifying it in a transaction. Caller must hold s.mu.
+func (s *memoryStore) journalIdempotency(c Context, key string) {
+	tx := memoryTransactionOf(c)
+	if tx == nil {
+		return
+	}
+	if _, ok := tx.idempotency[key]; ok {
+		return
+	}
+	if v, ok := s.idempotency[key]; ok {
+		tx.idempotency[key] = &v
+	} else {
+		tx.idempotency[key] = nil
+	}
+}
+
+// Copy an item so that callers can't modify the stored one through slices
+func copyItem(item Item) Item {
+	item.Members = append([]ItemMember(nil), item.Members...)
+	item.OwnerChanges = append([]ItemOwnerChange(nil), item.OwnerChanges...)
+	item.Waitlist = append([]ItemMember(nil), item.Waitlist...)
+	item.Banned = append([]string(nil), item.Banned...)
+	return item
+}
+
+func copyGroup(group Group) Group {
+	group.Members = append([]string(nil), group.Members...)
+	return group
+}
+
+func (r memoryItemStore) Get(c Context, id string) (*Item, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	item := copyItem(v)
+	item.Id = id
+	return &item, nil
+}
+
+func (r memoryItemStore) Query(c Context, q ItemQuery) ([]Item, string, error) {
+	unlock := r.s.lock(c)
+	var dst []Item
+	for id, v := range r.s.items {
+		if matchItemFilters(&v, q.Filters) {
+			item := copyItem(v)
+			item.Id = id
+			dst = append(dst, item)
+		}
+	}
+	unlock()
+
+	// Sort by the order property, and then by ID to be deterministic
+	var property string = strings.TrimPrefix(q.Order, "-")
+	var descending bool = strings.HasPrefix(q.Order, "-")
+	sort.Slice(dst, func(i, j int) bool {
+		if property != "" {
+			a, _ := itemProperty(&dst[i], property)
+			b, _ := itemProperty(&dst[j], property)
+			if d, ok := compareValues(a, b); ok && d != 0 {
+				return (d < 0) != descending
+			}
+		}
+		return dst[i].Id < dst[j].Id
+	})
+
+	// Page by offsets
+	var offset int
+	if q.Cursor != "" {
+		var err error
+		if offset, err = decodeMemoryCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	if offset > len(dst) {
+		offset = len(dst)
+	}
+	dst = dst[offset:]
+	var next string
+	if q.Limit > 0 && len(dst) > q.Limit {
+		dst = dst[:q.Limit]
+		next = encodeMemoryCursor(offset + q.Limit)
+	}
+	return dst, next, nil
+}
+
+// Cursors of the memory store are offsets in the sorted query result.
+// Pages may skip or repeat items if items are created or deleted in between.
+func encodeMemoryCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+func decodeMemoryCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(b), "offset:") {
+		return 0, ErrInvalidCursor
+	}
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(b), "offset:"))
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return offset, nil
+}
+
+func (r memoryItemStore) Count(c Context) (int, error) {
+	defer r.s.lock(c)()
+	return len(r.s.items), nil
+}
+
+func (r memoryItemStore) Create(c Context, item *Item) (string, error) {
+	defer r.s.lock(c)()
+	id := r.s.newId()
+	r.s.journalItem(c, id)
+	item.Version = 1
+	r.s.items[id] = copyItem(*item)
+	return id, nil
+}
+
+func (r memoryItemStore) Update(c Context, id string, item *Item) error {
+	defer r.s.lock(c)()
+	if _, ok := r.s.items[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.journalItem(c, id)
+	item.Version++
+	r.s.items[id] = copyItem(*item)
+	return nil
+}
+
+func (r memoryItemStore) Delete(c Context, id string) error {
+	defer r.s.lock(c)()
+	if _, ok := r.s.items[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.journalItem(c, id)
+	delete(r.s.items, id)
+	return nil
+}
+
+func (r memoryUserStore) Get(c Context, id string) (*User, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &v, nil
+}
+
+func (r memoryUserStore) FindByInstanceId(c Context, instanceId string) (string, *User, error) {
+	defer r.s.lock(c)()
+	for id, v := range r.s.users {
+		if v.InstanceId == instanceId {
+			return id, &v, nil
+		}
+	}
+	return "", nil, nil
+}
+
+func (r memoryUserStore) Create(c Context, user *User) (string, error) {
+	defer r.s.lock(c)()
+	id := r.s.newId()
+	r.s.journalUser(c, id)
+	r.s.users[id] = *user
+	return id, nil
+}
+
+func (r memoryUserStore) Update(c Context, id string, user *User) error {
+	defer r.s.lock(c)()
+	r.s.journalUser(c, id)
+	r.s.users[id] = *user
+	return nil
+}
+
+func (r memoryGroupStore) FindByName(c Context, name string) (string, *Group, error) {
+	defer r.s.lock(c)()
+	for id, v := range r.s.groups {
+		if v.Name == name {
+			group := copyGroup(v)
+			return id, &group, nil
+		}
+	}
+	return "", nil, nil
+}
+
+func (r memoryGroupStore) Create(c Context, group *Group) (string, error) {
+	defer r.s.lock(c)()
+	id := r.s.newId()
+	r.s.journalGroup(c, id)
+	r.s.groups[id] = copyGroup(*group)
+	return id, nil
+}
+
+func (r memoryGroupStore) Update(c Context, id string, group *Group) error {
+	defer r.s.lock(c)()
+	r.s.journalGroup(c, id)
+	r.s.groups[id] = copyGroup(*group)
+	return nil
+}
+
+func (r memoryGroupStore) Delete(c Context, id string) error {
+	defer r.s.lock(c)()
+	r.s.journalGroup(c, id)
+	delete(r.s.groups, id)
+	return nil
+}
+
+// Get an item property by its datastore name
+func itemProperty(item *Item, name string) (interface{}, bool) {
+	switch name {
+	case "Image":
+		return item.Image, true
+	case "Thumbnail":
+		return item.Thumbnail, true
+	case "People":
+		return item.People, true
+	case "Attendant":
+		return item.Attendant, true
+	case "OpenSlots":
+		return item.OpenSlots, true
+	case "Latitude":
+		return item.Latitude, true
+	case "Longitude":
+		return item.Longitude, true
+	case "Geohash":
+		return item.Geohash, true
+	case "CreateTime":
+		return item.CreateTime, true
+	case "Deadline":
+		return item.Deadline, true
+	case "Status":
+		return item.Status, true
+	case "GcmGroupName":
+		return item.GcmGroupName, true
+	case "GcmGroupKey":
+		return item.GcmGroupKey, true
+	}
+	return nil, false
+}
+
+// Check whether an item satisfies all filters like datastore does
+func matchItemFilters(item *Item, filters []ItemFilter) bool {
+	for _, f := range filters {
+		v, ok := itemProperty(item, f.Property)
+		if !ok {
+			return false
+		}
+		d, ok := compareValues(v, f.Value)
+		if !ok {
+			return false
+		}
+		switch f.Operator {
+		case "=":
+			ok = d == 0
+		case "<":
+			ok = d < 0
+		case "<=":
+			ok = d <= 0
+		case ">":
+			ok = d > 0
+		case ">=":
+			ok = d >= 0
+		default:
+			ok = false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare two property values. Return -1, 0, 1 and whether they are comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case int:
+		y, ok := b.(int)
+		if !ok {
+			return 0, false
+		}
+		return compareFloat(float64(x), float64(y)), true
+	case int64:
+		y, ok := b.(int64)
+		if !ok {
+			return 0, false
+		}
+		return compareFloat(float64(x), float64(y)), true
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		return compareFloat(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if x == y {
+			return 0, true
+		} else if !x {
+			return -1, true
+		}
+		return 1, true
+	case time.Time:
+		y, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func compareFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func (r memoryIdempotencyStore) Get(c Context, key string, now time.Time) (*IdempotencyRecord, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.idempotency[key]
+	if !ok || v.ExpireTime.Before(now) {
+		return nil, ErrNotFound
+	}
+	v.Header = append([]string(nil), v.Header...)
+	v.Body = append([]byte(nil), v.Body...)
+	return &v, nil
+}
+
+func (r memoryIdempotencyStore) Put(c Context, key string, record *IdempotencyRecord) error {
+	defer r.s.lock(c)()
+	r.s.journalIdempotency(c, key)
+	v := *record
+	v.Header = append([]string(nil), v.Header...)
+	v.Body = append([]byte(nil), v.Body...)
+	r.s.idempotency[key] = v
+	return nil
+}
+
+func (r memoryIdempotencyStore) Delete(c Context, key string) error {
+	defer r.s.lock(c)()
+	r.s.journalIdempotency(c, key)
+	delete(r.s.idempotency, key)
+	return nil
+}
+
+func (r memoryIdempotencyStore) DeleteExpired(c Context, now time.Time) (int, error) {
+	defer r.s.lock(c)()
+	var n int
+	for key, v := range r.s.idempotency {
+		if v.ExpireTime.Before(now) {
+			r.s.journalIdempotency(c, key)
+			delete(r.s.idempotency, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r memoryItemEventStore) Create(c Context, itemId string, event *ItemEvent) (string, error) {
+	defer r.s.lock(c)()
+	r.s.journalEvents(c, itemId)
+	event.Id = r.s.newId()
+	r.s.events[itemId] = append(r.s.events[itemId], *event)
+	return event.Id, nil
+}
+
+// Cursors are offsets like item queries. Events never move because they are only appended.
+func (r memoryItemEventStore) List(c Context, itemId string, cursor string, limit int) ([]ItemEvent, string, error) {
+	defer r.s.lock(c)()
+	var offset int
+	if cursor != "" {
+		var err error
+		if offset, err = decodeMemoryCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	var events []ItemEvent = r.s.events[itemId]
+	if offset > len(events) {
+		offset = len(events)
+	}
+	events = events[offset:]
+	var next string
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+		next = encodeMemoryCursor(offset + limit)
+	}
+	return append([]ItemEvent(nil), events...), next, nil
+}
+
+func (r memoryItemCommentStore) Get(c Context, itemId string, id string) (*ItemComment, error) {
+	defer r.s.lock(c)()
+	for _, v := range r.s.comments[itemId] {
+		if v.Id == id {
+			return &v, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Cursors are offsets like item queries. Pages may skip comments deleted in between.
+func (r memoryItemCommentStore) List(c Context, itemId string, cursor string, limit int) ([]ItemComment, string, error) {
+	defer r.s.lock(c)()
+	var offset int
+	if cursor != "" {
+		var err error
+		if offset, err = decodeMemoryCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	var comments []ItemComment = r.s.comments[itemId]
+	if offset > len(comments) {
+		offset = len(comments)
+	}
+	comments = comments[offset:]
+	var next string
+	if limit > 0 && len(comments) > limit {
+		comments = comments[:limit]
+		next = encodeMemoryCursor(offset + limit)
+	}
+	return append([]ItemComment(nil), comments...), next, nil
+}
+
+func (r memoryItemCommentStore) Create(c Context, itemId string, comment *ItemComment) (string, error) {
+	defer r.s.lock(c)()
+	r.s.journalComments(c, itemId)
+	comment.Id = r.s.newId()
+	r.s.comments[itemId] = append(r.s.comments[itemId], *comment)
+	return comment.Id, nil
+}
+
+func (r memoryItemCommentStore) Delete(c Context, itemId string, id string) error {
+	defer r.s.lock(c)()
+	var a []ItemComment = r.s.comments[itemId]
+	for i, v := range a {
+		if v.Id == id {
+			r.s.journalComments(c, itemId)
+			r.s.comments[itemId] = append(append([]ItemComment(nil), a[:i]...), a[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r memoryDeletedItemStore) Get(c Context, id string) (*DeletedItem, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.deleted[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	v.Item = copyItem(v.Item)
+	return &v, nil
+}
+
+func (r memoryDeletedItemStore) Create(c Context, id string, item *DeletedItem) error {
+	defer r.s.lock(c)()
+	r.s.journalDeletedItem(c, id)
+	v := *item
+	v.Item = copyItem(v.Item)
+	v.Item.Id = id
+	r.s.deleted[id] = v
+	return nil
+}
+
+func (r memoryDeletedItemStore) Restore(c Context, id string, item *Item) error {
+	defer r.s.lock(c)()
+	if _, ok := r.s.deleted[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.journalDeletedItem(c, id)
+	r.s.journalItem(c, id)
+	delete(r.s.deleted, id)
+	item.Version++
+	v := copyItem(*item)
+	v.Id = id
+	r.s.items[id] = v
+	return nil
+}
+
+func (r memoryDeletedItemStore) Purge(c Context, id string) error {
+	defer r.s.lock(c)()
+	if _, ok := r.s.deleted[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.journalDeletedItem(c, id)
+	r.s.journalEvents(c, id)
+	r.s.journalComments(c, id)
+	delete(r.s.deleted, id)
+	delete(r.s.events, id)
+	delete(r.s.comments, id)
+	return nil
+}
+
+func (r memoryDeletedItemStore) Expired(c Context, before time.Time, limit int) ([]DeletedItem, error) {
+	defer r.s.lock(c)()
+	var dst []DeletedItem
+	for _, v := range r.s.deleted {
+		if v.DeleteTime.Before(before) {
+			v.Item = copyItem(v.Item)
+			dst = append(dst, v)
+		}
+	}
+	sort.Slice(dst, func(i, j int) bool {
+		return dst[i].DeleteTime.Before(dst[j].DeleteTime)
+	})
+	if limit > 0 && len(dst) > limit {
+		dst = dst[:limit]
+	}
+	return dst, nil
+}
+
+func copySavedSearch(search SavedSearch) SavedSearch {
+	search.Keywords = append([]string(nil), search.Keywords...)
+	return search
+}
+
+// Saved searches which pass the filter in creation order. Caller must hold s.mu.
+func (s *memoryStore) findSavedSearches(f func(v *SavedSearch) bool) []SavedSearch {
+	var dst []SavedSearch
+	for id, v := range s.searches {
+		if f(&v) {
+			v = copySavedSearch(v)
+			v.Id = id
+			dst = append(dst, v)
+		}
+	}
+	sort.Slice(dst, func(i, j int) bool {
+		if !dst[i].CreateTime.Equal(dst[j].CreateTime) {
+			return dst[i].CreateTime.Before(dst[j].CreateTime)
+		}
+		return dst[i].Id < dst[j].Id
+	})
+	return dst
+}
+
+func (r memorySavedSearchStore) Get(c Context, id string) (*SavedSearch, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.searches[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	v = copySavedSearch(v)
+	v.Id = id
+	return &v, nil
+}
+
+func (r memorySavedSearchStore) ListByUser(c Context, userKey string) ([]SavedSearch, error) {
+	defer r.s.lock(c)()
+	return r.s.findSavedSearches(func(v *SavedSearch) bool {
+		return v.UserKey == userKey
+	}), nil
+}
+
+func (r memorySavedSearchStore) FindByGeohashPrefix(c Context, prefix string) ([]SavedSearch, error) {
+	defer r.s.lock(c)()
+	return r.s.findSavedSearches(func(v *SavedSearch) bool {
+		return strings.HasPrefix(v.Geohash, prefix)
+	}), nil
+}
+
+func (r memorySavedSearchStore) Create(c Context, search *SavedSearch) (string, error) {
+	defer r.s.lock(c)()
+	id := r.s.newId()
+	r.s.journalSavedSearch(c, id)
+	search.Id = id
+	r.s.searches[id] = copySavedSearch(*search)
+	return id, nil
+}
+
+func (r memorySavedSearchStore) Delete(c Context, id string) error {
+	defer r.s.lock(c)()
+	if _, ok := r.s.searches[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.journalSavedSearch(c, id)
+	delete(r.s.searches, id)
+	return nil
+}
+
+func (r memorySearchAlertQuotaStore) Get(c Context, userKey string) (*SearchAlertQuota, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.quotas[userKey]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &v, nil
+}
+
+func (r memorySearchAlertQuotaStore) Put(c Context, userKey string, quota *SearchAlertQuota) error {
+	defer r.s.lock(c)()
+	r.s.journalSearchAlertQuota(c, userKey)
+	r.s.quotas[userKey] = *quota
+	return nil
+}
+
+func (r memoryItemDeletionJobStore) Get(c Context, id string) (*ItemDeletionJob, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.deletions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	v.Id = id
+	return &v, nil
+}
+
+func (r memoryItemDeletionJobStore) Create(c Context, job *ItemDeletionJob) (string, error) {
+	defer r.s.lock(c)()
+	id := r.s.newId()
+	r.s.journalItemDeletionJob(c, id)
+	job.Id = id
+	r.s.deletions[id] = *job
+	return id, nil
+}
+
+func (r memoryItemDeletionJobStore) Update(c Context, id string, job *ItemDeletionJob) error {
+	defer r.s.lock(c)()
+	if _, ok := r.s.deletions[id]; !ok {
+		return ErrNotFound
+	}
+	r.s.journalItemDeletionJob(c, id)
+	r.s.deletions[id] = *job
+	return nil
+}
+
+func (r memoryItemBackfillStore) Get(c Context, name string) (*ItemBackfill, error) {
+	defer r.s.lock(c)()
+	v, ok := r.s.backfills[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &v, nil
+}
+
+func (r memoryItemBackfillStore) Put(c Context, name string, backfill *ItemBackfill) error {
+	defer r.s.lock(c)()
+	r.s.journalItemBackfill(c, name)
+	r.s.backfills[name] = *backfill
+	return nil
+}
+
+func (r memoryDeletedItemStore) FindByBlob(c Context, blobUrl string, limit int) ([]DeletedItem, error) {
+	defer r.s.lock(c)()
+	var dst []DeletedItem
+	for id, v := range r.s.deleted {
+		if limit > 0 && len(dst) == limit {
+			break
+		}
+		if v.Item.Image == blobUrl || v.Item.Thumbnail == blobUrl {
+			v.Item = copyItem(v.Item)
+			v.Item.Id = id
+			dst = append(dst, v)
+		}
+	}
+	return dst, nil
+}
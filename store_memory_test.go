@@ -0,0 +1,89 @@
+package aliza
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransactionIsolation(t *testing.T) {
+	s := NewMemoryStore()
+	c := NewBackgroundLogContext("test")
+
+	counted := make(chan int)
+	err := s.RunInTransaction(c, func(tc Context) error {
+		if _, err := s.Items().Create(tc, &Item{People: 2}); err != nil {
+			return err
+		}
+		// Readers outside the transaction wait until it commits
+		go func() {
+			n, _ := s.Items().Count(c)
+			counted <- n
+		}()
+		select {
+		case n := <-counted:
+			t.Errorf("Counted %d items before commit", n)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := <-counted; n != 1 {
+		t.Errorf("Counted %d items after commit", n)
+	}
+}
+
+func TestMemoryTransactionRollback(t *testing.T) {
+	s := NewMemoryStore()
+	c := NewBackgroundLogContext("test")
+	var item Item = Item{People: 2}
+	id, _ := s.Items().Create(c, &item)
+
+	failure := errors.New("failure")
+	err := s.RunInTransaction(c, func(tc Context) error {
+		pItem, err := s.Items().Get(tc, id)
+		if err != nil {
+			return err
+		}
+		pItem.People = 5
+		if err = s.Items().Update(tc, id, pItem); err != nil {
+			return err
+		}
+		if _, err = s.Items().Create(tc, &Item{People: 3}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("Got %v", err)
+	}
+	if pItem, _ := s.Items().Get(c, id); pItem.People != 2 || pItem.Version != item.Version {
+		t.Errorf("Got %+v after rollback", pItem)
+	}
+	if n, _ := s.Items().Count(c); n != 1 {
+		t.Errorf("Counted %d items after rollback", n)
+	}
+}
+
+func TestMemoryTransactionNested(t *testing.T) {
+	s := NewMemoryStore()
+	err := s.RunInTransaction(NewBackgroundLogContext("test"), func(tc Context) error {
+		return s.RunInTransaction(tc, func(Context) error { return nil })
+	})
+	if err != ErrNestedTransaction {
+		t.Errorf("Got %v", err)
+	}
+}
+
+func TestMemoryItemUpdateMissing(t *testing.T) {
+	s := NewMemoryStore()
+	c := NewBackgroundLogContext("test")
+	if err := s.Items().Update(c, "42", &Item{}); err != ErrNotFound {
+		t.Errorf("Got %v", err)
+	}
+	if _, err := s.Items().Get(c, "42"); err != ErrNotFound {
+		t.Errorf("Update created the item")
+	}
+}
@@ -0,0 +1,146 @@
+package aliza
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// The max number of items to close in one sweep. The rest are closed in the next sweep.
+const ExpireItemsBatchSize = 100
+
+// Header APP Engine sets on requests from cron jobs. It's removed from external requests.
+const HttpHeaderAppengineCron = "X-Appengine-Cron"
+
+// Result of a sweep
+type ExpireItemsResponseBody struct {
+	Closed int `json:"closed"`
+}
+
+// GET ./tasks/expire-items
+// Called by the cron job in cron.yaml. Served only on APP Engine. Expired idempotency records are deleted, deleted items are purged
+// and items stored before their indexed properties existed are backfilled too.
+// Success: 200 OK with the number of closed items
+// Failure: 403 Forbidden, 500 Internal Server Error
+func expireItemsTask(rw http.ResponseWriter, req *http.Request) {
+	// Appengine
+	var c Context = newContext(req)
+	// Result
+	var r int = http.StatusOK
+	// The number of closed items
+	var n int
+
+	defer func() {
+		if r == http.StatusOK {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(r)
+			json.NewEncoder(rw).Encode(ExpireItemsResponseBody{Closed: n})
+		} else {
+			writeError(rw, r, nil)
+		}
+	}()
+
+	// Only cron jobs can sweep
+	if req.Header.Get(HttpHeaderAppengineCron) != "true" {
+		c.Warningf("Request is not from cron. Ignore.")
+		r = http.StatusForbidden
+		return
+	}
+
+	var err error
+	if n, err = ExpireItems(c, time.Now()); err != nil {
+		c.Errorf("%s in closing expired items. %d items are closed.", err, n)
+		r = http.StatusInternalServerError
+		return
+	}
+	// Responses kept for retries expire along with items, deleted items are purged and old items are backfilled.
+	// Items are closed anyway in failure.
+	ExpireIdempotencyRecords(c, time.Now())
+	PurgeDeletedItems(c, time.Now())
+	BackfillItems(c, time.Now())
+}
+
+// Statuses of items to sweep. Items stored with an empty status are open. Items stored before
+// the status existed don't have it at all, so they are found only after BackfillItems stores them again.
+var expiringItemStatuses = append([]string{""}, activeItemStatuses...)
+
+// Close active items whose deadlines have passed. Notify the members and remove the GCM groups.
+// Closed items stay so that members can look back. Return the number of closed items.
+func ExpireItems(c Context, now time.Time) (n int, err error) {
+	for _, status := range expiringItemStatuses {
+		// Items in the status with deadlines before now
+		var items []Item
+		items, _, err = store.Items().Query(c, ItemQuery{
+			Filters: []ItemFilter{
+				{"Status", "=", status},
+				{"Deadline", ">", time.Time{}},
+				{"Deadline", "<=", now},
+			},
+			Order: "Deadline",
+			Limit: ExpireItemsBatchSize - n,
+		})
+		if err != nil {
+			c.Errorf("%s in querying expired %s items", err, status)
+			return
+		}
+		c.Debugf("%d %s items expire at %s", len(items), status, now)
+
+		for _, v := range items {
+			var item Item
+			var notification ItemUpdateNotification
+			var closed bool
+			if closed, err = closeExpiredItem(c, v.Id, now, &item, &notification); err != nil {
+				c.Errorf("%s in closing expired item %s", err, v.Id)
+				return
+			}
+			if !closed {
+				continue
+			}
+			n++
+			c.Infof("Item %s is closed because its deadline %s passed", v.Id, item.Deadline)
+
+			// Tell members and remove the GCM group. Keep going in failure because the item is closed anyway.
+			notification.ItemId = v.Id
+			if r := sendItemGcmMessage(c, &item, &notification); r != http.StatusOK {
+				c.Warningf("Send notification to all members of item %s failed", v.Id)
+			}
+			if r := updateItemGcmGroup(c, stateDeleteItem, &item, nil); r != http.StatusOK {
+				c.Warningf("Remove GCM group of item %s failed", v.Id)
+			}
+		}
+		if n >= ExpireItemsBatchSize {
+			return
+		}
+	}
+	return
+}
+
+// Close an item whose deadline passed in a transaction. Return false if it's no longer to close.
+func closeExpiredItem(c Context, id string, now time.Time, pItem *Item, pNotification *ItemUpdateNotification) (closed bool, err error) {
+	err = store.RunInTransaction(c, func(tc Context) error {
+		closed = false
+		// The item may have been changed since the query
+		p, err1 := store.Items().Get(tc, id)
+		if err1 == ErrNotFound {
+			return nil
+		} else if err1 != nil {
+			return err1
+		}
+		if p.Deadline.IsZero() || p.Deadline.After(now) || !isItemActive(p) {
+			return nil
+		}
+		*pItem = *p
+		pNotification.Message = "Item deadline passed. "
+		if e := transitItem(pItem, ItemStatusClosed, pNotification); e != nil {
+			return e
+		}
+		closed = true
+		event := statusChangedEvent("", ItemStatusClosed, time.Unix(now.Unix(), 0))
+		event.Detail = "Deadline passed"
+		if err1 = saveItemEvents(tc, id, []ItemEvent{event}); err1 != nil {
+			return err1
+		}
+		return store.Items().Update(tc, id, pItem)
+	})
+	return
+}